@@ -0,0 +1,438 @@
+package udxtransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+const (
+	// packetRefused is a listener's answer to the first packet of a source
+	// it doesn't admit. Its payload is the nonce of the dialer's padding,
+	// so only a listener that saw the padding can fail the dial.
+	packetRefused   byte = 0xDC
+	refusalNonceLen      = 8
+
+	// refusalMemory is how long the packets of a source the gate refused
+	// are dropped without asking it again. It outlasts paddingDelay, so a
+	// dialer padding late still learns of the refusal.
+	refusalMemory = 2 * paddingDelay
+
+	// admissionLifetime is how long a source admitted by the gate has to
+	// complete UDX's handshake before its scope is released.
+	admissionLifetime = 10 * time.Second
+	// admittedIdle is how long a source stays admitted after its last
+	// packet, like validatedIdle.
+	admittedIdle = validatedIdle
+	// maxPrefixAdmissions bounds the admissions from one /24 or /48, so a
+	// single network can't take every half-open slot.
+	maxPrefixAdmissions = 8
+)
+
+// sourceGate admits the sources of a listener's socket on their first packet
+// for UDX, before UDX keeps any state for them. Sources the transport dials
+// are admitted without asking the gate.
+type sourceGate struct {
+	mu       sync.RWMutex
+	gate     func(netip.AddrPort) bool // nil without a listener on the socket
+	release  func(netip.AddrPort)      // releases the admission the gate made for a source
+	admitted map[netip.AddrPort]*atomic.Int64
+	swept    time.Time
+	nonces   map[netip.AddrPort][]byte    // padding nonces of sources not admitted yet
+	refusals map[netip.AddrPort]time.Time // when the gate refused sources lately
+	dials    map[netip.AddrPort][]*pendingDial
+}
+
+// pendingDial is an outbound dial waiting for UDX's handshake.
+type pendingDial struct {
+	nonce  []byte
+	refuse func() // fails the dial with ErrConnRefused
+}
+
+// setGate makes the socket ask gate about every new source, and call release
+// for a source that turns out to be an established connection's new address.
+// A nil gate lets every source through.
+func (d *packetDemux) setGate(gate func(netip.AddrPort) bool, release func(netip.AddrPort)) {
+	d.gt.mu.Lock()
+	defer d.gt.mu.Unlock()
+	d.gt.gate = gate
+	d.gt.release = release
+	d.gt.nonces = nil
+	d.gt.refusals = nil
+}
+
+// pass reports whether a packet from addr may go on to UDX, asking the gate
+// about sources that aren't admitted yet. A refused source is told so if
+// its padding left a nonce to answer with, and its packets are dropped
+// without asking the gate again for refusalMemory. Otherwise, if it takes
+// the transport's packets, it may be an established connection that moved
+// to a new address, so it gets a retry: the transport answers those for its
+// connections, which lets the new address through without the gate (see
+// checkToken). Other sources, such as stock go-udx dialers, hear nothing.
+func (d *packetDemux) pass(pkt []byte, addr net.Addr) bool {
+	d.gt.mu.RLock()
+	gate := d.gt.gate
+	d.gt.mu.RUnlock()
+	if gate == nil {
+		return true
+	}
+	ap, ok := addrPortOf(addr)
+	if !ok || d.isAdmitted(ap) {
+		return true
+	}
+	if !d.refusedLately(ap) && gate(ap) {
+		d.gt.mu.Lock()
+		delete(d.gt.nonces, ap)
+		d.gt.mu.Unlock()
+		d.admitSource(ap)
+		return true
+	}
+	switch nonce := d.refuseSource(ap); {
+	case nonce != nil:
+		d.PacketConn.WriteTo(append([]byte{packetRefused}, nonce...), addr)
+	case d.speaks(ap):
+		d.sendRetry(pkt, addr, ap)
+	}
+	return false
+}
+
+// refuseSource remembers that the gate refused ap, and takes the nonce of
+// its padding if it left one.
+func (d *packetDemux) refuseSource(ap netip.AddrPort) (nonce []byte) {
+	now := d.clock.Now()
+	d.gt.mu.Lock()
+	defer d.gt.mu.Unlock()
+	nonce = d.gt.nonces[ap]
+	delete(d.gt.nonces, ap)
+	if _, ok := d.gt.refusals[ap]; !ok {
+		if d.gt.refusals == nil {
+			d.gt.refusals = make(map[netip.AddrPort]time.Time)
+		}
+		if len(d.gt.refusals) >= maxUnvalidatedSources {
+			for src, at := range d.gt.refusals {
+				if now.Sub(at) >= refusalMemory {
+					delete(d.gt.refusals, src)
+				}
+			}
+		}
+		if len(d.gt.refusals) >= maxUnvalidatedSources {
+			// The gate is asked again sooner; nothing else depends on it.
+			clear(d.gt.refusals)
+		}
+		d.gt.refusals[ap] = now
+	}
+	return nonce
+}
+
+// refusedLately reports whether the gate refused ap less than refusalMemory
+// ago.
+func (d *packetDemux) refusedLately(ap netip.AddrPort) bool {
+	d.gt.mu.RLock()
+	at, ok := d.gt.refusals[ap]
+	d.gt.mu.RUnlock()
+	return ok && d.clock.Now().Sub(at) < refusalMemory
+}
+
+// keepNonce remembers the nonce of a padding packet from a source the gate
+// hasn't decided on yet. A source the gate refused lately is told so right
+// away: its dialer padded late (see dialPadding).
+func (d *packetDemux) keepNonce(pkt []byte, addr net.Addr) {
+	if len(pkt) < 1+refusalNonceLen {
+		return
+	}
+	ap, ok := addrPortOf(addr)
+	if !ok || d.isAdmitted(ap) {
+		return
+	}
+	nonce := bytes.Clone(pkt[1 : 1+refusalNonceLen])
+	if d.refusedLately(ap) {
+		d.PacketConn.WriteTo(append([]byte{packetRefused}, nonce...), addr)
+		return
+	}
+	d.gt.mu.Lock()
+	defer d.gt.mu.Unlock()
+	if d.gt.gate == nil {
+		return
+	}
+	if d.gt.nonces == nil {
+		d.gt.nonces = make(map[netip.AddrPort][]byte)
+	}
+	if len(d.gt.nonces) >= maxUnvalidatedSources {
+		// Sources that padded and went quiet; the nonce is a courtesy.
+		clear(d.gt.nonces)
+	}
+	d.gt.nonces[ap] = nonce
+}
+
+// admitSource lets the packets of ap through the gate, for admittedIdle after
+// the last one.
+func (d *packetDemux) admitSource(ap netip.AddrPort) {
+	now := d.clock.Now()
+	d.gt.mu.Lock()
+	defer d.gt.mu.Unlock()
+	if d.gt.admitted == nil {
+		d.gt.admitted = make(map[netip.AddrPort]*atomic.Int64)
+	}
+	if now.Sub(d.gt.swept) >= admittedIdle {
+		for src, last := range d.gt.admitted {
+			if now.Sub(time.Unix(0, last.Load())) >= admittedIdle {
+				delete(d.gt.admitted, src)
+			}
+		}
+		d.gt.swept = now
+	}
+	last := new(atomic.Int64)
+	last.Store(now.UnixNano())
+	d.gt.admitted[ap] = last
+}
+
+// admitPath lets the packets of ap, the new address of an established
+// connection, through the socket. The admission the gate may have made for
+// it is released: no new connection comes from there.
+func (d *packetDemux) admitPath(ap netip.AddrPort) {
+	d.allow(ap)
+	d.admitSource(ap)
+	d.gt.mu.RLock()
+	release := d.gt.release
+	d.gt.mu.RUnlock()
+	if release != nil {
+		release(ap)
+	}
+}
+
+// isAdmitted reports whether ap is admitted, keeping it so.
+func (d *packetDemux) isAdmitted(ap netip.AddrPort) bool {
+	d.gt.mu.RLock()
+	last := d.gt.admitted[ap]
+	pending := len(d.gt.dials[ap]) > 0
+	d.gt.mu.RUnlock()
+	if pending {
+		return true
+	}
+	if last == nil {
+		return false
+	}
+	now := d.clock.Now()
+	if now.Sub(time.Unix(0, last.Load())) >= admittedIdle {
+		return false
+	}
+	last.Store(now.UnixNano())
+	return true
+}
+
+// addDial registers a dial to ap, which refuse fails if the listener
+// refuses it. It returns the nonce for the dial's padding, and a function
+// that removes the dial again.
+func (d *packetDemux) addDial(ap netip.AddrPort, refuse func()) (nonce []byte, remove func()) {
+	pd := &pendingDial{nonce: make([]byte, refusalNonceLen), refuse: refuse}
+	rand.Read(pd.nonce)
+	d.gt.mu.Lock()
+	defer d.gt.mu.Unlock()
+	if d.gt.dials == nil {
+		d.gt.dials = make(map[netip.AddrPort][]*pendingDial)
+	}
+	d.gt.dials[ap] = append(d.gt.dials[ap], pd)
+	return pd.nonce, func() {
+		d.gt.mu.Lock()
+		defer d.gt.mu.Unlock()
+		dials := d.gt.dials[ap]
+		for i, other := range dials {
+			if other == pd {
+				dials = append(dials[:i], dials[i+1:]...)
+				break
+			}
+		}
+		if len(dials) == 0 {
+			delete(d.gt.dials, ap)
+		} else {
+			d.gt.dials[ap] = dials
+		}
+	}
+}
+
+// dialing reports whether a dial to ap is waiting for UDX's handshake.
+func (d *packetDemux) dialing(ap netip.AddrPort) bool {
+	d.gt.mu.RLock()
+	defer d.gt.mu.RUnlock()
+	return len(d.gt.dials[ap]) > 0
+}
+
+// refused fails the pending dial a refusal packet from addr answers.
+func (d *packetDemux) refused(pkt []byte, addr net.Addr) {
+	ap, ok := addrPortOf(addr)
+	if !ok || len(pkt) != 1+refusalNonceLen {
+		return
+	}
+	d.gt.mu.RLock()
+	defer d.gt.mu.RUnlock()
+	for _, pd := range d.gt.dials[ap] {
+		if bytes.Equal(pd.nonce, pkt[1:]) {
+			pd.refuse()
+		}
+	}
+}
+
+// admission is the scope of a source the gate admitted, waiting for UDX to
+// accept its connection.
+type admission struct {
+	scope network.ConnManagementScope
+	stop  func() bool // cancels the release of the scope after admissionLifetime
+}
+
+// gate runs the connection gater and the resource manager on the first
+// packet of a new source. The scope it opens is handed to the connection
+// UDX accepts from the source, or released after admissionLifetime. Past
+// the half-open limit, or past maxPrefixAdmissions from the source's
+// prefix, new sources are refused. A spoofer has to spread its packets over
+// that many prefixes to fill the admissions.
+//
+// A connection migrating to an address the gate admits has its admission
+// released once UDX reports the migration. One whose new address the gate
+// refuses gets through by answering a retry (see pass).
+func (l *rawListener) gate(ap netip.AddrPort) bool {
+	remoteMaddr, err := toUDXMultiaddr(ap.Addr().String(), int(ap.Port()))
+	if err != nil {
+		return false
+	}
+	prefix := admissionPrefix(ap)
+	// The lock is held while the gater and the resource manager decide, so
+	// the limits can't be overrun between the check and the insert. Only
+	// the socket's reader calls gate.
+	l.admissionsMu.Lock()
+	defer l.admissionsMu.Unlock()
+	old := l.admissions[ap]
+	if old == nil && (len(l.admissions) >= cap(l.halfOpen) || l.prefixes[prefix] >= maxPrefixAdmissions) {
+		return false
+	}
+	if l.ctx.Err() != nil {
+		return false
+	}
+	scope, ok := l.admit(remoteMaddr)
+	if !ok {
+		return false
+	}
+	if old != nil {
+		old.stop()
+		old.scope.Done()
+	} else {
+		l.prefixes[prefix]++
+	}
+	a := &admission{scope: scope}
+	l.admissions[ap] = a
+	a.stop = l.transport.clock.AfterFunc(admissionLifetime, func() {
+		if l.takeAdmission(ap, a) {
+			scope.Done()
+		}
+	})
+	return true
+}
+
+// releaseAdmission releases the admission of ap, the new address of an
+// established connection rather than a new source.
+func (l *rawListener) releaseAdmission(ap netip.AddrPort) {
+	l.admissionsMu.Lock()
+	a := l.admissions[ap]
+	l.admissionsMu.Unlock()
+	if a != nil && l.takeAdmission(ap, a) {
+		a.stop()
+		a.scope.Done()
+	}
+}
+
+// admissionPrefix returns the prefix of ap's address that its admissions
+// count towards: a /24 for IPv4, a /48 for IPv6.
+func admissionPrefix(ap netip.AddrPort) netip.Prefix {
+	bits := 48
+	if ap.Addr().Is4() {
+		bits = 24
+	}
+	prefix, _ := ap.Addr().Prefix(bits)
+	return prefix
+}
+
+// removeAdmissionLocked removes the admission of ap. The caller holds
+// admissionsMu.
+func (l *rawListener) removeAdmissionLocked(ap netip.AddrPort) {
+	delete(l.admissions, ap)
+	prefix := admissionPrefix(ap)
+	if l.prefixes[prefix]--; l.prefixes[prefix] <= 0 {
+		delete(l.prefixes, prefix)
+	}
+}
+
+// admissionOf takes the scope the gate opened for the connection UDX
+// accepted from addr, if there is one.
+func (l *rawListener) admissionOf(addr net.Addr) (network.ConnManagementScope, bool) {
+	ap, ok := addrPortOf(addr)
+	if !ok {
+		return nil, false
+	}
+	l.admissionsMu.Lock()
+	a := l.admissions[ap]
+	l.admissionsMu.Unlock()
+	if a == nil || !l.takeAdmission(ap, a) {
+		return nil, false
+	}
+	a.stop()
+	return a.scope, true
+}
+
+// takeAdmission removes a from the admissions, reporting whether it was
+// still there.
+func (l *rawListener) takeAdmission(ap netip.AddrPort, a *admission) bool {
+	l.admissionsMu.Lock()
+	defer l.admissionsMu.Unlock()
+	if l.admissions[ap] != a {
+		return false
+	}
+	l.removeAdmissionLocked(ap)
+	return true
+}
+
+// releaseAdmissions releases the scopes of every admission.
+func (l *rawListener) releaseAdmissions() {
+	l.admissionsMu.Lock()
+	defer l.admissionsMu.Unlock()
+	for ap, a := range l.admissions {
+		a.stop()
+		a.scope.Done()
+		l.removeAdmissionLocked(ap)
+	}
+}
+
+// startDial prepares a dial to raddr from m: its source is validated and
+// admitted, and unless pad is false, the padding ahead of UDX's handshake
+// goes out after delay. The returned context is canceled if the listener
+// refuses the dial, which refused then reports; done is called once UDX's
+// handshake is over, and cancels padding that hasn't gone out yet.
+func (m *udpMux) startDial(ctx context.Context, raddr *net.UDPAddr, delay time.Duration, pad bool) (dialCtx context.Context, refused func() bool, done func()) {
+	dialCtx, cancel := context.WithCancelCause(ctx)
+	var nonce []byte
+	remove := func() {}
+	if ap, ok := addrPortOf(raddr); ok {
+		m.demux.allow(ap)
+		m.demux.admitSource(ap)
+		nonce, remove = m.demux.addDial(ap, func() { cancel(ErrConnRefused) })
+	}
+	stopPadding := func() bool { return false }
+	switch {
+	case !pad:
+	case delay <= 0:
+		m.sendPadding(raddr, nonce)
+	default:
+		stopPadding = m.demux.clock.AfterFunc(delay, func() { m.sendPadding(raddr, nonce) })
+	}
+	refused = func() bool { return context.Cause(dialCtx) == ErrConnRefused }
+	return dialCtx, refused, func() {
+		stopPadding()
+		remove()
+		cancel(nil)
+	}
+}
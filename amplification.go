@@ -0,0 +1,147 @@
+package udxtransport
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	udx "github.com/stephanfeb/go-udx"
+)
+
+const (
+	// amplificationFactor caps the bytes sent to a source that isn't
+	// validated at this many times the bytes received from it, as in QUIC.
+	amplificationFactor = 3
+	// maxUnvalidatedSources bounds the sources the limit keeps count for;
+	// packets from further unvalidated sources are dropped.
+	maxUnvalidatedSources = 1 << 14
+	// unvalidatedIdle is how long the count of a source that isn't validated
+	// is kept after its last packet, well past the time its handshake may
+	// take.
+	unvalidatedIdle = time.Minute
+
+	// packetPadding is sent by a dialer ahead of UDX's handshake, when
+	// dialPadding allows. The listener discards it, but counts its bytes
+	// towards the limit, as QUIC pads its first packets to 1200 bytes.
+	packetPadding  byte = 0xDB
+	dialPaddingLen      = baseMTU
+)
+
+// amplificationBudget counts the bytes exchanged with a source that isn't
+// validated.
+type amplificationBudget struct {
+	mu       sync.Mutex
+	received int
+	sent     int
+	last     time.Time // of the last packet received
+}
+
+// countReceived counts a packet from addr towards the anti-amplification
+// limit if its source isn't validated. It reports false if the packet must
+// be dropped because too many sources are being counted already.
+func (d *packetDemux) countReceived(addr net.Addr, n int) bool {
+	ap, ok := addrPortOf(addr)
+	if !ok || d.isValidated(ap) {
+		return true
+	}
+	now := d.clock.Now()
+	d.sv.mu.RLock()
+	b := d.sv.budgets[ap]
+	d.sv.mu.RUnlock()
+	if b == nil {
+		d.sv.mu.Lock()
+		if b = d.sv.budgets[ap]; b == nil {
+			if d.sv.budgets == nil {
+				d.sv.budgets = make(map[netip.AddrPort]*amplificationBudget)
+			}
+			if len(d.sv.budgets) >= maxUnvalidatedSources {
+				d.sweepBudgetsLocked(now)
+			}
+			if len(d.sv.budgets) >= maxUnvalidatedSources {
+				d.sv.mu.Unlock()
+				return false
+			}
+			b = &amplificationBudget{}
+			d.sv.budgets[ap] = b
+		}
+		d.sv.mu.Unlock()
+	}
+	b.mu.Lock()
+	b.received += n
+	b.last = now
+	b.mu.Unlock()
+	return true
+}
+
+func (d *packetDemux) sweepBudgetsLocked(now time.Time) {
+	for ap, b := range d.sv.budgets {
+		b.mu.Lock()
+		idle := now.Sub(b.last) >= unvalidatedIdle
+		b.mu.Unlock()
+		if idle {
+			delete(d.sv.budgets, ap)
+		}
+	}
+}
+
+// WriteTo sends a packet of UDX's, unless it would take the bytes sent to
+// a source that isn't validated past the anti-amplification limit. Such a
+// packet is dropped as if lost, and UDX retransmits it once the source has
+// sent more. Packets to a connection's remote go through its pacer, if it
+// has one, which queues them until the pacing rate allows them out. The
+// write never waits for the pacer.
+func (d *packetDemux) WriteTo(p []byte, addr net.Addr) (int, error) {
+	ap, ok := addrPortOf(addr)
+	if !ok {
+		return d.PacketConn.WriteTo(p, addr)
+	}
+	if !d.maySend(ap, len(p)) {
+		if d.metrics != nil {
+			d.metrics.AmplificationLimited(len(p))
+		}
+		return len(p), nil
+	}
+	if pc := d.pacerOf(ap); pc != nil {
+		return pc.send(p, addr)
+	}
+	return d.PacketConn.WriteTo(p, addr)
+}
+
+// maySend reports whether n more bytes may go to ap, counting them if so.
+// Sources with no count are ones the transport contacted first.
+func (d *packetDemux) maySend(ap netip.AddrPort, n int) bool {
+	d.sv.mu.RLock()
+	b := d.sv.budgets[ap]
+	d.sv.mu.RUnlock()
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sent+n > amplificationFactor*b.received {
+		return false
+	}
+	b.sent += n
+	return true
+}
+
+// sendPadding gives a listener room to answer UDX's handshake under its
+// anti-amplification limit. The padding carries nonce, which a listener
+// refusing the dial answers with. It goes out through the demux like UDX's
+// packets, so the socket's limits apply to it too.
+func (m *udpMux) sendPadding(raddr net.Addr, nonce []byte) {
+	padding := make([]byte, dialPaddingLen)
+	padding[0] = packetPadding
+	copy(padding[1:], nonce)
+	m.demux.WriteTo(padding, raddr)
+}
+
+// handshakeDone validates the remote of a connection UDX accepted, lifting
+// the anti-amplification limit: UDX's handshake took a round trip to the
+// remote's address, which a spoofed source can't complete.
+func (l *rawListener) handshakeDone(udxConn *udx.Connection) {
+	if ap, ok := addrPortOf(udxConn.RemoteAddr()); ok {
+		l.mux.demux.allow(ap)
+	}
+}
@@ -0,0 +1,282 @@
+package udxtransport
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxsim"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// amplificationTracer counts the packets the anti-amplification limit drops.
+type amplificationTracer struct {
+	MetricsTracer
+	packets, bytes atomic.Int64
+}
+
+func (mt *amplificationTracer) AmplificationLimited(n int) {
+	mt.packets.Add(1)
+	mt.bytes.Add(int64(n))
+}
+
+// countingConn counts the bytes written to a socket.
+type countingConn struct {
+	net.PacketConn
+	written atomic.Int64
+}
+
+func (c *countingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.written.Add(int64(len(p)))
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// receivedBytes counts the bytes arriving at c until it has been idle for a
+// while.
+func receivedBytes(c net.PacketConn, idle time.Duration) int {
+	total := 0
+	buf := make([]byte, 2048)
+	for {
+		c.SetReadDeadline(time.Now().Add(idle))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return total
+		}
+		total += n
+	}
+}
+
+func TestAmplificationLimit(t *testing.T) {
+	n := udxsim.NewNetwork(1, udxsim.Link{})
+	defer n.Close()
+	listen := func(ip net.IP, port int) *udxsim.PacketConn {
+		pc, err := n.Host(ip).ListenPacket("udp4", &net.UDPAddr{Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc.(*udxsim.PacketConn)
+	}
+	server := listen(net.IPv4(10, 0, 0, 1), 4001)
+	victim := listen(net.IPv4(10, 0, 0, 2), 4001)
+	attacker := listen(net.IPv4(10, 0, 0, 3), 4001)
+	attacker.Spoof(victim.LocalAddr().(*net.UDPAddr))
+
+	tracer := &amplificationTracer{}
+	demux := newPacketDemux(server, systemClock{}, newTokenKeys(udx.RealClock{}), tracer)
+	attacker.WriteTo(bytes.Repeat([]byte{0xFF}, 100), server.LocalAddr())
+	buf := make([]byte, 2048)
+	demux.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, from, err := demux.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	} else if from.String() != victim.LocalAddr().String() {
+		t.Fatalf("packet came from %s, not the spoofed %s", from, victim.LocalAddr())
+	}
+
+	// The server may answer with three times what it got, and no more.
+	for range 4 {
+		demux.WriteTo(make([]byte, 100), victim.LocalAddr())
+	}
+	if got := receivedBytes(victim, 100*time.Millisecond); got != 300 {
+		t.Errorf("victim got %d bytes, want 300", got)
+	}
+	if tracer.packets.Load() != 1 || tracer.bytes.Load() != 100 {
+		t.Errorf("limited %d packets of %d bytes, want 1 of 100", tracer.packets.Load(), tracer.bytes.Load())
+	}
+
+	// A source that completes a handshake is no longer limited.
+	ap, _ := addrPortOf(victim.LocalAddr())
+	demux.allow(ap)
+	for range 4 {
+		demux.WriteTo(make([]byte, 100), victim.LocalAddr())
+	}
+	if got := receivedBytes(victim, 100*time.Millisecond); got != 400 {
+		t.Errorf("validated victim got %d bytes, want 400", got)
+	}
+}
+
+func TestAmplificationSpoofedDial(t *testing.T) {
+	n := udxsim.NewNetwork(1, udxsim.Link{Latency: time.Millisecond})
+	defer n.Close()
+	serverIP, victimIP, attackerIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)
+
+	server := newTestTransport(t, nil, nil, WithListenPacket(n.Host(serverIP).ListenPacket))
+	defer server.Close()
+	ln, err := server.Listen(ma.StringCast("/ip4/10.0.0.1/udp/4001/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	victim, err := n.Host(victimIP).ListenPacket("udp4", &net.UDPAddr{Port: 4001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer victim.Close()
+	pc, err := n.Host(attackerIP).ListenPacket("udp4", &net.UDPAddr{Port: 4001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.(*udxsim.PacketConn).Spoof(victim.LocalAddr().(*net.UDPAddr))
+	attacker := &countingConn{PacketConn: pc}
+	mux := udx.NewMultiplexer(attacker, udx.RealClock{})
+	defer mux.Close()
+
+	// The attacker's handshake never completes, since the answers go to the
+	// victim, and whatever it sends, the victim gets at most three times as
+	// much.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go mux.Dial(ctx, &net.UDPAddr{IP: serverIP, Port: 4001})
+	received := receivedBytes(victim, time.Second)
+	if sent := int(attacker.written.Load()); received > amplificationFactor*sent {
+		t.Errorf("victim got %d bytes for the %d the attacker sent", received, sent)
+	}
+
+	// Real dialers pad their first packet, and get through.
+	client := newTestTransport(t, nil, nil, WithListenPacket(n.Host(net.IPv4(10, 0, 0, 4)).ListenPacket))
+	defer client.Close()
+	dctx, dcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dcancel()
+	c, err := client.Dial(dctx, ln.Multiaddr(), server.localPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestAmplificationLiftedOnAccept(t *testing.T) {
+	server := newTestTransport(t, nil, nil)
+	defer server.Close()
+	ln, _, _ := listenForTest(t, server)
+	demux := ln.(*listener).raw.mux.demux
+
+	// UDX's handshake validates the dialer, before stream 0 or the
+	// transport's handshake.
+	c := dialRawUDX(t, ln.Multiaddr())
+	ap, ok := addrPortOf(c.LocalAddr())
+	if !ok {
+		t.Fatal("dialer has no UDP address")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !demux.isValidated(ap) {
+		if time.Now().After(deadline) {
+			t.Fatal("accepted dialer isn't validated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// firstBytesConn records the first byte of every packet through a socket.
+type firstBytesConn struct {
+	net.PacketConn
+	mu            sync.Mutex
+	read, written []byte
+}
+
+func (c *firstBytesConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && n > 0 {
+		c.mu.Lock()
+		c.read = append(c.read, p[0])
+		c.mu.Unlock()
+	}
+	return n, addr, err
+}
+
+func (c *firstBytesConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > 0 {
+		c.mu.Lock()
+		c.written = append(c.written, p[0])
+		c.mu.Unlock()
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// check fails t if a packet the transport claims for its own went either way
+// through c: a plain go-udx peer receives them as junk, and one of UDX's
+// packets starting like them would be taken from UDX.
+func (c *firstBytesConn) check(t *testing.T) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.read) == 0 || len(c.written) == 0 {
+		t.Fatalf("%d packets read and %d written, want both", len(c.read), len(c.written))
+	}
+	for _, b := range c.read {
+		if b >= packetDatagram && b <= packetRefused {
+			t.Errorf("plain UDX peer received a packet of kind %#x", b)
+		}
+	}
+	for _, b := range c.written {
+		if b >= packetDatagram && b <= packetRefused {
+			t.Errorf("plain UDX peer sent a packet starting with %#x", b)
+		}
+	}
+}
+
+// plainUDXPeer starts a go-udx multiplexer with nothing of the transport on
+// top, which accepts UDX connections and never answers on them.
+func plainUDXPeer(t *testing.T) (*firstBytesConn, *udx.Multiplexer) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &firstBytesConn{PacketConn: conn}
+	mux := udx.NewMultiplexer(fc, udx.RealClock{})
+	t.Cleanup(func() { mux.Close() })
+	go func() {
+		for {
+			if _, err := mux.Accept(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+	return fc, mux
+}
+
+func TestPlainUDXPeer(t *testing.T) {
+	t.Run("dialed", func(t *testing.T) {
+		for _, native := range []bool{true, false} {
+			var opts []Option
+			if !native {
+				opts = append(opts, DisableNativeMultiplexing())
+			}
+			fc, mux := plainUDXPeer(t)
+			a := mux.Addr().(*net.UDPAddr)
+			addr, _ := toUDXMultiaddr(a.IP.String(), a.Port)
+			_, id := generateKey(t)
+			// Past paddingDelay, so padding would have gone out had UDX's
+			// handshake stalled.
+			if _, err := dialForTest(t, addr, id, 2*paddingDelay, opts...); err == nil {
+				t.Fatalf("native=%t: dial to a plain UDX peer succeeded", native)
+			}
+			fc.check(t)
+		}
+	})
+
+	t.Run("dialing", func(t *testing.T) {
+		// A listener validating and gating its sources neither retries nor
+		// refuses a dialer that didn't pad.
+		ln, _, _ := listenForTest(t, newTestTransport(t, &acceptGater{}, nil, WithAddressValidation(ValidateAlways)))
+		fc, mux := plainUDXPeer(t)
+		key, _ := udxAddrKey(ln.Multiaddr())
+		raddr, _ := net.ResolveUDPAddr("udp4", key)
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		if _, err := mux.Dial(ctx, raddr); err == nil {
+			t.Fatal("UDX handshake completed with an unvalidated source")
+		}
+		fc.mu.Lock()
+		read := len(fc.read)
+		fc.mu.Unlock()
+		if read != 0 {
+			t.Errorf("plain UDX dialer received %d packets", read)
+		}
+	})
+}
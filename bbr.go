@@ -0,0 +1,267 @@
+package udxtransport
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	bbrHighGain          = 2.885 // 2/ln(2), which doubles the sending rate every round trip
+	bbrCwndGain          = 2
+	bbrBandwidthRounds   = 10 // round trips the bandwidth estimate is the maximum of
+	bbrFullBandwidthGrow = 1.25
+	bbrFullBandwidthMiss = 3 // rounds without bbrFullBandwidthGrow that end startup
+	bbrMinRTTWindow      = 10 * time.Second
+	bbrProbeRTTDuration  = 200 * time.Millisecond
+	bbrMinWindowPackets  = 4
+)
+
+// bbrCycleGains are the pacing gains probeBW cycles through, one minimum
+// round-trip time each: probe for more bandwidth, drain the queue that made,
+// then cruise.
+var bbrCycleGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+// bbrSent is what bbr remembers about a packet in flight to measure the
+// delivery rate when it is acknowledged.
+type bbrSent struct {
+	packetNumber  uint64
+	delivered     int       // bytes delivered when the packet was sent
+	deliveredTime time.Time // when they were
+	firstSentAt   time.Time // when the last packet acknowledged by then was sent
+}
+
+// bbr is the congestion controller of BBR. It estimates the bottleneck
+// bandwidth as the highest delivery rate of the last bbrBandwidthRounds
+// round trips and the propagation delay as the lowest round-trip time of
+// the last bbrMinRTTWindow, and keeps a gain times their product in flight.
+type bbr struct {
+	maxDatagramSize int
+	cwnd            int
+	mode            bbrMode
+	pacingGain      float64
+	cwndGain        float64
+
+	sent          []bbrSent // packets in flight, oldest first
+	delivered     int
+	deliveredTime time.Time
+	firstSentAt   time.Time
+
+	round          int
+	roundDelivered int // delivered at which the next round trip starts
+	bandwidth      [bbrBandwidthRounds]float64
+	minRTT         time.Duration
+	minRTTStamp    time.Time
+
+	fullBandwidth  float64
+	fullBandwidthN int
+	filledPipe     bool
+	cycleIndex     int
+	cycleStart     time.Time
+	probeRTTDone   time.Time // zero until probeRTT has drained the pipe
+	probeRTTRound  int
+
+	pacingRate atomic.Int64 // bytes per second, for PacingRate
+}
+
+func newBBR(maxDatagramSize int) CongestionController {
+	return &bbr{
+		maxDatagramSize: maxDatagramSize,
+		cwnd:            initialWindowPackets * maxDatagramSize,
+		pacingGain:      bbrHighGain,
+		cwndGain:        bbrHighGain,
+	}
+}
+
+func (b *bbr) OnPacketSent(now time.Time, packetNumber uint64, bytes, bytesInFlight int) {
+	if b.deliveredTime.IsZero() {
+		b.deliveredTime, b.firstSentAt = now, now
+	}
+	b.sent = append(b.sent, bbrSent{
+		packetNumber:  packetNumber,
+		delivered:     b.delivered,
+		deliveredTime: b.deliveredTime,
+		firstSentAt:   b.firstSentAt,
+	})
+}
+
+func (b *bbr) OnPacketAcked(now time.Time, packetNumber uint64, sentAt time.Time, bytes, bytesInFlight int) {
+	b.delivered += bytes
+	b.deliveredTime = now
+	b.firstSentAt = sentAt
+
+	if rtt := now.Sub(sentAt); b.minRTT == 0 || rtt <= b.minRTT || now.Sub(b.minRTTStamp) > bbrMinRTTWindow {
+		if b.mode != bbrProbeRTT || rtt <= b.minRTT {
+			b.minRTT = rtt
+			b.minRTTStamp = now
+		}
+	}
+	if p, ok := b.popSent(packetNumber); ok {
+		if p.delivered >= b.roundDelivered {
+			b.roundDelivered = b.delivered
+			b.round++
+			b.bandwidth[b.round%bbrBandwidthRounds] = 0
+			b.checkFullBandwidth()
+		}
+		interval := max(now.Sub(p.deliveredTime), sentAt.Sub(p.firstSentAt))
+		if interval > 0 {
+			rate := float64(b.delivered-p.delivered) / interval.Seconds()
+			if i := b.round % bbrBandwidthRounds; rate > b.bandwidth[i] {
+				b.bandwidth[i] = rate
+			}
+		}
+	}
+
+	b.updateMode(now, bytesInFlight)
+	b.updateWindow(bytes)
+	b.pacingRate.Store(int64(b.pacingGain * b.maxBandwidth()))
+}
+
+// popSent removes the record of packet packetNumber, along with those of
+// older packets, which were acknowledged or lost before it.
+func (b *bbr) popSent(packetNumber uint64) (bbrSent, bool) {
+	for i, p := range b.sent {
+		if p.packetNumber == packetNumber {
+			b.sent = b.sent[i+1:]
+			return p, true
+		}
+		if p.packetNumber > packetNumber {
+			b.sent = b.sent[i:]
+			return bbrSent{}, false
+		}
+	}
+	b.sent = b.sent[:0]
+	return bbrSent{}, false
+}
+
+// checkFullBandwidth ends startup once a few round trips in a row didn't
+// raise the bandwidth estimate by much.
+func (b *bbr) checkFullBandwidth() {
+	if b.filledPipe {
+		return
+	}
+	if bw := b.maxBandwidth(); bw >= b.fullBandwidth*bbrFullBandwidthGrow {
+		b.fullBandwidth = bw
+		b.fullBandwidthN = 0
+		return
+	}
+	b.fullBandwidthN++
+	b.filledPipe = b.fullBandwidthN >= bbrFullBandwidthMiss
+}
+
+func (b *bbr) updateMode(now time.Time, bytesInFlight int) {
+	switch b.mode {
+	case bbrStartup:
+		if b.filledPipe {
+			// Pacing below the bandwidth drains the queue startup built.
+			b.mode = bbrDrain
+			b.pacingGain, b.cwndGain = 1/bbrHighGain, 1
+		}
+	case bbrDrain:
+		if bytesInFlight <= b.bdp(1) {
+			b.enterProbeBW(now)
+		}
+	case bbrProbeBW:
+		if now.Sub(b.cycleStart) > b.minRTT {
+			b.cycleIndex = (b.cycleIndex + 1) % len(bbrCycleGains)
+			b.cycleStart = now
+			b.pacingGain = bbrCycleGains[b.cycleIndex]
+		}
+	case bbrProbeRTT:
+		if b.probeRTTDone.IsZero() {
+			if bytesInFlight <= b.minWindow() {
+				b.probeRTTDone = now.Add(bbrProbeRTTDuration)
+				b.probeRTTRound = b.round
+			}
+		} else if now.After(b.probeRTTDone) && b.round > b.probeRTTRound {
+			b.minRTTStamp = now
+			if b.filledPipe {
+				b.enterProbeBW(now)
+			} else {
+				b.mode = bbrStartup
+				b.pacingGain, b.cwndGain = bbrHighGain, bbrHighGain
+			}
+		}
+	}
+	// A minimum round-trip time that hasn't been seen again for a while may
+	// be stale, so drain the pipe to measure it again.
+	if b.mode != bbrProbeRTT && !b.minRTTStamp.IsZero() && now.Sub(b.minRTTStamp) > bbrMinRTTWindow {
+		b.mode = bbrProbeRTT
+		b.pacingGain, b.cwndGain = 1, 1
+		b.probeRTTDone = time.Time{}
+	}
+}
+
+func (b *bbr) enterProbeBW(now time.Time) {
+	b.mode = bbrProbeBW
+	b.cwndGain = bbrCwndGain
+	// Start anywhere but in the draining phase, so flows probe out of step.
+	b.cycleIndex = int(now.UnixNano() % int64(len(bbrCycleGains)))
+	if b.cycleIndex == 1 {
+		b.cycleIndex = 0
+	}
+	b.cycleStart = now
+	b.pacingGain = bbrCycleGains[b.cycleIndex]
+}
+
+func (b *bbr) updateWindow(acked int) {
+	if b.mode == bbrProbeRTT {
+		b.cwnd = b.minWindow()
+		return
+	}
+	target := b.bdp(b.cwndGain)
+	if target == 0 {
+		b.cwnd += acked
+		return
+	}
+	if b.filledPipe {
+		b.cwnd = min(b.cwnd+acked, target)
+	} else if b.cwnd < target || b.delivered < initialWindowPackets*b.maxDatagramSize {
+		b.cwnd += acked
+	}
+	b.cwnd = max(b.cwnd, b.minWindow())
+}
+
+// bdp returns gain times the estimated bandwidth-delay product, or 0 before
+// there is an estimate.
+func (b *bbr) bdp(gain float64) int {
+	return int(gain * b.maxBandwidth() * b.minRTT.Seconds())
+}
+
+func (b *bbr) maxBandwidth() float64 {
+	var bw float64
+	for _, s := range b.bandwidth {
+		bw = max(bw, s)
+	}
+	return bw
+}
+
+// BBR mostly ignores loss, which doesn't tell congestion from a lossy link.
+func (b *bbr) OnPacketLost(time.Time, uint64, time.Time, int, int) {}
+
+func (b *bbr) OnRetransmissionTimeout(time.Time) {
+	b.cwnd = b.minWindow()
+}
+
+func (b *bbr) SetMaxDatagramSize(n int) {
+	b.maxDatagramSize = n
+	b.cwnd = max(b.cwnd, b.minWindow())
+}
+
+func (b *bbr) CongestionWindow() int { return b.cwnd }
+
+// PacingRate returns the rate in bytes per second to pace packets at, or 0
+// before bbr has measured the bandwidth.
+func (b *bbr) PacingRate() int {
+	return int(b.pacingRate.Load())
+}
+
+func (b *bbr) minWindow() int { return bbrMinWindowPackets * b.maxDatagramSize }
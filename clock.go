@@ -0,0 +1,152 @@
+package udxtransport
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// Clock is the time source of a transport: the udx.Clock handed to every
+// UDX multiplexer, and the timers the transport schedules its own work on.
+// A udxsim.ManualClock is one.
+type Clock interface {
+	udx.Clock
+	// AfterFunc calls f once d has passed, unless stop is called first.
+	// stop reports whether it prevented the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// systemClock is the default Clock, on the system's time.
+type systemClock struct {
+	udx.RealClock
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// clockTimer is a time.Timer, or with a period a time.Ticker, on a Clock.
+// Like theirs, its channel holds at most one pending tick.
+type clockTimer struct {
+	C <-chan time.Time
+
+	clock  Clock
+	period time.Duration
+	c      chan time.Time
+	mu     sync.Mutex
+	gen    uint64 // counts the times the timer was armed, to ignore stale fires
+	stop   func() bool
+}
+
+// newTimer returns a timer that ticks once, after d.
+func newTimer(clock Clock, d time.Duration) *clockTimer {
+	t := &clockTimer{clock: clock, c: make(chan time.Time, 1)}
+	t.C = t.c
+	t.Reset(d)
+	return t
+}
+
+// newTicker returns a timer that ticks every period.
+func newTicker(clock Clock, period time.Duration) *clockTimer {
+	t := &clockTimer{clock: clock, period: period, c: make(chan time.Time, 1)}
+	t.C = t.c
+	t.Reset(period)
+	return t
+}
+
+// Reset rearms the timer to tick after d, dropping a pending tick.
+func (t *clockTimer) Reset(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked()
+	t.armLocked(d)
+}
+
+// Stop stops the timer. A pending tick stays in the channel.
+func (t *clockTimer) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked()
+}
+
+func (t *clockTimer) stopLocked() {
+	t.gen++
+	if t.stop != nil {
+		t.stop()
+		t.stop = nil
+	}
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+func (t *clockTimer) armLocked(d time.Duration) {
+	gen := t.gen
+	t.stop = t.clock.AfterFunc(d, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.gen != gen {
+			return
+		}
+		select {
+		case t.c <- t.clock.Now():
+		default:
+		}
+		t.stop = nil
+		if t.period > 0 {
+			t.armLocked(t.period)
+		}
+	})
+}
+
+// withTimeout is context.WithTimeout on the transport's clock. The
+// context's deadline reads on the clock, as the deadlines of UDX streams
+// do.
+func (t *Transport) withTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := t.clock.(systemClock); ok {
+		return context.WithTimeout(parent, d)
+	}
+	ctx := &clockContext{
+		Context:  parent,
+		deadline: t.clock.Now().Add(d),
+		done:     make(chan struct{}),
+	}
+	stopTimer := t.clock.AfterFunc(d, func() { ctx.cancel(context.DeadlineExceeded) })
+	stopParent := context.AfterFunc(parent, func() { ctx.cancel(parent.Err()) })
+	return ctx, func() {
+		stopTimer()
+		stopParent()
+		ctx.cancel(context.Canceled)
+	}
+}
+
+// clockContext is a context whose deadline is on a Clock.
+type clockContext struct {
+	context.Context // the parent, for values
+	deadline        time.Time
+	done            chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *clockContext) Deadline() (time.Time, bool) { return c.deadline, true }
+func (c *clockContext) Done() <-chan struct{}       { return c.done }
+
+func (c *clockContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *clockContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
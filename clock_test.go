@@ -0,0 +1,163 @@
+package udxtransport
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxsim"
+)
+
+func TestClockTimer(t *testing.T) {
+	clock := udxsim.NewManualClock(time.Unix(1700000000, 0))
+	ticks := func(c <-chan time.Time) int {
+		select {
+		case <-c:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	timer := newTimer(clock, 10*time.Millisecond)
+	clock.Advance(9 * time.Millisecond)
+	if ticks(timer.C) != 0 {
+		t.Fatal("timer fired early")
+	}
+	clock.Advance(time.Millisecond)
+	if ticks(timer.C) != 1 {
+		t.Fatal("timer didn't fire")
+	}
+	clock.Advance(10 * time.Millisecond)
+	timer.Reset(10 * time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
+	timer.Stop()
+	clock.Advance(time.Second)
+	if ticks(timer.C) != 0 {
+		t.Fatal("stopped timer fired")
+	}
+
+	ticker := newTicker(clock, 10*time.Millisecond)
+	defer ticker.Stop()
+	fired := 0
+	for range 5 {
+		clock.Advance(10 * time.Millisecond)
+		fired += ticks(ticker.C)
+	}
+	if fired != 5 {
+		t.Fatalf("ticker fired %d times in 5 periods", fired)
+	}
+}
+
+// inboundResourceManager records the scopes of inbound connections.
+type inboundResourceManager struct {
+	network.NullResourceManager
+
+	mu      sync.Mutex
+	inbound []*recordingScope
+}
+
+func (r *inboundResourceManager) OpenConnection(dir network.Direction, _ bool, _ ma.Multiaddr) (network.ConnManagementScope, error) {
+	if dir != network.DirInbound {
+		return &network.NullScope{}, nil
+	}
+	s := &recordingScope{}
+	r.mu.Lock()
+	r.inbound = append(r.inbound, s)
+	r.mu.Unlock()
+	return s, nil
+}
+
+func (r *inboundResourceManager) scopes() []*recordingScope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*recordingScope(nil), r.inbound...)
+}
+
+func TestAdmissionLifetimeOnClock(t *testing.T) {
+	clock := udxsim.NewManualClock(time.Now())
+	n := udxsim.NewNetwork(1, udxsim.Link{}, udxsim.WithClock(clock))
+	defer n.Close()
+	rcmgr := &inboundResourceManager{}
+	tr := newTestTransport(t, nil, rcmgr, WithClock(clock), WithListenPacket(n.Host(net.IPv4(10, 0, 0, 2)).ListenPacket))
+	defer tr.Close()
+	ln, err := tr.Listen(ma.StringCast("/ip4/10.0.0.2/udp/4001/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A source whose first packet UDX never answers with a connection.
+	src, err := n.Host(net.IPv4(10, 0, 0, 1)).ListenPacket("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.WriteTo([]byte{0xFF, 0, 0, 0}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4001}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rcmgr.scopes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the source wasn't admitted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	scope := rcmgr.scopes()[0]
+
+	clock.Advance(admissionLifetime - time.Millisecond)
+	if _, _, done := scope.state(); done {
+		t.Fatal("admission released before its lifetime on the clock")
+	}
+	clock.Advance(time.Millisecond)
+	if _, _, done := scope.state(); !done {
+		t.Fatal("admission not released after its lifetime on the clock")
+	}
+}
+
+func TestAdmissionsPerPrefix(t *testing.T) {
+	clock := udxsim.NewManualClock(time.Now())
+	rcmgr := &inboundResourceManager{}
+	tr := newTestTransport(t, nil, rcmgr, WithClock(clock), WithMaxHalfOpenConns(2*maxPrefixAdmissions))
+	defer tr.Close()
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	raw := ln.(*listener).raw
+
+	// Spoofed sources from one /24 take no more than their share.
+	for i := range maxPrefixAdmissions {
+		if !raw.gate(netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)}), 4001)) {
+			t.Fatalf("source %d of the prefix refused", i+1)
+		}
+	}
+	if raw.gate(netip.MustParseAddrPort("10.0.0.200:4001")) {
+		t.Error("source past the prefix's share admitted")
+	}
+	if !raw.gate(netip.MustParseAddrPort("10.0.0.1:4001")) {
+		t.Error("source admitted again refused")
+	}
+	for i := range maxPrefixAdmissions {
+		if !raw.gate(netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i + 1), 1}), 4001)) {
+			t.Fatalf("source of prefix %d refused", i+1)
+		}
+	}
+	if raw.gate(netip.MustParseAddrPort("10.9.9.9:4001")) {
+		t.Error("source past the half-open limit admitted")
+	}
+
+	// Once the admissions run out, the prefix has room again.
+	clock.Advance(admissionLifetime)
+	if !raw.gate(netip.MustParseAddrPort("10.0.0.200:4001")) {
+		t.Error("source refused after the admissions ran out")
+	}
+	if n := len(raw.prefixes); n != 1 {
+		t.Errorf("%d prefixes counted, want 1", n)
+	}
+}
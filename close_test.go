@@ -0,0 +1,173 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/goleak"
+)
+
+// socketCounter opens operating system sockets and counts the open ones.
+type socketCounter struct {
+	open atomic.Int64
+}
+
+type countedSocket struct {
+	*net.UDPConn
+	counter *socketCounter
+	closed  atomic.Bool
+}
+
+func (s *countedSocket) Close() error {
+	if s.closed.CompareAndSwap(false, true) {
+		s.counter.open.Add(-1)
+	}
+	return s.UDPConn.Close()
+}
+
+func (sc *socketCounter) listenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	sc.open.Add(1)
+	return &countedSocket{UDPConn: conn, counter: sc}, nil
+}
+
+func TestCloseLeaks(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	var sockets socketCounter
+	server := newTestTransport(t, nil, nil, WithListenPacket(sockets.listenPacket))
+	ln, err := server.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptErr := make(chan error, 1)
+	var accepted []tpt.CapableConn
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			accepted = append(accepted, c)
+		}
+	}()
+
+	// A native and an upgraded connection, each with a stream, plus a
+	// connection the server dials from its listen socket.
+	var clients []*Transport
+	for _, opts := range [][]Option{nil, {DisableNativeMultiplexing()}} {
+		client := newTestTransport(t, nil, nil, append(opts, WithListenPacket(sockets.listenPacket))...)
+		clients = append(clients, client)
+		c, err := client.Dial(context.Background(), ln.Multiaddr(), server.localPeer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.OpenStream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clientLn, err := clients[0].Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := clientLn.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	dialed, err := server.Dial(context.Background(), clientLn.Multiaddr(), clients[0].localPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-acceptErr:
+		if err == nil {
+			t.Error("Accept returned no error after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't return after Close")
+	}
+	if len(accepted) != 2 {
+		t.Fatalf("accepted %d connections, want 2", len(accepted))
+	}
+	for _, c := range append(accepted, dialed) {
+		if !c.IsClosed() {
+			t.Errorf("%T still open after Close", c)
+		}
+	}
+	if _, err := server.Dial(context.Background(), clientLn.Multiaddr(), clients[0].localPeer); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Dial after Close: %v, want %v", err, ErrTransportClosed)
+	}
+	if _, err := server.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/udx")); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Listen after Close: %v, want %v", err, ErrTransportClosed)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+	if n := sockets.open.Load(); n != 0 {
+		t.Errorf("%d sockets open after Close", n)
+	}
+}
+
+func TestCloseQueuedLeaks(t *testing.T) {
+	// Registered first, so it runs after the dialers are closed.
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+	var sockets socketCounter
+	server := newTestTransport(t, nil, nil, WithListenPacket(sockets.listenPacket))
+	pc, err := server.listenPacket("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := server.newUDPMux(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A listener without the upgrader, so the connections stay queued.
+	raw := server.newRawListener(m)
+	go raw.acceptLoop()
+
+	const queued = 3
+	for range queued {
+		c := dialRawUDX(t, m.laddr)
+		stream0, err := c.OpenStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream0.Write([]byte("\x13/multistream/1.0.0\n"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(raw.queue) < queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections queued, want %d", len(raw.queue), queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	raw.Close()
+	server.Close()
+	if n := sockets.open.Load(); n != 0 {
+		t.Errorf("%d sockets open after Close", n)
+	}
+}
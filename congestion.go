@@ -0,0 +1,259 @@
+package udxtransport
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// CongestionController decides how many bytes a UDX connection keeps in
+// flight. go-udx's loss recovery reports every packet of the connection to
+// its controller and sends no more than the controller's window allows.
+//
+// The type is an alias of an interface literal, so go-udx declares the same
+// interface without importing this package. Packet numbers grow with every
+// packet sent, retransmissions included, so a number names one packet. Bytes
+// in flight are counted after the event reported. Calls come from one
+// goroutine at a time.
+type CongestionController = interface {
+	// OnPacketSent reports packet packetNumber of bytes leaving at now.
+	OnPacketSent(now time.Time, packetNumber uint64, bytes, bytesInFlight int)
+	// OnPacketAcked reports the first acknowledgement of packet
+	// packetNumber, sent at sentAt.
+	OnPacketAcked(now time.Time, packetNumber uint64, sentAt time.Time, bytes, bytesInFlight int)
+	// OnPacketLost reports packet packetNumber, sent at sentAt, being
+	// declared lost.
+	OnPacketLost(now time.Time, packetNumber uint64, sentAt time.Time, bytes, bytesInFlight int)
+	// OnRetransmissionTimeout reports the retransmission timer firing.
+	OnRetransmissionTimeout(now time.Time)
+	// SetMaxDatagramSize sets the size of a full packet, which windows are
+	// counted in.
+	SetMaxDatagramSize(n int)
+	// CongestionWindow returns how many bytes may be in flight.
+	CongestionWindow() int
+}
+
+// CongestionControl is a congestion control algorithm, which
+// WithCongestionControl makes the transport run on its connections.
+type CongestionControl struct {
+	Name string // reported in LinkStats
+	// New returns a controller for a connection whose full packets are
+	// maxDatagramSize bytes.
+	New func(maxDatagramSize int) CongestionController
+}
+
+// The built-in algorithms.
+var (
+	// NewReno halves its window on loss and grows it by a packet per round
+	// trip, as in RFC 9002.
+	NewReno = CongestionControl{Name: "newreno", New: newNewReno}
+	// Cubic grows its window along a cubic function of the time since the
+	// last loss, as in RFC 9438. It fills paths with a large bandwidth-delay
+	// product faster than NewReno.
+	Cubic = CongestionControl{Name: "cubic", New: newCubic}
+	// BBR sizes its window to the bottleneck bandwidth and round-trip time
+	// it measures, after BBR version 1, and mostly ignores loss. It keeps
+	// queues short and suits bulk transfers over lossy paths.
+	BBR = CongestionControl{Name: "bbr", New: newBBR}
+)
+
+const (
+	initialWindowPackets = 10
+	minWindowPackets     = 2
+	// initialRTT is the round-trip time assumed before there is a sample,
+	// as in RFC 9002.
+	initialRTT = 333 * time.Millisecond
+)
+
+// congestionControlled is implemented by udx.Connection when it runs a
+// congestion controller the transport gives it. Without it, connections run
+// go-udx's own congestion control: WithCongestionControl is refused, and
+// connections aren't paced, nor do datagrams and probes count against the
+// window.
+type congestionControlled interface {
+	SetCongestionController(cc CongestionController)
+}
+
+// checkCongestion checks that go-udx can run the algorithm given with
+// WithCongestionControl.
+func (t *Transport) checkCongestion() error {
+	if _, ok := any((*udx.Connection)(nil)).(congestionControlled); !ok && t.congestionSet {
+		return errors.New("go-udx doesn't support congestion controllers")
+	}
+	return nil
+}
+
+// configureCongestion hands c, a udx.Connection, a controller of the
+// transport's algorithm and returns it, measured for the connection's pacer
+// and transport packets. It returns nil if go-udx doesn't take one.
+func (t *Transport) configureCongestion(c any) *measuredController {
+	ccc, ok := c.(congestionControlled)
+	if !ok {
+		return nil
+	}
+	cc := newMeasuredController(t.congestion.New(t.initialMTU), t.clock)
+	ccc.SetCongestionController(cc)
+	return cc
+}
+
+// measuredController is the controller of a connection as UDX runs it. It
+// keeps the window, smoothed round-trip time and bytes in flight it last saw
+// where the transport can read them while UDX calls the controller, and
+// counts the transport's own packets on the connection, datagrams and path
+// MTU probes, against the window UDX sees.
+type measuredController struct {
+	CongestionController
+	clock    Clock
+	cwnd     atomic.Int64
+	srtt     atomic.Int64 // nanoseconds; 0 until the first acknowledgement
+	inFlight atomic.Int64 // UDX's bytes in flight
+
+	mu           sync.Mutex
+	outside      []outsidePacket // the transport's packets in flight, oldest first
+	outsideBytes int
+}
+
+// outsidePacket is a packet the transport sent beside UDX's. Nothing
+// acknowledges it, so it counts as in flight for as long as one of UDX's
+// would take to be acknowledged: a smoothed round trip.
+type outsidePacket struct {
+	until time.Time
+	bytes int
+}
+
+func newMeasuredController(cc CongestionController, clock Clock) *measuredController {
+	m := &measuredController{CongestionController: cc, clock: clock}
+	m.cwnd.Store(int64(cc.CongestionWindow()))
+	return m
+}
+
+func (m *measuredController) OnPacketSent(now time.Time, packetNumber uint64, bytes, bytesInFlight int) {
+	m.CongestionController.OnPacketSent(now, packetNumber, bytes, bytesInFlight)
+	m.inFlight.Store(int64(bytesInFlight))
+}
+
+func (m *measuredController) OnPacketAcked(now time.Time, packetNumber uint64, sentAt time.Time, bytes, bytesInFlight int) {
+	m.CongestionController.OnPacketAcked(now, packetNumber, sentAt, bytes, bytesInFlight)
+	rtt := now.Sub(sentAt)
+	if srtt := time.Duration(m.srtt.Load()); srtt > 0 {
+		rtt = (7*srtt + rtt) / 8
+	}
+	m.srtt.Store(int64(max(rtt, 1)))
+	m.cwnd.Store(int64(m.CongestionController.CongestionWindow()))
+	m.inFlight.Store(int64(bytesInFlight))
+}
+
+func (m *measuredController) OnPacketLost(now time.Time, packetNumber uint64, sentAt time.Time, bytes, bytesInFlight int) {
+	m.CongestionController.OnPacketLost(now, packetNumber, sentAt, bytes, bytesInFlight)
+	m.cwnd.Store(int64(m.CongestionController.CongestionWindow()))
+	m.inFlight.Store(int64(bytesInFlight))
+}
+
+func (m *measuredController) OnRetransmissionTimeout(now time.Time) {
+	m.CongestionController.OnRetransmissionTimeout(now)
+	m.cwnd.Store(int64(m.CongestionController.CongestionWindow()))
+}
+
+func (m *measuredController) SetMaxDatagramSize(n int) {
+	m.CongestionController.SetMaxDatagramSize(n)
+	m.cwnd.Store(int64(m.CongestionController.CongestionWindow()))
+}
+
+// CongestionWindow returns the window the controller last reported, less
+// the transport's packets in flight, down to the smallest window.
+func (m *measuredController) CongestionWindow() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return max(int(m.cwnd.Load())-m.outsideLocked(), minWindowPackets*baseMTU)
+}
+
+// sendOutside reports whether a packet of n bytes the transport sends beside
+// UDX's fits in the window with the bytes in flight, and counts it as in
+// flight if so. A forced packet is counted either way.
+func (m *measuredController) sendOutside(n int, force bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !force && int(m.inFlight.Load())+m.outsideLocked()+n > int(m.cwnd.Load()) {
+		return false
+	}
+	rtt := time.Duration(m.srtt.Load())
+	if rtt == 0 {
+		rtt = initialRTT
+	}
+	m.outside = append(m.outside, outsidePacket{until: m.clock.Now().Add(rtt), bytes: n})
+	m.outsideBytes += n
+	return true
+}
+
+// outsideLocked returns the bytes of the transport's packets in flight.
+func (m *measuredController) outsideLocked() int {
+	now := m.clock.Now()
+	for len(m.outside) > 0 && !m.outside[0].until.After(now) {
+		m.outsideBytes -= m.outside[0].bytes
+		m.outside = m.outside[1:]
+	}
+	return m.outsideBytes
+}
+
+// newReno is the congestion controller of NewReno.
+type newReno struct {
+	maxDatagramSize int
+	cwnd            int
+	ssthresh        int
+	ackedBytes      int       // bytes acknowledged in congestion avoidance since the window last grew
+	recoveryStart   time.Time // packets sent before it don't reduce the window again
+}
+
+func newNewReno(maxDatagramSize int) CongestionController {
+	return &newReno{
+		maxDatagramSize: maxDatagramSize,
+		cwnd:            initialWindowPackets * maxDatagramSize,
+		ssthresh:        int(^uint(0) >> 1),
+	}
+}
+
+func (r *newReno) OnPacketSent(time.Time, uint64, int, int) {}
+
+func (r *newReno) OnPacketAcked(now time.Time, _ uint64, sentAt time.Time, bytes, bytesInFlight int) {
+	if !sentAt.After(r.recoveryStart) {
+		return
+	}
+	if r.cwnd < r.ssthresh {
+		r.cwnd += bytes
+		return
+	}
+	r.ackedBytes += bytes
+	if r.ackedBytes >= r.cwnd {
+		r.ackedBytes -= r.cwnd
+		r.cwnd += r.maxDatagramSize
+	}
+}
+
+func (r *newReno) OnPacketLost(now time.Time, _ uint64, sentAt time.Time, bytes, bytesInFlight int) {
+	if !sentAt.After(r.recoveryStart) {
+		return
+	}
+	r.recoveryStart = now
+	r.cwnd = max(r.cwnd/2, r.minWindow())
+	r.ssthresh = r.cwnd
+	r.ackedBytes = 0
+}
+
+func (r *newReno) OnRetransmissionTimeout(now time.Time) {
+	r.recoveryStart = now
+	r.ssthresh = max(r.cwnd/2, r.minWindow())
+	r.cwnd = r.minWindow()
+	r.ackedBytes = 0
+}
+
+func (r *newReno) SetMaxDatagramSize(n int) {
+	r.maxDatagramSize = n
+	r.cwnd = max(r.cwnd, r.minWindow())
+}
+
+func (r *newReno) CongestionWindow() int { return r.cwnd }
+
+func (r *newReno) minWindow() int { return minWindowPackets * r.maxDatagramSize }
@@ -0,0 +1,265 @@
+package udxtransport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxsim"
+)
+
+const (
+	ccPacketSize = baseMTU
+	ccBandwidth  = 1000 * ccPacketSize // bytes per second on the bottleneck
+	ccLatency    = 10 * time.Millisecond
+	ccBDP        = 2 * ccBandwidth * ccLatency / time.Second // bandwidth-delay product
+	ccDuration   = 2 * time.Second
+	// ccTick is the step of the simulation's clock, a tenth of the time the
+	// bottleneck takes to send a packet.
+	ccTick = 100 * time.Microsecond
+	// ccWrite is how much a flow that pauses writes between pauses.
+	ccWrite = 16 << 10
+)
+
+// ccBottleneck is a link with a queue of one bandwidth-delay product.
+var ccBottleneck = udxsim.Link{Latency: ccLatency, Bandwidth: ccBandwidth, Queue: int(ccBDP)}
+
+// ccFlow is what a connection sending as fast as its window allows got
+// through a bottleneck.
+type ccFlow struct {
+	delivered int64 // bytes acknowledged
+	maxWindow int   // largest congestion window seen
+}
+
+// ccSim runs the congestion controllers of connections over a bottleneck on
+// a simulated clock, the way UDX's loss recovery drives them: packets leave
+// while the window has room, queue at the bottleneck, and are acknowledged a
+// round trip after they get through. A packet three behind one acknowledged
+// is lost, and so is everything in flight once the oldest packet has gone
+// unacknowledged for three smoothed round trips. The results don't depend
+// on the speed or the scheduling of the machine running the test.
+type ccSim struct {
+	link        udxsim.Link
+	clock       *udxsim.ManualClock
+	flows       []*ccSimFlow
+	queued      []ccSimPacket // at the bottleneck, by the time they leave it
+	queuedBytes int
+	free        time.Time     // when the bottleneck has sent the packets queued
+	acks        []ccSimPacket // acknowledgements on their way, by the time they arrive
+	counters    udxsim.Counters
+}
+
+// ccSimFlow is a connection of a ccSim.
+type ccSimFlow struct {
+	ccFlow
+	cc        *measuredController
+	pacer     *pacer        // nil if the flow isn't paced
+	pause     time.Duration // after every ccWrite bytes; 0 to write all the time
+	writable  int           // bytes written and not sent yet
+	nextWrite time.Time
+	next      uint64        // packet number
+	sent      []ccSimPacket // not acknowledged or lost yet, by packet number
+	inFlight  int
+}
+
+type ccSimPacket struct {
+	flow   *ccSimFlow
+	pn     uint64
+	sentAt time.Time
+	at     time.Time // when it leaves the bottleneck, or its acknowledgement arrives
+}
+
+// runCCFlows runs flows connections with controllers of cc over bottleneck
+// for ccDuration, each sending as fast as its window allows, and its pacer
+// if paced, pausing for pause after every ccWrite bytes. It returns the
+// flows and what happened to the packets on the bottleneck.
+func runCCFlows(t *testing.T, cc CongestionControl, bottleneck udxsim.Link, flows int, pause time.Duration, paced bool) ([]ccFlow, udxsim.Counters) {
+	t.Helper()
+	s := &ccSim{link: bottleneck, clock: udxsim.NewManualClock(time.Unix(1700000000, 0))}
+	for range flows {
+		f := &ccSimFlow{cc: newMeasuredController(cc.New(ccPacketSize), s.clock), pause: pause}
+		if paced {
+			f.pacer = &pacer{clock: s.clock, rate: f.cc.pacingRate, closed: make(chan struct{})}
+		}
+		s.flows = append(s.flows, f)
+	}
+	for end := s.clock.Now().Add(ccDuration); s.clock.Now().Before(end); s.clock.Advance(ccTick) {
+		s.step(s.clock.Now())
+	}
+	results := make([]ccFlow, flows)
+	for i, f := range s.flows {
+		results[i] = f.ccFlow
+	}
+	t.Logf("%s: %+v, %d of %d packets overflowed the queue", cc.Name, results, s.counters.Overflowed, s.counters.Sent)
+	return results, s.counters
+}
+
+// step moves the packets along and has the flows send what they may at now.
+func (s *ccSim) step(now time.Time) {
+	for len(s.queued) > 0 && !s.queued[0].at.After(now) {
+		p := s.queued[0]
+		s.queued = s.queued[1:]
+		s.queuedBytes -= ccPacketSize
+		s.counters.Delivered++
+		p.at = p.at.Add(2 * s.link.Latency)
+		s.acks = append(s.acks, p)
+	}
+	for len(s.acks) > 0 && !s.acks[0].at.After(now) {
+		p := s.acks[0]
+		s.acks = s.acks[1:]
+		p.flow.acked(now, p)
+	}
+	for _, f := range s.flows {
+		f.timeout(now)
+		if f.pause > 0 && f.writable <= 0 && !now.Before(f.nextWrite) {
+			f.writable += ccWrite
+		}
+	}
+	// The flows take turns, so none gets to the queue first every time.
+	for sending := true; sending; {
+		sending = false
+		for _, f := range s.flows {
+			if f.canSend() {
+				s.send(now, f)
+				sending = true
+			}
+		}
+	}
+}
+
+// canSend reports whether f may send a packet now, taking the pacer's
+// tokens for it if so.
+func (f *ccSimFlow) canSend() bool {
+	return (f.pause == 0 || f.writable > 0) && f.inFlight+ccPacketSize <= f.cc.CongestionWindow() &&
+		(f.pacer == nil || f.pacer.take(ccPacketSize))
+}
+
+// send sends a packet of f's into the bottleneck, unless its queue is full.
+func (s *ccSim) send(now time.Time, f *ccSimFlow) {
+	p := ccSimPacket{flow: f, pn: f.next, sentAt: now}
+	f.next++
+	f.sent = append(f.sent, p)
+	f.inFlight += ccPacketSize
+	if f.pause > 0 {
+		if f.writable -= ccPacketSize; f.writable <= 0 {
+			f.nextWrite = now.Add(f.pause)
+		}
+	}
+	f.cc.OnPacketSent(now, p.pn, ccPacketSize, f.inFlight)
+	f.maxWindow = max(f.maxWindow, int(f.cc.cwnd.Load()))
+	s.counters.Sent++
+	if s.queuedBytes+ccPacketSize > s.link.Queue {
+		s.counters.Overflowed++
+		return
+	}
+	s.free = later(now, s.free).Add(time.Duration(ccPacketSize) * time.Second / time.Duration(s.link.Bandwidth))
+	p.at = s.free
+	s.queued = append(s.queued, p)
+	s.queuedBytes += ccPacketSize
+}
+
+// acked reports the acknowledgement of p, and the packets sent before it
+// that were lost. The bottleneck keeps the packets of a flow in order, so
+// those are all that are still unacknowledged.
+func (f *ccSimFlow) acked(now time.Time, p ccSimPacket) {
+	if len(f.sent) == 0 || f.sent[0].pn > p.pn {
+		return // declared lost on a timeout already
+	}
+	for f.sent[0].pn < p.pn {
+		f.lost(now)
+	}
+	f.sent = f.sent[1:]
+	f.inFlight -= ccPacketSize
+	f.delivered += ccPacketSize
+	f.cc.OnPacketAcked(now, p.pn, p.sentAt, ccPacketSize, f.inFlight)
+}
+
+// lost declares the oldest packet in flight lost.
+func (f *ccSimFlow) lost(now time.Time) {
+	p := f.sent[0]
+	f.sent = f.sent[1:]
+	f.inFlight -= ccPacketSize
+	f.cc.OnPacketLost(now, p.pn, p.sentAt, ccPacketSize, f.inFlight)
+}
+
+// timeout declares every packet in flight lost once the oldest has gone
+// unacknowledged for three smoothed round trips.
+func (f *ccSimFlow) timeout(now time.Time) {
+	srtt := time.Duration(f.cc.srtt.Load())
+	if srtt == 0 {
+		srtt = initialRTT
+	}
+	if len(f.sent) == 0 || now.Sub(f.sent[0].sentAt) < 3*srtt {
+		return
+	}
+	for len(f.sent) > 0 {
+		f.lost(now)
+	}
+	f.cc.OnRetransmissionTimeout(now)
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+var congestionControls = []CongestionControl{NewReno, Cubic, BBR}
+
+func TestCongestionControlThroughput(t *testing.T) {
+	for _, cc := range congestionControls {
+		t.Run(cc.Name, func(t *testing.T) {
+			flows, _ := runCCFlows(t, cc, ccBottleneck, 1, 0, true)
+			// A window of a bandwidth-delay product keeps the bottleneck
+			// busy; the initial window is half of one.
+			if w := flows[0].maxWindow; w < int(ccBDP) {
+				t.Errorf("window grew to %d bytes, want at least the bandwidth-delay product of %d", w, ccBDP)
+			}
+		})
+	}
+}
+
+func TestCongestionControlFairness(t *testing.T) {
+	for _, cc := range congestionControls {
+		t.Run(cc.Name, func(t *testing.T) {
+			flows, _ := runCCFlows(t, cc, ccBottleneck, 2, 0, true)
+			x, y := float64(flows[0].delivered), float64(flows[1].delivered)
+			// Jain's index: 1 for an even split, 0.5 if one flow takes all.
+			if jain := (x + y) * (x + y) / (2 * (x*x + y*y)); jain < 0.75 {
+				t.Errorf("flows split the bottleneck %.0f to %.0f bytes, fairness index %.2f", x, y, jain)
+			}
+		})
+	}
+}
+
+func TestCongestionControlLoss(t *testing.T) {
+	start := time.Now()
+	for _, tc := range []struct {
+		cc   CongestionControl
+		want int // window after a loss, from 20 packets
+	}{
+		{NewReno, 10 * ccPacketSize},
+		{Cubic, 14 * ccPacketSize},
+		{BBR, 20 * ccPacketSize}, // BBR doesn't react to loss
+	} {
+		c := tc.cc.New(ccPacketSize)
+		for i := range 10 {
+			sent := start.Add(time.Duration(i) * time.Millisecond)
+			c.OnPacketSent(sent, uint64(i), ccPacketSize, (i+1)*ccPacketSize)
+		}
+		for i := range 10 {
+			sent := start.Add(time.Duration(i) * time.Millisecond)
+			c.OnPacketAcked(sent.Add(20*time.Millisecond), uint64(i), sent, ccPacketSize, (9-i)*ccPacketSize)
+		}
+		if got := c.CongestionWindow(); got != 20*ccPacketSize {
+			t.Fatalf("%s: window %d after slow start, want %d", tc.cc.Name, got, 20*ccPacketSize)
+		}
+		// Two losses of one round trip reduce the window once.
+		lost := start.Add(30 * time.Millisecond)
+		c.OnPacketLost(lost, 25, start.Add(25*time.Millisecond), ccPacketSize, 0)
+		c.OnPacketLost(lost, 26, start.Add(26*time.Millisecond), ccPacketSize, 0)
+		if got := c.CongestionWindow(); got != tc.want {
+			t.Errorf("%s: window %d after a loss, want %d", tc.cc.Name, got, tc.want)
+		}
+	}
+}
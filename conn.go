@@ -0,0 +1,348 @@
+package udxtransport
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// sessionKeys seal the frames of native streams and the transport's packets:
+// local for what we send, remote for what the peer sends. Streams and
+// packets are keyed apart, so their nonces never meet under one key.
+type sessionKeys struct {
+	local, remote               cipher.AEAD // stream frames
+	localPackets, remotePackets cipher.AEAD
+	ready                       chan struct{} // closed once remote is set; nil if it was set from the start
+}
+
+// newSessionKeys expands the stream secret agreed during the handshake into
+// AES-GCM keys for each direction. The dialer's direction of a resumption
+// with early data is keyed with the early secret instead. A dialer that
+// doesn't know the stream secret yet sets the listener's keys later.
+func newSessionKeys(res *handshakeResult, isDialer bool) (*sessionKeys, error) {
+	dialerSecret := res.secret
+	if res.earlySecret != nil {
+		dialerSecret = res.earlySecret
+	}
+	dialerKey, dialerPackets, err := newDirectionKeys(dialerSecret, "libp2p-udx dialer")
+	if err != nil {
+		return nil, err
+	}
+	if res.secret == nil {
+		return &sessionKeys{local: dialerKey, localPackets: dialerPackets, ready: make(chan struct{})}, nil
+	}
+	listenerKey, listenerPackets, err := newDirectionKeys(res.secret, "libp2p-udx listener")
+	if err != nil {
+		return nil, err
+	}
+	if isDialer {
+		return &sessionKeys{local: dialerKey, remote: listenerKey, localPackets: dialerPackets, remotePackets: listenerPackets}, nil
+	}
+	return &sessionKeys{local: listenerKey, remote: dialerKey, localPackets: listenerPackets, remotePackets: dialerPackets}, nil
+}
+
+// setRemote sets the listener's keys once the dialer learns the stream
+// secret.
+func (k *sessionKeys) setRemote(secret []byte) error {
+	key, packets, err := newDirectionKeys(secret, "libp2p-udx listener")
+	if err != nil {
+		return err
+	}
+	k.remote, k.remotePackets = key, packets
+	close(k.ready)
+	return nil
+}
+
+// remotePacketKey returns the key of the remote's packets, or nil if it
+// isn't set yet.
+func (k *sessionKeys) remotePacketKey() cipher.AEAD {
+	if k.ready != nil {
+		select {
+		case <-k.ready:
+		default:
+			return nil
+		}
+	}
+	return k.remotePackets
+}
+
+// waitRemote returns the key of the remote's stream frames once it is set,
+// or nil if done is closed first.
+func (k *sessionKeys) waitRemote(done <-chan struct{}) cipher.AEAD {
+	if k.ready != nil {
+		select {
+		case <-k.ready:
+		case <-done:
+			return nil
+		}
+	}
+	return k.remote
+}
+
+// newDirectionKeys derives the keys of one direction's stream frames and
+// packets from secret.
+func newDirectionKeys(secret []byte, info string) (streams, packets cipher.AEAD, err error) {
+	if streams, err = newSessionAEAD(secret, info); err != nil {
+		return nil, nil, err
+	}
+	if packets, err = newSessionAEAD(secret, info+" packets"); err != nil {
+		return nil, nil, err
+	}
+	return streams, packets, nil
+}
+
+func newSessionAEAD(secret []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// conn is a natively multiplexed tpt.CapableConn: every network.MuxedStream
+// is its own udx.Stream on the wrapped udx.Connection.
+type conn struct {
+	udxConn   *udx.Connection
+	control   *stream // stream 0: the handshake, then close frames; kept open so the handshake's last flight is never cut short
+	transport *Transport
+	mux       *udpMux // socket the connection runs on; released on Close
+	trace     *connTrace
+	scope     network.ConnManagementScope
+	keys      *sessionKeys
+	isDialer  bool
+
+	localPeer      peer.ID
+	localMultiaddr ma.Multiaddr
+
+	remotePeerID peer.ID
+	remotePubKey ic.PubKey
+	path         *connPath // remote address, which changes if the connection migrates
+	pkts         *packets  // datagrams and path MTU probes
+
+	nextID    atomic.Uint64
+	mtu       atomic.Int64 // path MTU in bytes of UDP payload
+	probeAcks chan int     // sizes of acknowledged MTU probes; nil unless discoverMTU runs
+	closed    atomic.Bool
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+	closeErr  error
+
+	remoteIDsMu sync.Mutex
+	maxRemoteID uint64              // highest ID of a stream the remote opened; 0 before the first
+	skippedIDs  map[uint64]struct{} // remote IDs below maxRemoteID not read yet, within streamIDWindow
+
+	streamsMu sync.Mutex
+	closing   *network.ConnError // set once either side starts closing the connection
+	active    int                // streams not yet closed or reset
+	idle      chan struct{}      // closed when active drops to zero while draining
+}
+
+var (
+	_ tpt.CapableConn = (*conn)(nil)
+	_ StatsConn       = (*conn)(nil)
+)
+
+// streamIDWindow is how many streams behind the remote's highest one a
+// stream's header may be read, as headers are read in whatever order the
+// streams are first used.
+const streamIDWindow = 256
+
+// Stream IDs are never reused: the dialer opens even IDs from 2 (stream 0
+// carries the handshake) and the listener odd IDs from 1.
+func (c *conn) initStreamIDs() {
+	c.skippedIDs = make(map[uint64]struct{})
+	if c.isDialer {
+		c.nextID.Store(2)
+	} else {
+		c.nextID.Store(1)
+	}
+}
+
+// readStreamHeader reads the ID of a stream opened by the remote and rejects
+// IDs of the wrong parity or that were used before.
+func (c *conn) readStreamHeader(str *udx.Stream) (uint64, error) {
+	var hdr [streamIDLen]byte
+	if _, err := io.ReadFull(str, hdr[:]); err != nil {
+		return 0, err
+	}
+	id := binary.BigEndian.Uint64(hdr[:])
+	if wantOdd := c.isDialer; id == 0 || (id%2 == 1) != wantOdd {
+		return 0, errStreamProtocol
+	}
+	if !c.acceptRemoteID(id) {
+		return 0, errStreamProtocol
+	}
+	return id, nil
+}
+
+// acceptRemoteID reports whether the remote may open a stream with id. As in
+// QUIC, the remote opens its IDs in order, so only the highest one is kept,
+// along with the IDs below it whose headers haven't been read yet. Those
+// more than streamIDWindow streams behind are given up on.
+func (c *conn) acceptRemoteID(id uint64) bool {
+	c.remoteIDsMu.Lock()
+	defer c.remoteIDsMu.Unlock()
+	if id <= c.maxRemoteID {
+		if _, ok := c.skippedIDs[id]; !ok {
+			return false
+		}
+		delete(c.skippedIDs, id)
+		return true
+	}
+	next := c.maxRemoteID + 2
+	if c.maxRemoteID == 0 {
+		next = 2 - id%2 // the remote's first ID
+	}
+	lowest := uint64(0)
+	if id > 2*streamIDWindow {
+		lowest = id - 2*streamIDWindow
+	}
+	for skipped := max(next, lowest); skipped < id; skipped += 2 {
+		c.skippedIDs[skipped] = struct{}{}
+	}
+	for skipped := range c.skippedIDs {
+		if skipped < lowest {
+			delete(c.skippedIDs, skipped)
+		}
+	}
+	c.maxRemoteID = id
+	return true
+}
+
+func (c *conn) As(target any) bool {
+	switch t := target.(type) {
+	case **udx.Connection:
+		*t = c.udxConn
+		return true
+	case *StatsConn:
+		*t = c
+		return true
+	case *DatagramConn:
+		if !c.transport.datagrams {
+			return false
+		}
+		*t = c
+		return true
+	}
+	return false
+}
+
+// LinkStats returns the current state of the UDX connection, with the path
+// MTU discovery found.
+func (c *conn) LinkStats() LinkStats {
+	s := c.path.linkStats()
+	s.MTU = c.pathMTU()
+	return s
+}
+
+// PathMTU returns the path MTU discovery found, or the initial MTU if it
+// doesn't run.
+func (c *conn) PathMTU() int { return c.pathMTU() }
+
+// Close closes the connection and releases its resource scope.
+func (c *conn) Close() error {
+	return c.closeWithCode(network.ConnNoError)
+}
+
+// CloseWithError closes the connection, sending the remote a close frame
+// with errCode first.
+func (c *conn) CloseWithError(errCode network.ConnErrorCode) error {
+	c.goAway(errCode)
+	return c.closeWithCode(errCode)
+}
+
+func (c *conn) closeWithCode(code network.ConnErrorCode) error {
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+		close(c.done)
+		c.control.str.Close()
+		c.closeErr = closeUDX(c.udxConn, code)
+		c.path.close()
+		c.closePackets()
+		c.transport.removeConn(c)
+		c.transport.releaseMux(c.mux)
+		c.scope.Done()
+		if m := c.transport.metrics; m != nil {
+			m.ConnClosed(c.udxConn, c.localMultiaddr)
+		}
+		c.trace.close()
+	})
+	return c.closeErr
+}
+
+// IsClosed returns whether Close has been called.
+func (c *conn) IsClosed() bool {
+	return c.closed.Load()
+}
+
+// OpenStream opens a new udx.Stream and announces its ID to the remote. Once
+// either side has started closing the connection, it fails with a
+// *network.ConnError.
+func (c *conn) OpenStream(ctx context.Context) (network.MuxedStream, error) {
+	if err := c.openingStream(); err != nil {
+		return nil, err
+	}
+	str, err := c.udxConn.OpenStream(ctx)
+	if err != nil {
+		c.streamDone()
+		return nil, c.streamErr(err)
+	}
+	id := c.nextID.Add(2) - 2
+
+	var hdr [streamIDLen]byte
+	binary.BigEndian.PutUint64(hdr[:], id)
+	if _, err := str.Write(hdr[:]); err != nil {
+		str.Close()
+		c.streamDone()
+		return nil, fmt.Errorf("writing stream header: %w", c.streamErr(err))
+	}
+	c.trace.event(udxtrace.StreamOpened, map[string]any{"stream_id": id, "initiator": "local"})
+	return &stream{str: str, conn: c, id: id}, nil
+}
+
+// AcceptStream accepts a stream opened by the remote.
+func (c *conn) AcceptStream() (network.MuxedStream, error) {
+	str, err := c.udxConn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, c.streamErr(err)
+	}
+	c.acceptedStream()
+	return &stream{str: str, conn: c, accepted: true}, nil
+}
+
+func (c *conn) LocalPeer() peer.ID            { return c.localPeer }
+func (c *conn) RemotePeer() peer.ID           { return c.remotePeerID }
+func (c *conn) RemotePublicKey() ic.PubKey    { return c.remotePubKey }
+func (c *conn) LocalMultiaddr() ma.Multiaddr  { return c.localMultiaddr }
+func (c *conn) RemoteMultiaddr() ma.Multiaddr { return c.path.remoteMultiaddr() }
+func (c *conn) Transport() tpt.Transport      { return c.transport }
+func (c *conn) Scope() network.ConnScope      { return c.scope }
+
+// ConnState reports the built-in handshake as the security protocol and
+// native UDX streams as the multiplexer.
+func (c *conn) ConnState() network.ConnectionState {
+	return network.ConnectionState{
+		Security:          handshakeSecurityID,
+		StreamMultiplexer: nativeProtocolID,
+		Transport:         "udx",
+	}
+}
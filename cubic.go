@@ -0,0 +1,116 @@
+package udxtransport
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	cubicC    = 0.4 // window growth, in packets per second cubed
+	cubicBeta = 0.7 // window kept on loss
+	// cubicAlpha makes the Reno-friendly window grow as fast as NewReno
+	// does with cubicBeta's decrease.
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// cubic is the congestion controller of CUBIC (RFC 9438). Windows are in
+// bytes, and the cubic function in packets.
+type cubic struct {
+	maxDatagramSize int
+	cwnd            int
+	ssthresh        int
+	recoveryStart   time.Time // packets sent before it don't reduce the window again
+	rtt             time.Duration
+
+	epochStart time.Time // start of the current congestion avoidance epoch; zero before one starts
+	k          float64   // seconds from epochStart until the window is back at wMax
+	wMax       float64   // window before the last reduction, in packets
+	wLastMax   float64   // wMax before the last reduction, for fast convergence
+	wEst       float64   // Reno-friendly window, in packets
+}
+
+func newCubic(maxDatagramSize int) CongestionController {
+	return &cubic{
+		maxDatagramSize: maxDatagramSize,
+		cwnd:            initialWindowPackets * maxDatagramSize,
+		ssthresh:        int(^uint(0) >> 1),
+	}
+}
+
+func (c *cubic) OnPacketSent(time.Time, uint64, int, int) {}
+
+func (c *cubic) OnPacketAcked(now time.Time, _ uint64, sentAt time.Time, bytes, bytesInFlight int) {
+	if sample := now.Sub(sentAt); c.rtt == 0 {
+		c.rtt = sample
+	} else {
+		c.rtt = (7*c.rtt + sample) / 8
+	}
+	if !sentAt.After(c.recoveryStart) {
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd += bytes
+		return
+	}
+
+	mds := float64(c.maxDatagramSize)
+	cwnd := float64(c.cwnd) / mds
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		c.wEst = cwnd
+		if c.wMax <= cwnd {
+			c.wMax = cwnd
+			c.k = 0
+		} else {
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+		}
+	}
+	t := now.Add(c.rtt).Sub(c.epochStart).Seconds()
+	target := cubicC*math.Pow(t-c.k, 3) + c.wMax
+	target = min(max(target, cwnd), 1.5*cwnd)
+	c.wEst += cubicAlpha * float64(bytes) / mds / cwnd
+	if c.wEst > target {
+		target = c.wEst
+	}
+	c.cwnd += int((target - cwnd) / cwnd * float64(bytes))
+}
+
+func (c *cubic) OnPacketLost(now time.Time, _ uint64, sentAt time.Time, bytes, bytesInFlight int) {
+	if !sentAt.After(c.recoveryStart) {
+		return
+	}
+	c.recoveryStart = now
+	c.reduce()
+}
+
+// reduce shrinks the window at the start of a congestion event.
+func (c *cubic) reduce() {
+	cwnd := float64(c.cwnd) / float64(c.maxDatagramSize)
+	if cwnd < c.wLastMax {
+		// Fast convergence: a flow whose window keeps shrinking releases
+		// bandwidth to newer flows sooner.
+		c.wLastMax = cwnd
+		c.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wLastMax = cwnd
+		c.wMax = cwnd
+	}
+	c.cwnd = max(int(float64(c.cwnd)*cubicBeta), c.minWindow())
+	c.ssthresh = c.cwnd
+	c.epochStart = time.Time{}
+}
+
+func (c *cubic) OnRetransmissionTimeout(now time.Time) {
+	c.recoveryStart = now
+	c.reduce()
+	c.cwnd = c.minWindow()
+}
+
+func (c *cubic) SetMaxDatagramSize(n int) {
+	c.maxDatagramSize = n
+	c.cwnd = max(c.cwnd, c.minWindow())
+}
+
+func (c *cubic) CongestionWindow() int { return c.cwnd }
+
+func (c *cubic) minWindow() int { return minWindowPackets * c.maxDatagramSize }
@@ -0,0 +1,107 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// datagramQueueLen is how many received datagrams wait for ReceiveDatagram;
+// more are dropped.
+const datagramQueueLen = 128
+
+var (
+	// ErrDatagramsUnsupported is returned by SendDatagram when the remote
+	// hasn't announced datagram support, either because it doesn't support
+	// them or because its announcement hasn't arrived yet.
+	ErrDatagramsUnsupported = errors.New("remote doesn't support datagrams")
+	// ErrDatagramTooLarge is returned by SendDatagram for a payload above
+	// MaxDatagramSize.
+	ErrDatagramTooLarge = errors.New("datagram too large")
+)
+
+// DatagramConn is implemented by natively multiplexed connections of a
+// transport created with EnableDatagrams. Behind the swarm, get it with As:
+//
+//	var dc udxtransport.DatagramConn
+//	if conn.As(&dc) {
+//		err := dc.SendDatagram(msg)
+//	}
+type DatagramConn interface {
+	// SendDatagram sends b as a single unreliable, unordered message. It
+	// counts against the connection's congestion window like the packets
+	// of streams, and is dropped, as if lost, when the window is full.
+	SendDatagram(b []byte) error
+	// ReceiveDatagram returns the next datagram from the remote.
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	// MaxDatagramSize is the largest payload SendDatagram takes, derived
+	// from the path MTU. It is 0 until the remote has announced datagram
+	// support, right after the handshake.
+	MaxDatagramSize() int
+}
+
+var _ DatagramConn = (*conn)(nil)
+
+func (c *conn) MaxDatagramSize() int {
+	if !c.transport.datagrams {
+		return 0
+	}
+	c.pkts.mu.Lock()
+	remoteMax := c.pkts.remoteMax
+	c.pkts.mu.Unlock()
+	if remoteMax == 0 {
+		return 0
+	}
+	return min(remoteMax, c.pathMTU()-packetHeaderLen-c.keys.local.Overhead())
+}
+
+func (c *conn) SendDatagram(b []byte) error {
+	if c.closed.Load() {
+		return c.streamErr(net.ErrClosed)
+	}
+	max := c.MaxDatagramSize()
+	if max == 0 {
+		return ErrDatagramsUnsupported
+	}
+	if len(b) > max {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrDatagramTooLarge, len(b), max)
+	}
+	n, err := c.sendPacket(packetDatagram, b)
+	if err == errCongested {
+		return nil // dropped, as if lost
+	}
+	if m := c.transport.metrics; m != nil && err == nil {
+		m.BytesSent(n)
+	}
+	return err
+}
+
+func (c *conn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	if !c.transport.datagrams {
+		return nil, ErrDatagramsUnsupported
+	}
+	select {
+	case b := <-c.pkts.queue:
+		return b, nil
+	case <-c.done:
+		return nil, c.streamErr(net.ErrClosed)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// receiveDatagram queues the datagram of a packet of size bytes, dropping it
+// if the queue is full.
+func (c *conn) receiveDatagram(payload []byte, size int) {
+	if !c.transport.datagrams {
+		return
+	}
+	if m := c.transport.metrics; m != nil {
+		m.BytesReceived(size)
+	}
+	select {
+	case c.pkts.queue <- payload:
+	default:
+	}
+}
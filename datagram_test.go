@@ -0,0 +1,181 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxsim"
+)
+
+// datagramConn returns c's DatagramConn once the remote's announcement has
+// arrived.
+func datagramConn(t *testing.T, c tpt.CapableConn) DatagramConn {
+	t.Helper()
+	var dc DatagramConn
+	if !c.As(&dc) {
+		t.Fatalf("%T isn't a DatagramConn", c)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dc.MaxDatagramSize() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("remote didn't announce datagram support")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return dc
+}
+
+func TestDatagrams(t *testing.T) {
+	_, _, dialed, accepted := connectedPeers(t, EnableDatagrams())
+	client, server := datagramConn(t, dialed), datagramConn(t, accepted)
+
+	if max := client.MaxDatagramSize(); max < baseMTU-packetHeaderLen-16 || max > defaultMaxMTU-packetHeaderLen-16 {
+		t.Errorf("MaxDatagramSize = %d", max)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, dir := range []struct {
+		name     string
+		from, to DatagramConn
+	}{{"to server", client, server}, {"to client", server, client}} {
+		// Datagrams may be lost, so send until one arrives.
+		msg := []byte("hello " + dir.name)
+		got := make(chan []byte, 1)
+		go func() {
+			b, err := dir.to.ReceiveDatagram(ctx)
+			if err == nil {
+				got <- b
+			}
+		}()
+	send:
+		for {
+			if err := dir.from.SendDatagram(msg); err != nil {
+				t.Fatalf("%s: %v", dir.name, err)
+			}
+			select {
+			case b := <-got:
+				if string(b) != string(msg) {
+					t.Errorf("%s: received %q, want %q", dir.name, b, msg)
+				}
+				break send
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("%s: no datagram arrived", dir.name)
+			}
+		}
+	}
+
+	if err := client.SendDatagram(make([]byte, client.MaxDatagramSize()+1)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("oversized SendDatagram: %v, want %v", err, ErrDatagramTooLarge)
+	}
+
+	// Streams still work next to datagrams.
+	str, err := dialed.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	dialed.Close()
+	if _, err := client.ReceiveDatagram(ctx); err == nil {
+		t.Error("ReceiveDatagram succeeded on a closed connection")
+	}
+}
+
+func TestDatagramsNotNegotiated(t *testing.T) {
+	server := newTestTransport(t, nil, nil)
+	t.Cleanup(func() { server.Close() })
+	ln, serverID, conns := listenForTest(t, server)
+	dialed, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second, EnableDatagrams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := <-conns
+	defer accepted.Close()
+
+	var dc DatagramConn
+	if accepted.As(&dc) {
+		t.Error("connection of a transport without datagrams is a DatagramConn")
+	}
+	if !dialed.As(&dc) {
+		t.Fatal("connection isn't a DatagramConn")
+	}
+	if dc.MaxDatagramSize() != 0 {
+		t.Errorf("MaxDatagramSize = %d with a remote without datagrams", dc.MaxDatagramSize())
+	}
+	if err := dc.SendDatagram([]byte("hello")); !errors.Is(err, ErrDatagramsUnsupported) {
+		t.Errorf("SendDatagram: %v, want %v", err, ErrDatagramsUnsupported)
+	}
+
+	_, _, upgraded, _ := connectedPeers(t, EnableDatagrams(), DisableNativeMultiplexing())
+	if upgraded.As(&dc) {
+		t.Error("upgraded connection is a DatagramConn")
+	}
+}
+
+func TestDatagramReplayWindow(t *testing.T) {
+	var d packets
+	for _, c := range []struct {
+		seq  uint64
+		want bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		{100, true},
+		{37, true},
+		{36, false}, // behind the window
+		{37, false},
+		{200, true},
+		{100, false},
+	} {
+		if got := d.accept(c.seq); got != c.want {
+			t.Errorf("accept(%d) = %v, want %v", c.seq, got, c.want)
+		}
+	}
+}
+
+func TestDatagramCongestionWindow(t *testing.T) {
+	clock := udxsim.NewManualClock(time.Unix(1700000000, 0))
+	cc := newMeasuredController(NewReno.New(baseMTU), clock)
+	sent := clock.Now()
+	cc.OnPacketSent(sent, 0, baseMTU, baseMTU)
+	clock.Advance(20 * time.Millisecond)
+	cc.OnPacketAcked(clock.Now(), 0, sent, baseMTU, 0)
+	cwnd := (initialWindowPackets + 1) * baseMTU
+	cc.OnPacketSent(clock.Now(), 1, 8*baseMTU, 8*baseMTU)
+
+	// A datagram takes its room in the window from UDX's packets until it
+	// would have been acknowledged, a smoothed RTT later.
+	if !cc.sendOutside(2*baseMTU, false) {
+		t.Fatal("datagram with room in the window wasn't sent")
+	}
+	if got := cc.CongestionWindow(); got != cwnd-2*baseMTU {
+		t.Errorf("UDX's window %d with a datagram in flight, want %d", got, cwnd-2*baseMTU)
+	}
+	if cc.sendOutside(2*baseMTU, false) {
+		t.Error("datagram beyond the window was sent")
+	}
+	if !cc.sendOutside(2*baseMTU, true) {
+		t.Error("probe beyond the window wasn't sent")
+	}
+	if got := cc.CongestionWindow(); got != cwnd-4*baseMTU {
+		t.Errorf("UDX's window %d with a datagram and a probe in flight, want %d", got, cwnd-4*baseMTU)
+	}
+	clock.Advance(20 * time.Millisecond)
+	if got := cc.CongestionWindow(); got != cwnd {
+		t.Errorf("UDX's window %d a round trip later, want %d", got, cwnd)
+	}
+}
@@ -0,0 +1,20 @@
+package udxtransport
+
+import "syscall"
+
+// setDontFragment sets the don't-fragment bit on a socket's packets, without
+// limiting them to the path MTU the kernel has cached.
+func setDontFragment(raw syscall.RawConn) error {
+	var err4, err6 error
+	if err := raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	}); err != nil {
+		return err
+	}
+	// A socket of one address family refuses the other's option.
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
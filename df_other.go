@@ -0,0 +1,14 @@
+//go:build !linux
+
+package udxtransport
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setDontFragment isn't implemented outside Linux, so path MTU discovery
+// only runs on sockets that never fragment.
+func setDontFragment(syscall.RawConn) error {
+	return errors.New("don't-fragment bit not supported on this platform")
+}
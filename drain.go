@@ -0,0 +1,282 @@
+package udxtransport
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// closeFrameTimeout bounds how long closing a native connection tries to
+// deliver the close frame.
+const closeFrameTimeout = time.Second
+
+// Drainer is implemented by the Transport and by the listeners it returns.
+// Drain stops accepting connections, tells the remote of every live
+// connection that it is closing with code, waits until ctx is done for the
+// streams in flight to finish, and then closes the connections and releases
+// their sockets. It returns ctx.Err() if streams were cut short.
+//
+// Natively multiplexed connections wait for their open streams to be closed
+// or reset, and refuse new ones in the meantime. Streams of upgraded
+// connections live inside Yamux: those connections are closed right away,
+// sending Yamux's GoAway with code.
+type Drainer interface {
+	Drain(ctx context.Context, code network.ConnErrorCode) error
+}
+
+var (
+	_ Drainer = (*Transport)(nil)
+	_ Drainer = (*listener)(nil)
+)
+
+// errorCloser is implemented by udx.Connection when its close carries an
+// application error code to the remote. Without it, UDX connections are
+// closed without one; natively multiplexed connections still deliver the
+// code in the close frame on stream 0.
+type errorCloser interface {
+	CloseWithError(code uint32) error
+}
+
+// closeUDX closes c with code, if go-udx can carry one.
+func closeUDX(c *udx.Connection, code network.ConnErrorCode) error {
+	if ec, ok := any(c).(errorCloser); ok {
+		return ec.CloseWithError(uint32(code))
+	}
+	return c.Close()
+}
+
+// liveConn is a connection handed out by Dial or Accept, which Drain and
+// Close close.
+type liveConn interface {
+	Close() error
+	drain(ctx context.Context, code network.ConnErrorCode) error
+}
+
+// addListener tracks l until it is closed. It reports false if the
+// transport is closed.
+func (t *Transport) addListener(l *listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.listeners[l] = struct{}{}
+	return true
+}
+
+func (t *Transport) removeListener(l *listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.listeners, l)
+}
+
+// addConn tracks c until it is closed. l is the listener that accepted c, or
+// nil if it was dialed. It reports false if the transport is closed.
+func (t *Transport) addConn(c liveConn, l *rawListener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[c] = l
+	return true
+}
+
+func (t *Transport) removeConn(c liveConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// Drain closes the transport gracefully; see Drainer. Listeners are closed
+// first, then every connection is drained, and finally the outbound sockets
+// are closed.
+func (t *Transport) Drain(ctx context.Context, code network.ConnErrorCode) error {
+	t.mu.Lock()
+	listeners := make([]*listener, 0, len(t.listeners))
+	for l := range t.listeners {
+		listeners = append(listeners, l)
+	}
+	t.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	err := t.drainConns(ctx, code, func(*rawListener) bool { return true })
+	t.Close()
+	return err
+}
+
+// Drain closes the listener gracefully, draining the connections it
+// accepted; see Drainer. Connections dialed from the listener's socket are
+// left alone, and keep the socket open until they are closed.
+func (l *listener) Drain(ctx context.Context, code network.ConnErrorCode) error {
+	l.Close()
+	return l.raw.transport.drainConns(ctx, code, func(from *rawListener) bool { return from == l.raw })
+}
+
+// drainConns drains the live connections accepted by the listeners match
+// selects, nil standing for dialed connections, all at once.
+func (t *Transport) drainConns(ctx context.Context, code network.ConnErrorCode, match func(*rawListener) bool) error {
+	t.mu.Lock()
+	var conns []liveConn
+	for c, l := range t.conns {
+		if match(l) {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+
+	errs := make(chan error, len(conns))
+	for _, c := range conns {
+		go func() { errs <- c.drain(ctx, code) }()
+	}
+	var err error
+	for range conns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// drain announces the close to the remote, waits for the open streams to
+// finish or for ctx, and closes the connection.
+func (c *conn) drain(ctx context.Context, code network.ConnErrorCode) error {
+	c.goAway(code)
+	err := c.waitStreams(ctx)
+	c.closeWithCode(code)
+	return err
+}
+
+// goAway refuses new streams from now on and sends a close frame with code
+// on stream 0, so the remote stops opening streams too and closes its side
+// as soon as the connection goes away.
+func (c *conn) goAway(code network.ConnErrorCode) {
+	c.streamsMu.Lock()
+	if c.closing == nil {
+		c.closing = &network.ConnError{ErrorCode: code}
+	}
+	c.streamsMu.Unlock()
+
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(code))
+	c.control.wmu.Lock()
+	defer c.control.wmu.Unlock()
+	c.control.str.SetWriteDeadline(c.transport.clock.Now().Add(closeFrameTimeout))
+	c.control.writeFrame(frameClose, payload[:])
+}
+
+// readControl reads stream 0 after the handshake: the remote's receiver ID,
+// session tickets, and the close frame the remote sends before it closes the
+// connection. Once stream 0 ends, so does the connection.
+func (c *conn) readControl() {
+	defer c.Close()
+	for {
+		typ, payload, err := c.control.readFrame()
+		if err != nil {
+			return
+		}
+		if typ == frameReceiver {
+			if c.remoteReceiver(payload) != nil {
+				return
+			}
+			continue
+		}
+		if typ == frameTicket {
+			if c.storeTicket(payload) != nil {
+				return
+			}
+			continue
+		}
+		if typ != frameClose || len(payload) != 4 {
+			return
+		}
+		c.streamsMu.Lock()
+		if c.closing == nil {
+			c.closing = &network.ConnError{
+				Remote:    true,
+				ErrorCode: network.ConnErrorCode(binary.BigEndian.Uint32(payload)),
+			}
+		}
+		c.streamsMu.Unlock()
+	}
+}
+
+// closedWith returns the error the connection is closing with, or nil.
+func (c *conn) closedWith() *network.ConnError {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	return c.closing
+}
+
+// streamErr replaces the error of a stream on a closed connection with the
+// connection's close code, if it has one.
+func (c *conn) streamErr(err error) error {
+	if cerr := c.closedWith(); cerr != nil && c.closed.Load() {
+		return cerr
+	}
+	return err
+}
+
+// openingStream counts a new stream, unless the connection is closing.
+func (c *conn) openingStream() error {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if c.closing != nil {
+		return c.closing
+	}
+	c.active++
+	return nil
+}
+
+// acceptedStream counts a stream the remote opened. Streams that were on
+// their way when the connection started closing are still accepted.
+func (c *conn) acceptedStream() {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	c.active++
+}
+
+// streamDone is called once for every counted stream when it is closed or
+// reset.
+func (c *conn) streamDone() {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	c.active--
+	if c.active == 0 && c.idle != nil {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// waitStreams waits until no stream is open, or for ctx.
+func (c *conn) waitStreams(ctx context.Context) error {
+	c.streamsMu.Lock()
+	if c.active == 0 {
+		c.streamsMu.Unlock()
+		return nil
+	}
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+	idle := c.idle
+	c.streamsMu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain closes an upgraded connection right away: its streams aren't visible
+// to the transport.
+func (c *upgradedConn) drain(_ context.Context, code network.ConnErrorCode) error {
+	c.CloseWithError(code)
+	return nil
+}
@@ -0,0 +1,191 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+)
+
+// connectedPeers returns a server transport with a listener, and a
+// connection to it with the server's end.
+func connectedPeers(t *testing.T, opts ...Option) (server *Transport, ln tpt.Listener, dialed, accepted tpt.CapableConn) {
+	t.Helper()
+	server = newTestTransport(t, nil, nil, opts...)
+	t.Cleanup(func() { server.Close() })
+	ln, serverID, conns := listenForTest(t, server)
+	dialed, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case accepted = <-conns:
+		t.Cleanup(func() { accepted.Close() })
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+	return server, ln, dialed, accepted
+}
+
+// waitClosed waits for the remote's close to reach c.
+func waitClosed(t *testing.T, c tpt.CapableConn) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection wasn't closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	server, ln, dialed, accepted := connectedPeers(t)
+
+	str, err := dialed.OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	sstr, err := accepted.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(sstr, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- server.Drain(context.Background(), network.ConnShutdown) }()
+
+	// The client learns of the close and stops opening streams.
+	want := &network.ConnError{Remote: true, ErrorCode: network.ConnShutdown}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := dialed.OpenStream(context.Background())
+		if err != nil {
+			if !errors.Is(err, want) {
+				t.Fatalf("OpenStream: %v, want %v", err, want)
+			}
+			break
+		}
+		s.Reset()
+		if time.Now().After(deadline) {
+			t.Fatal("client kept opening streams")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := accepted.OpenStream(context.Background()); !errors.Is(err, &network.ConnError{ErrorCode: network.ConnShutdown}) {
+		t.Errorf("OpenStream on the draining side: %v", err)
+	}
+
+	// The stream in flight still finishes.
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned with a stream open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := str.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	str.CloseWrite()
+	if b, err := io.ReadAll(sstr); err != nil || string(b) != "pong" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	sstr.Close()
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("Drain: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain didn't return")
+	}
+	if !accepted.IsClosed() {
+		t.Error("drained connection isn't closed")
+	}
+	waitClosed(t, dialed)
+
+	if _, err := dialForTest(t, ln.Multiaddr(), accepted.LocalPeer(), 300*time.Millisecond); err == nil {
+		t.Error("dialed a drained listener")
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	_, ln, dialed, accepted := connectedPeers(t)
+
+	if _, err := dialed.OpenStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := ln.(Drainer).Drain(ctx, network.ConnShutdown)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Drain: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Drain took %s", d)
+	}
+	if !accepted.IsClosed() {
+		t.Error("connection isn't closed after the deadline")
+	}
+	waitClosed(t, dialed)
+}
+
+func TestDrainRemoteReset(t *testing.T) {
+	server, _, dialed, accepted := connectedPeers(t)
+
+	str, err := dialed.OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	sstr, err := accepted.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sstr, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	str.ResetWithError(42)
+	var serr *network.StreamError
+	if _, err := sstr.Read(make([]byte, 1)); !errors.As(err, &serr) || !serr.Remote {
+		t.Fatalf("Read: %v, want the remote's reset", err)
+	}
+
+	// The reset stream is never closed on this side, but it is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Drain(ctx, network.ConnShutdown); err != nil {
+		t.Fatalf("Drain waited for a stream the remote reset: %v", err)
+	}
+}
+
+func TestDrainUpgraded(t *testing.T) {
+	server, _, dialed, accepted := connectedPeers(t, DisableNativeMultiplexing())
+
+	if err := server.Drain(context.Background(), network.ConnShutdown); err != nil {
+		t.Fatal(err)
+	}
+	if !accepted.IsClosed() {
+		t.Error("drained connection isn't closed")
+	}
+	if _, err := dialed.AcceptStream(); err == nil {
+		t.Error("AcceptStream succeeded on a drained connection")
+	}
+}
@@ -0,0 +1,543 @@
+package udxtransport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// handshakeSecurityID identifies the built-in handshake that authenticates
+// native connections in place of Noise.
+//
+// The handshake binds the libp2p identities to an ephemeral X25519 exchange,
+// in the spirit of QUIC's TLS handshake with the libp2p certificate
+// extension:
+//
+//	dialer → listener:  preamble, e_i
+//	listener → dialer:  preamble, e_r, seal_r(pubkey_r, sig_r)
+//	dialer → listener:  seal_i(pubkey_i, sig_i)
+//
+// Each signature covers both ephemeral keys and the transcript so far, and
+// the identities travel sealed under keys derived from the ephemeral
+// exchange. The README's Handshake Security section sets out what the
+// handshake protects against and what it doesn't. The dialer can open
+// streams as soon as it has sent its last message.
+//
+// A dialer holding a session ticket from the listener resumes instead:
+//
+//	dialer → listener:  resume preamble, e_i, flags, ticket, binder
+//	listener → dialer:  resume preamble, e_r, confirm
+//
+// The binder and confirmation prove both sides know the ticket's resumption
+// secret, which stands in for the signatures, and the stream secret mixes
+// it with the ephemeral exchange. A listener that can't resume with the
+// ticket answers as in the full handshake, which the dialer then finishes,
+// unless the flags say the dialer sent early data: streams keyed with an
+// early secret derived from the resumption secret alone, written before the
+// listener answered. Early data can't be answered by a full handshake, so
+// the listener then sends the native preamble alone and fails the
+// connection.
+const handshakeSecurityID protocol.ID = "/libp2p-udx/handshake/1.0.0"
+
+const (
+	responderSigPrefix = "libp2p-udx-handshake responder:"
+	initiatorSigPrefix = "libp2p-udx-handshake initiator:"
+	maxHandshakeMsgLen = 8 << 10
+	ephemeralKeyLen    = 32
+	handshakeKeyLen    = 32
+	handshakeNonceLen  = 12
+	resumeMACLen       = 32 // binder and confirmation
+
+	resumeEarlyData byte = 1 << 0 // flag: the dialer keys its direction with the early secret
+)
+
+var errHandshakeSignature = errors.New("invalid handshake signature")
+
+// handshakeResult is what a completed handshake yields: the authenticated
+// remote identity and the secret the native stream keys are derived from.
+type handshakeResult struct {
+	remotePeer  peer.ID
+	remotePub   ic.PubKey
+	secret      []byte // nil for a dialer still waiting to learn it after sending early data
+	earlySecret []byte // keys the dialer's direction instead of secret if set
+	resumed     bool
+}
+
+// handshakeState accumulates the transcript and the ephemeral exchange.
+type handshakeState struct {
+	key        ic.PrivKey
+	ephemeral  *ecdh.PrivateKey
+	shared     []byte
+	ephemerals []byte // both ephemeral keys, initiator first, once exchanged
+	transcript []byte // hash of all messages so far
+}
+
+func newHandshakeState(key ic.PrivKey) (*handshakeState, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(nativePreamble)
+	return &handshakeState{key: key, ephemeral: eph, transcript: h[:]}, nil
+}
+
+func (hs *handshakeState) mix(parts ...[]byte) {
+	h := sha256.New()
+	h.Write(hs.transcript)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	hs.transcript = h.Sum(nil)
+}
+
+// exchange mixes both ephemeral keys into the transcript, initiator first,
+// and computes the shared secret.
+func (hs *handshakeState) exchange(initiatorEph, responderEph, remote []byte) error {
+	pub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	hs.shared, err = hs.ephemeral.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	hs.ephemerals = append(append([]byte{}, initiatorEph...), responderEph...)
+	hs.mix(initiatorEph, responderEph)
+	return nil
+}
+
+// signed returns what one side signs: its role's prefix, both ephemeral
+// keys and the transcript. The transcript covers the keys already; naming
+// them outright keeps a signature from standing for any other exchange even
+// if the transcript's hash were to fall.
+func (hs *handshakeState) signed(sigPrefix string) []byte {
+	msg := append([]byte(sigPrefix), hs.ephemerals...)
+	return append(msg, hs.transcript...)
+}
+
+// sealer returns the AEAD protecting one side's identity message. Each key
+// seals exactly one message, so the nonce is fixed.
+func (hs *handshakeState) sealer(label string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, hs.shared, hs.transcript, label, handshakeKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealIdentity produces the sealed pubkey and transcript signature for one
+// side and mixes them into the transcript.
+func (hs *handshakeState) sealIdentity(label, sigPrefix string) ([]byte, error) {
+	aead, err := hs.sealer(label)
+	if err != nil {
+		return nil, err
+	}
+	pubBytes, err := ic.MarshalPublicKey(hs.key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	sig, err := hs.key.Sign(hs.signed(sigPrefix))
+	if err != nil {
+		return nil, err
+	}
+	plain := appendLengthPrefixed(appendLengthPrefixed(nil, pubBytes), sig)
+	sealed := aead.Seal(nil, make([]byte, handshakeNonceLen), plain, nil)
+	hs.mix(pubBytes, sig)
+	return sealed, nil
+}
+
+// openIdentity verifies the remote side's sealed pubkey and transcript
+// signature and mixes them into the transcript.
+func (hs *handshakeState) openIdentity(label, sigPrefix string, sealed []byte) (ic.PubKey, error) {
+	aead, err := hs.sealer(label)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, make([]byte, handshakeNonceLen), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening identity: %w", err)
+	}
+	pubBytes, rest, err := readLengthPrefixed(plain)
+	if err != nil {
+		return nil, err
+	}
+	sig, _, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ic.UnmarshalPublicKey(pubBytes)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := pub.Verify(hs.signed(sigPrefix), sig)
+	if err != nil || !ok {
+		return nil, errHandshakeSignature
+	}
+	hs.mix(pubBytes, sig)
+	return pub, nil
+}
+
+// result derives the stream secret from the shared secret and the complete
+// transcript.
+func (hs *handshakeState) result(remotePub ic.PubKey) (*handshakeResult, error) {
+	remotePeer, err := peer.IDFromPublicKey(remotePub)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hkdf.Key(sha256.New, hs.shared, hs.transcript, "libp2p-udx stream secret", sessionSecretLen)
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeResult{remotePeer: remotePeer, remotePub: remotePub, secret: secret}, nil
+}
+
+// handshakeOutbound runs the dialer's side of the handshake. It returns
+// errLegacyPeer if the listener answers with multistream-select instead of
+// the native preamble, and ErrConnRefused if the listener refused the
+// connection.
+func handshakeOutbound(rw io.ReadWriter, key ic.PrivKey, p peer.ID) (*handshakeResult, error) {
+	hs, err := newHandshakeState(key)
+	if err != nil {
+		return nil, err
+	}
+	ephI := hs.ephemeral.PublicKey().Bytes()
+	if _, err := rw.Write(append(append([]byte{}, nativePreamble...), ephI...)); err != nil {
+		return nil, fmt.Errorf("writing preamble: %w", err)
+	}
+
+	if _, err := readPreamble(rw); err != nil {
+		if errors.Is(err, ErrConnRefused) || errors.Is(err, errLegacyPeer) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("reading preamble: %w", err)
+	}
+	return finishOutbound(rw, hs, ephI, p)
+}
+
+// finishOutbound runs the rest of the dialer's side of the full handshake
+// once the listener's preamble is read.
+func finishOutbound(rw io.ReadWriter, hs *handshakeState, ephI []byte, p peer.ID) (*handshakeResult, error) {
+	ephR := make([]byte, ephemeralKeyLen)
+	if _, err := io.ReadFull(rw, ephR); err != nil {
+		return nil, err
+	}
+	if err := hs.exchange(ephI, ephR, ephR); err != nil {
+		return nil, err
+	}
+	sealedR, err := readHandshakeMsg(rw)
+	if err != nil {
+		return nil, err
+	}
+	remotePub, err := hs.openIdentity("responder identity", responderSigPrefix, sealedR)
+	if err != nil {
+		return nil, err
+	}
+	if p != "" && !p.MatchesPublicKey(remotePub) {
+		return nil, fmt.Errorf("peer id mismatch: expected %s", p)
+	}
+
+	sealedI, err := hs.sealIdentity("initiator identity", initiatorSigPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHandshakeMsg(rw, sealedI); err != nil {
+		return nil, err
+	}
+	return hs.result(remotePub)
+}
+
+// ticketOpener opens the session tickets dialers resume with.
+type ticketOpener interface {
+	// openTicket returns the resumption secret and dialer's key of a
+	// ticket the listener issued and that hasn't expired.
+	openTicket(ticket []byte) (secret []byte, remote ic.PubKey, ok bool)
+	// firstUse reports whether ticket wasn't resumed with before, and marks
+	// it used.
+	firstUse(ticket []byte) bool
+}
+
+// handshakeInbound runs the listener's side of the handshake, resuming with
+// the dialer's ticket if tickets opens it. tickets is nil if the listener
+// doesn't resume. The dialer's preamble is expected to be unread in rw.
+func handshakeInbound(rw io.ReadWriter, key ic.PrivKey, tickets ticketOpener) (*handshakeResult, error) {
+	hs, err := newHandshakeState(key)
+	if err != nil {
+		return nil, err
+	}
+	resume, err := readPreamble(rw)
+	if err != nil {
+		return nil, err
+	}
+	ephI := make([]byte, ephemeralKeyLen)
+	if _, err := io.ReadFull(rw, ephI); err != nil {
+		return nil, err
+	}
+	if resume {
+		res, err := resumeInbound(rw, hs, ephI, tickets)
+		if res != nil || err != nil {
+			return res, err
+		}
+	}
+	ephR := hs.ephemeral.PublicKey().Bytes()
+	if err := hs.exchange(ephI, ephR, ephI); err != nil {
+		return nil, err
+	}
+	sealedR, err := hs.sealIdentity("responder identity", responderSigPrefix)
+	if err != nil {
+		return nil, err
+	}
+	msg := append(append([]byte{}, nativePreamble...), ephR...)
+	msg = appendLengthPrefixed(msg, sealedR)
+	if _, err := rw.Write(msg); err != nil {
+		return nil, err
+	}
+
+	sealedI, err := readHandshakeMsg(rw)
+	if err != nil {
+		return nil, err
+	}
+	remotePub, err := hs.openIdentity("initiator identity", initiatorSigPrefix, sealedI)
+	if err != nil {
+		return nil, err
+	}
+	return hs.result(remotePub)
+}
+
+// resumingHandshake is the dialer's side of a resumption whose first
+// message is sent.
+type resumingHandshake struct {
+	full        *handshakeState // the full handshake, should the listener fall back to it
+	hs          *handshakeState
+	ephI        []byte
+	ticket      SessionTicket
+	earlyData   bool
+	earlySecret []byte
+}
+
+// startResumption sends the first message of a resumption with ticket.
+func startResumption(rw io.Writer, key ic.PrivKey, ticket SessionTicket, earlyData bool) (*resumingHandshake, error) {
+	full, err := newHandshakeState(key)
+	if err != nil {
+		return nil, err
+	}
+	r := &resumingHandshake{full: full, ephI: full.ephemeral.PublicKey().Bytes(), ticket: ticket, earlyData: earlyData}
+	var flags byte
+	if earlyData {
+		flags |= resumeEarlyData
+	}
+	hs := *full
+	r.hs = &hs
+	r.hs.mix(resumePreamble, r.ephI, []byte{flags}, ticket.Ticket)
+	binder, err := resumeMAC(ticket.Secret, nil, r.hs.transcript, "libp2p-udx resumption binder")
+	if err != nil {
+		return nil, err
+	}
+	r.hs.mix(binder)
+	if r.earlyData {
+		r.earlySecret, err = hkdf.Key(sha256.New, ticket.Secret, r.hs.transcript, "libp2p-udx early secret", sessionSecretLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msg := append(append([]byte{}, resumePreamble...), r.ephI...)
+	msg = append(msg, flags)
+	msg = appendLengthPrefixed(msg, ticket.Ticket)
+	if _, err := rw.Write(append(msg, binder...)); err != nil {
+		return nil, fmt.Errorf("writing preamble: %w", err)
+	}
+	return r, nil
+}
+
+// early returns what the dialer knows of the session before the listener
+// answers, for sending early data.
+func (r *resumingHandshake) early() (*handshakeResult, error) {
+	remotePeer, err := peer.IDFromPublicKey(r.ticket.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeResult{remotePeer: remotePeer, remotePub: r.ticket.PubKey, earlySecret: r.earlySecret, resumed: true}, nil
+}
+
+// finish reads the listener's answer. It finishes the full handshake if
+// the listener fell back to it, which fails with errTicketRejected once
+// early data was sent.
+func (r *resumingHandshake) finish(rw io.ReadWriter, p peer.ID) (*handshakeResult, error) {
+	resumed, err := readPreamble(rw)
+	if err != nil {
+		if errors.Is(err, ErrConnRefused) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("reading preamble: %w", err)
+	}
+	if !resumed {
+		if r.earlyData {
+			return nil, errTicketRejected
+		}
+		return finishOutbound(rw, r.full, r.ephI, p)
+	}
+	ephR := make([]byte, ephemeralKeyLen)
+	if _, err := io.ReadFull(rw, ephR); err != nil {
+		return nil, err
+	}
+	confirm := make([]byte, resumeMACLen)
+	if _, err := io.ReadFull(rw, confirm); err != nil {
+		return nil, err
+	}
+	if err := r.hs.exchange(r.ephI, ephR, ephR); err != nil {
+		return nil, err
+	}
+	want, err := resumeMAC(r.ticket.Secret, r.hs.shared, r.hs.transcript, "libp2p-udx resumption confirmation")
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(confirm, want) {
+		return nil, errHandshakeSignature
+	}
+	r.hs.mix(confirm)
+	res, err := r.hs.resumedResult(r.ticket.Secret, r.ticket.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	res.earlySecret = r.earlySecret
+	return res, nil
+}
+
+// resumeInbound resumes with the ticket of a resumption's first message.
+// It returns a nil result without an error if the ticket is no good and the
+// full handshake must run instead.
+func resumeInbound(rw io.ReadWriter, hs *handshakeState, ephI []byte, tickets ticketOpener) (*handshakeResult, error) {
+	var flags [1]byte
+	if _, err := io.ReadFull(rw, flags[:]); err != nil {
+		return nil, err
+	}
+	ticket, err := readHandshakeMsg(rw)
+	if err != nil {
+		return nil, err
+	}
+	binder := make([]byte, resumeMACLen)
+	if _, err := io.ReadFull(rw, binder); err != nil {
+		return nil, err
+	}
+
+	rs := *hs
+	rs.mix(resumePreamble, ephI, flags[:], ticket)
+	secret, remotePub, ok := []byte(nil), ic.PubKey(nil), false
+	if tickets != nil {
+		secret, remotePub, ok = tickets.openTicket(ticket)
+	}
+	if ok {
+		want, err := resumeMAC(secret, nil, rs.transcript, "libp2p-udx resumption binder")
+		ok = err == nil && hmac.Equal(binder, want) && tickets.firstUse(ticket)
+	}
+	earlyData := flags[0]&resumeEarlyData != 0
+	if !ok {
+		if earlyData {
+			// The native preamble alone tells the dialer its early data is
+			// lost.
+			rw.Write(nativePreamble)
+			return nil, errTicketRejected
+		}
+		return nil, nil
+	}
+	rs.mix(binder)
+	var earlySecret []byte
+	if earlyData {
+		if earlySecret, err = hkdf.Key(sha256.New, secret, rs.transcript, "libp2p-udx early secret", sessionSecretLen); err != nil {
+			return nil, err
+		}
+	}
+
+	ephR := rs.ephemeral.PublicKey().Bytes()
+	if err := rs.exchange(ephI, ephR, ephI); err != nil {
+		return nil, err
+	}
+	confirm, err := resumeMAC(secret, rs.shared, rs.transcript, "libp2p-udx resumption confirmation")
+	if err != nil {
+		return nil, err
+	}
+	msg := append(append(append([]byte{}, resumePreamble...), ephR...), confirm...)
+	if _, err := rw.Write(msg); err != nil {
+		return nil, err
+	}
+	rs.mix(confirm)
+	res, err := rs.resumedResult(secret, remotePub)
+	if err != nil {
+		return nil, err
+	}
+	res.earlySecret = earlySecret
+	return res, nil
+}
+
+// resumeMAC keys a MAC of the transcript with the resumption secret and, once
+// known, the ephemeral shared secret.
+func resumeMAC(secret, shared, transcript []byte, label string) ([]byte, error) {
+	return hkdf.Key(sha256.New, append(append([]byte{}, secret...), shared...), transcript, label, resumeMACLen)
+}
+
+// resumedResult derives the stream secret of a resumption from the
+// resumption secret, the shared secret and the complete transcript.
+func (hs *handshakeState) resumedResult(secret []byte, remotePub ic.PubKey) (*handshakeResult, error) {
+	remotePeer, err := peer.IDFromPublicKey(remotePub)
+	if err != nil {
+		return nil, err
+	}
+	streamSecret, err := hkdf.Key(sha256.New, append(append([]byte{}, secret...), hs.shared...), hs.transcript, "libp2p-udx stream secret", sessionSecretLen)
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeResult{remotePeer: remotePeer, remotePub: remotePub, secret: streamSecret, resumed: true}, nil
+}
+
+func appendLengthPrefixed(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func readLengthPrefixed(b []byte) (data, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+func writeHandshakeMsg(w io.Writer, msg []byte) error {
+	_, err := w.Write(appendLengthPrefixed(nil, msg))
+	return err
+}
+
+func readHandshakeMsg(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > maxHandshakeMsgLen {
+		return nil, fmt.Errorf("handshake message too large: %d bytes", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
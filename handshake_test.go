@@ -0,0 +1,136 @@
+package udxtransport
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	dialerKey, dialerID := generateKey(t)
+	listenerKey, listenerID := generateKey(t)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	type result struct {
+		res *handshakeResult
+		err error
+	}
+	inbound := make(chan result, 1)
+	go func() {
+		res, err := handshakeInbound(b, listenerKey, nil)
+		inbound <- result{res, err}
+	}()
+
+	out, err := handshakeOutbound(a, dialerKey, listenerID)
+	if err != nil {
+		t.Fatal("outbound:", err)
+	}
+	in := <-inbound
+	if in.err != nil {
+		t.Fatal("inbound:", in.err)
+	}
+
+	if out.remotePeer != listenerID {
+		t.Fatalf("dialer saw %s, want %s", out.remotePeer, listenerID)
+	}
+	if in.res.remotePeer != dialerID {
+		t.Fatalf("listener saw %s, want %s", in.res.remotePeer, dialerID)
+	}
+	if !bytes.Equal(out.secret, in.res.secret) {
+		t.Fatal("stream secrets differ")
+	}
+}
+
+func TestHandshakePeerIDMismatch(t *testing.T) {
+	dialerKey, _ := generateKey(t)
+	listenerKey, _ := generateKey(t)
+	_, otherID := generateKey(t)
+
+	a, b := net.Pipe()
+	defer b.Close()
+
+	go func() {
+		handshakeInbound(b, listenerKey, nil)
+		b.Close()
+	}()
+
+	_, err := handshakeOutbound(a, dialerKey, otherID)
+	a.Close()
+	if err == nil {
+		t.Fatal("handshake with the wrong peer ID should fail")
+	}
+}
+
+func TestHandshakeLegacyListener(t *testing.T) {
+	dialerKey, _ := generateKey(t)
+	_, listenerID := generateKey(t)
+
+	a, b := net.Pipe()
+	defer a.Close()
+
+	// A listener on the upgrader path answers with multistream-select and
+	// hangs up on the preamble.
+	go func() {
+		buf := make([]byte, len(nativePreamble)+ephemeralKeyLen)
+		b.Read(buf)
+		b.Write([]byte("\x13/multistream/1.0.0\n"))
+		b.Close()
+	}()
+
+	_, err := handshakeOutbound(a, dialerKey, listenerID)
+	if !errors.Is(err, errLegacyPeer) {
+		t.Fatalf("got %v, want errLegacyPeer", err)
+	}
+}
+
+func TestHandshakeBrokenStream(t *testing.T) {
+	dialerKey, _ := generateKey(t)
+	_, listenerID := generateKey(t)
+
+	// A native listener whose stream breaks off mid-preamble is no legacy
+	// peer, and neither is one that sends garbage.
+	for _, answer := range []string{"", "\x00/libp2p-udx/na", "\x13/multi", "garbage that is long enough"} {
+		a, b := net.Pipe()
+		go func() {
+			buf := make([]byte, len(nativePreamble)+ephemeralKeyLen)
+			b.Read(buf)
+			b.Write([]byte(answer))
+			b.Close()
+		}()
+		_, err := handshakeOutbound(a, dialerKey, listenerID)
+		a.Close()
+		if err == nil || errors.Is(err, errLegacyPeer) {
+			t.Errorf("answer %q: got %v, want a handshake error", answer, err)
+		}
+	}
+}
+
+func TestSessionKeysApart(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, sessionSecretLen)
+	dialer, err := newSessionKeys(&handshakeResult{secret: secret}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := newSessionKeys(&handshakeResult{secret: secret}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A stream ID the remote picked can give a frame the nonce of a packet;
+	// the two mustn't share a key.
+	nonce := packetNonce(1)
+	frame := dialer.local.Seal(nil, nonce, []byte("frame"), nil)
+	if _, err := listener.remote.Open(nil, nonce, frame, nil); err != nil {
+		t.Fatal("frame doesn't open under the stream key:", err)
+	}
+	if _, err := listener.remotePacketKey().Open(nil, nonce, frame, nil); err == nil {
+		t.Error("frame opens under the packet key")
+	}
+	pkt := dialer.localPackets.Seal(nil, nonce, []byte("packet"), nil)
+	if _, err := listener.remotePacketKey().Open(nil, nonce, pkt, nil); err != nil {
+		t.Error("packet doesn't open under the packet key:", err)
+	}
+}
@@ -0,0 +1,146 @@
+package udxtransport
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrHolePunching is returned when no connection arrived while punching.
+var ErrHolePunching = errors.New("hole punching attempted; no active dial")
+
+// HolePunchTimeout bounds how long the server side of a hole punch sends
+// punch packets and waits for the client's connection.
+var HolePunchTimeout = 5 * time.Second
+
+// errNoPunchSocket is returned when there's no listener to punch from: a
+// hole punched from any other socket can't be used to accept the connection.
+var errNoPunchSocket = errors.New("hole punching requires a listener on the same address family")
+
+type holePunchKey struct {
+	addr string
+	peer peer.ID
+}
+
+type activeHolePunch struct {
+	connCh    chan tpt.CapableConn
+	fulfilled bool
+}
+
+// holePunch implements the server side of a simultaneous connect. As with
+// QUIC, the roles assigned by the holepunch service decide which side dials:
+// the client dials as usual, while the server only sends punch packets from
+// its listen socket to open its NAT and then takes the client's connection
+// out of its listener. Both sides calling Dial at once thus yields exactly
+// one UDX connection, with an unambiguous dialer for the handshake.
+func (t *Transport) holePunch(ctx context.Context, udpNetwork string, remoteAddr *net.UDPAddr, p peer.ID) (tpt.CapableConn, error) {
+	m := t.getListenMux(udpNetwork, remoteAddr)
+	if m == nil {
+		return nil, errNoPunchSocket
+	}
+	defer t.releaseMux(m)
+
+	ctx, cancel := t.withTimeout(ctx, HolePunchTimeout)
+	defer cancel()
+
+	key := holePunchKey{addr: remoteAddr.String(), peer: p}
+	t.holePunchingMx.Lock()
+	if _, ok := t.holePunching[key]; ok {
+		t.holePunchingMx.Unlock()
+		return nil, fmt.Errorf("already punching hole for %s", remoteAddr)
+	}
+	connCh := make(chan tpt.CapableConn, 1)
+	t.holePunching[key] = &activeHolePunch{connCh: connCh}
+	t.holePunchingMx.Unlock()
+
+	var timer *clockTimer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	// Punch packets are random bytes, which the remote UDX multiplexer
+	// discards as undecodable.
+	payload := make([]byte, 64)
+	if ap, ok := addrPortOf(remoteAddr); ok {
+		m.demux.allow(ap)
+	}
+	var punchErr error
+loop:
+	for i := 0; ; i++ {
+		rand.Read(payload)
+		if _, err := m.conn.WriteTo(payload, remoteAddr); err != nil {
+			punchErr = err
+			break
+		}
+
+		maxSleep := min(10*(i+1)*(i+1), 200) // in ms
+		d := 10*time.Millisecond + time.Duration(mrand.IntN(maxSleep))*time.Millisecond
+		if timer == nil {
+			timer = newTimer(t.clock, d)
+		} else {
+			timer.Reset(d)
+		}
+		select {
+		case c := <-connCh:
+			t.holePunchingMx.Lock()
+			delete(t.holePunching, key)
+			t.holePunchingMx.Unlock()
+			return c, nil
+		case <-timer.C:
+		case <-ctx.Done():
+			punchErr = ErrHolePunching
+			break loop
+		}
+	}
+	// we only arrive here if punchErr != nil
+	t.holePunchingMx.Lock()
+	defer func() {
+		delete(t.holePunching, key)
+		t.holePunchingMx.Unlock()
+	}()
+	select {
+	case c := <-connCh:
+		return c, nil
+	default:
+		return nil, punchErr
+	}
+}
+
+// deliverHolePunch hands an inbound connection to the hole punch waiting for
+// it, if any, and reports whether it did.
+func (t *Transport) deliverHolePunch(c tpt.CapableConn) bool {
+	addr, err := udxAddrKey(c.RemoteMultiaddr())
+	if err != nil {
+		return false
+	}
+	key := holePunchKey{addr: addr, peer: c.RemotePeer()}
+
+	t.holePunchingMx.Lock()
+	defer t.holePunchingMx.Unlock()
+	hp, ok := t.holePunching[key]
+	if !ok || hp.fulfilled {
+		return false
+	}
+	hp.connCh <- c
+	hp.fulfilled = true
+	return true
+}
+
+// udxAddrKey formats a /udx multiaddr like net.UDPAddr.String.
+func udxAddrKey(addr ma.Multiaddr) (string, error) {
+	host, port, err := fromUDXMultiaddr(addr)
+	if err != nil {
+		return "", err
+	}
+	return (&net.UDPAddr{IP: net.ParseIP(host), Port: port}).String(), nil
+}
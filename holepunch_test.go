@@ -0,0 +1,243 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// natProxy simulates an address-restricted NAT in front of one peer. The
+// peer reaches a remote through an alias socket on the inside; the proxy
+// forwards from its public socket and only lets packets from a remote back
+// in once the peer has sent something to it.
+type natProxy struct {
+	inside *net.UDPAddr // the peer's listen address
+	public *net.UDPConn
+
+	mu      sync.Mutex
+	allowed map[string]bool         // remote public addresses the peer sent to
+	aliases map[string]*net.UDPConn // remote public address → inside alias
+}
+
+func newNATProxy(t *testing.T, inside ma.Multiaddr) *natProxy {
+	t.Helper()
+	addr, err := udxAddrKey(inside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insideAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &natProxy{
+		inside:  insideAddr,
+		public:  public,
+		allowed: make(map[string]bool),
+		aliases: make(map[string]*net.UDPConn),
+	}
+	t.Cleanup(func() { n.close() })
+	go n.readPublic()
+	return n
+}
+
+func (n *natProxy) readPublic() {
+	buf := make([]byte, 64<<10)
+	for {
+		size, from, err := n.public.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		alias, ok := n.aliases[from.String()]
+		allowed := n.allowed[from.String()]
+		n.mu.Unlock()
+		if ok && allowed {
+			alias.WriteToUDP(buf[:size], n.inside)
+		}
+	}
+}
+
+// alias returns the multiaddr the peer behind n dials to reach the peer
+// behind remote.
+func (n *natProxy) alias(t *testing.T, remote *natProxy) ma.Multiaddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotePublic := remote.public.LocalAddr().(*net.UDPAddr)
+	n.mu.Lock()
+	n.aliases[remotePublic.String()] = conn
+	n.mu.Unlock()
+
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			size, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.allowed[remotePublic.String()] = true
+			n.mu.Unlock()
+			n.public.WriteToUDP(buf[:size], remotePublic)
+		}
+	}()
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	maddr, err := toUDXMultiaddr(local.IP.String(), local.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return maddr
+}
+
+func (n *natProxy) close() {
+	n.public.Close()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.aliases {
+		c.Close()
+	}
+}
+
+// holePunchPeers sets up two transports listening behind NAT proxies.
+func holePunchPeers(t *testing.T) (client, server *Transport, clientLn, serverLn tpt.Listener, clientNAT, serverNAT *natProxy) {
+	t.Helper()
+	clientKey, _ := generateKey(t)
+	serverKey, _ := generateKey(t)
+
+	var err error
+	client, err = NewTransport(clientKey, createUpgrader(t, clientKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewTransport(serverKey, createUpgrader(t, serverKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	laddr := ma.StringCast("/ip4/127.0.0.1/udp/0/udx")
+	clientLn, err = client.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientLn.Close() })
+	serverLn, err = server.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverLn.Close() })
+
+	return client, server, clientLn, serverLn, newNATProxy(t, clientLn.Multiaddr()), newNATProxy(t, serverLn.Multiaddr())
+}
+
+func TestHolePunching(t *testing.T) {
+	client, server, clientLn, serverLn, clientNAT, serverNAT := holePunchPeers(t)
+	clientToServer := clientNAT.alias(t, serverNAT)
+	serverToClient := serverNAT.alias(t, clientNAT)
+
+	// Neither listener should see the hole-punched connection.
+	for _, ln := range []tpt.Listener{clientLn, serverLn} {
+		go func() {
+			if c, err := ln.Accept(); err == nil {
+				c.Close()
+				t.Error("didn't expect to accept any connections")
+			}
+		}()
+	}
+
+	type result struct {
+		conn tpt.CapableConn
+		err  error
+	}
+	serverRes := make(chan result, 1)
+	go func() {
+		c, err := server.Dial(
+			network.WithSimultaneousConnect(context.Background(), false, "hole-punching"),
+			serverToClient,
+			client.localPeer,
+		)
+		serverRes <- result{c, err}
+	}()
+
+	// Let the server side register its hole punch and open its NAT first,
+	// as the holepunch service's RTT-based synchronization does.
+	deadline := time.Now().Add(time.Second)
+	for {
+		server.holePunchingMx.Lock()
+		n := len(server.holePunching)
+		server.holePunchingMx.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server never started punching")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientConn, err := client.Dial(
+		network.WithSimultaneousConnect(ctx, true, "hole-punching"),
+		clientToServer,
+		server.localPeer,
+	)
+	if err != nil {
+		t.Fatal("client dial:", err)
+	}
+	defer clientConn.Close()
+	if clientConn.RemotePeer() != server.localPeer {
+		t.Fatal("client: remote peer mismatch")
+	}
+
+	res := <-serverRes
+	if res.err != nil {
+		t.Fatal("server hole punch:", res.err)
+	}
+	defer res.conn.Close()
+	if res.conn.RemotePeer() != client.localPeer {
+		t.Fatal("server: remote peer mismatch")
+	}
+}
+
+func TestDialBlockedByNAT(t *testing.T) {
+	client, server, _, _, clientNAT, serverNAT := holePunchPeers(t)
+	clientToServer := clientNAT.alias(t, serverNAT)
+
+	// Without the server punching, its NAT drops the client's packets.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	c, err := client.Dial(ctx, clientToServer, server.localPeer)
+	if err == nil {
+		c.Close()
+		t.Fatal("expected the dial to fail")
+	}
+}
+
+func TestHolePunchingTimeout(t *testing.T) {
+	client, server, _, _, clientNAT, serverNAT := holePunchPeers(t)
+	serverToClient := serverNAT.alias(t, clientNAT)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := server.Dial(network.WithSimultaneousConnect(ctx, false, "hole-punching"), serverToClient, client.localPeer)
+	if !errors.Is(err, ErrHolePunching) {
+		t.Fatalf("expected ErrHolePunching, got %v", err)
+	}
+	if len(server.holePunching) != 0 {
+		t.Fatal("hole punch should be unregistered")
+	}
+}
@@ -0,0 +1,51 @@
+package udxtransport
+
+import (
+	"errors"
+	"time"
+
+	udx "github.com/stephanfeb/go-udx"
+)
+
+const (
+	// defaultIdleTimeout closes connections nothing has arrived on for this
+	// long, as go-libp2p's QUIC transport does.
+	defaultIdleTimeout = 30 * time.Second
+	// defaultKeepAlive is below the 30 second UDP mapping timeout of common
+	// NATs, so an idle connection keeps its mapping.
+	defaultKeepAlive = 15 * time.Second
+)
+
+// idleConfigurer is implemented by udx.Connection when it handles idle
+// timeouts and keep-alives, for natively multiplexed and upgraded
+// connections alike. A zero duration disables either. Without it,
+// connections time out and send keep-alives as go-udx does on its own, and
+// the idle options are refused.
+type idleConfigurer interface {
+	SetIdleTimeout(d time.Duration)
+	SetKeepAlive(interval time.Duration)
+}
+
+// checkIdle derives the keep-alive interval from the idle timeout unless it
+// was given, and checks that go-udx can apply the idle options given.
+func (t *Transport) checkIdle() error {
+	if !t.keepAliveSet && t.idleTimeout > 0 {
+		t.keepAlive = min(defaultKeepAlive, t.idleTimeout/2)
+	}
+	if t.idleTimeout > 0 && t.keepAlive >= t.idleTimeout {
+		return errors.New("keep-alive interval must be shorter than the idle timeout")
+	}
+	if _, ok := any((*udx.Connection)(nil)).(idleConfigurer); !ok && (t.idleSet || t.keepAliveSet) {
+		return errors.New("go-udx doesn't support idle timeouts and keep-alives")
+	}
+	return nil
+}
+
+// configureIdle hands the idle timeout and keep-alive interval to c, a
+// udx.Connection, if go-udx takes them.
+func (t *Transport) configureIdle(c any) {
+	if ic, ok := c.(idleConfigurer); ok {
+		ic.SetIdleTimeout(t.idleTimeout)
+		ic.SetKeepAlive(t.keepAlive)
+	}
+}
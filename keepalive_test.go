@@ -0,0 +1,59 @@
+package udxtransport
+
+import (
+	"testing"
+	"time"
+
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// recordingIdle records the idle settings a transport hands go-udx.
+type recordingIdle struct {
+	idle, keepAlive time.Duration
+}
+
+func (r *recordingIdle) SetIdleTimeout(d time.Duration)      { r.idle = d }
+func (r *recordingIdle) SetKeepAlive(interval time.Duration) { r.keepAlive = interval }
+
+func TestKeepAlive(t *testing.T) {
+	if _, ok := any((*udx.Connection)(nil)).(idleConfigurer); !ok {
+		t.Skip("go-udx doesn't take idle settings")
+	}
+	for _, tc := range []struct {
+		opts            []Option
+		idle, keepAlive time.Duration
+	}{
+		{nil, defaultIdleTimeout, defaultKeepAlive},
+		{[]Option{WithIdleTimeout(10 * time.Second)}, 10 * time.Second, 5 * time.Second},
+		{[]Option{WithIdleTimeout(time.Minute)}, time.Minute, defaultKeepAlive},
+		{[]Option{WithIdleTimeout(0)}, 0, defaultKeepAlive},
+		{[]Option{WithIdleTimeout(time.Second), WithKeepAlive(0)}, time.Second, 0},
+		{[]Option{WithKeepAlive(20 * time.Second)}, defaultIdleTimeout, 20 * time.Second},
+	} {
+		var r recordingIdle
+		newTestTransport(t, nil, nil, tc.opts...).configureIdle(&r)
+		if r.idle != tc.idle || r.keepAlive != tc.keepAlive {
+			t.Errorf("idle timeout %s and keep-alive %s handed to go-udx, want %s and %s", r.idle, r.keepAlive, tc.idle, tc.keepAlive)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	if _, ok := any((*udx.Connection)(nil)).(idleConfigurer); !ok {
+		t.Skip("go-udx doesn't take idle settings")
+	}
+	for _, native := range []bool{true, false} {
+		opts := []Option{WithIdleTimeout(100 * time.Millisecond), WithKeepAlive(0)}
+		if !native {
+			opts = append(opts, DisableNativeMultiplexing())
+		}
+		_, _, dialed, accepted := connectedPeers(t, opts...)
+
+		start := time.Now()
+		waitClosed(t, accepted)
+		waitClosed(t, dialed)
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("native=%t: closed after %s, before the idle timeout", native, d)
+		}
+	}
+}
@@ -2,47 +2,191 @@ package udxtransport
 
 import (
 	"context"
+	"io"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	tpt "github.com/libp2p/go-libp2p/core/transport"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
 	udx "github.com/stephanfeb/go-udx"
 )
 
+const (
+	// acceptQueueLen is how many raw connections may wait for the
+	// upgrader, matching the upgrader's own accept queue.
+	acceptQueueLen = 16
+	// defaultStream0Timeout bounds how long an inbound connection may take
+	// to open stream 0 and send its first byte.
+	defaultStream0Timeout = 10 * time.Second
+	// defaultMaxHalfOpen caps the inbound connections a listener sets up at
+	// once.
+	defaultMaxHalfOpen = 128
+	// maxRefusing caps the refusals a listener sends at once.
+	maxRefusing = 16
+	// refusalTimeout bounds the work spent refusing a connection.
+	refusalTimeout = time.Second
+)
+
+// connMultiaddrs is what the connection gater sees of an inbound connection
+// in InterceptAccept.
+type connMultiaddrs struct {
+	local, remote ma.Multiaddr
+}
+
+func (c *connMultiaddrs) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c *connMultiaddrs) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+
+// listener is the tpt.Listener returned by Transport.Listen. Natively
+// multiplexed connections are delivered by the raw listener directly; the
+// rest come out of the upgrader's listener.
+type listener struct {
+	raw      *rawListener
+	upgraded tpt.Listener
+}
+
+var _ tpt.Listener = (*listener)(nil)
+
+// acceptUpgraded forwards connections from the upgrader's listener until it
+// fails, which happens once the raw listener is closed.
+func (l *listener) acceptUpgraded() {
+	for {
+		c, err := l.upgraded.Accept()
+		if err != nil {
+			l.raw.closeWithErr(err)
+			return
+		}
+		l.raw.finished(nil)
+		c = wrapUpgraded(c)
+		if uc, ok := c.(*upgradedConn); ok {
+			if !l.raw.transport.addConn(uc, l.raw) {
+				uc.Close()
+				continue
+			}
+			uc.raw.path.setPeer(c.RemotePeer())
+			uc.raw.trace.event(udxtrace.HandshakeCompleted, map[string]any{
+				"peer":     c.RemotePeer().String(),
+				"security": string(c.ConnState().Security),
+			})
+		}
+		if !l.raw.deliver(c) {
+			return
+		}
+	}
+}
+
+func (l *listener) Accept() (tpt.CapableConn, error) {
+	select {
+	case c := <-l.raw.conns:
+		return c, nil
+	case <-l.raw.closed:
+		return nil, l.raw.err
+	}
+}
+
+func (l *listener) Close() error {
+	l.raw.transport.removeListener(l)
+	return l.upgraded.Close()
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.raw.Addr()
+}
+
+func (l *listener) Multiaddr() ma.Multiaddr {
+	return l.raw.laddr
+}
+
 // rawListener wraps a udx.Multiplexer to implement transport.GatedMaListener.
 // It accepts raw UDX connections and prepares them for the upgrader pipeline,
-// which handles Noise + Yamux negotiation in parallel goroutines.
+// which handles Noise + Yamux negotiation in parallel goroutines. Connections
+// that offer native multiplexing are handshaken here instead.
+//
+// The connection gater and the resource manager are consulted on the first
+// packet of a new source, before UDX keeps any state for it, and answer a
+// source they reject with a refusal packet. Sources already admitted, such
+// as a peer reconnecting from the same address, are consulted once the UDX
+// handshake completes instead; connections they reject then are refused on
+// stream 0 without any further work. Each admitted connection is set up in its own
+// goroutine, so a peer that never opens stream 0 only holds up itself.
+// Connections count as half-open until they are queued for the upgrader or
+// have finished the native handshake; beyond maxHalfOpen, new ones are
+// refused.
 type rawListener struct {
-	mux       *udx.Multiplexer
+	mux       *udpMux
 	transport *Transport
 	laddr     ma.Multiaddr
+	ctx       context.Context // canceled on Close to stop the accept loop
+	cancel    context.CancelFunc
+
+	halfOpen     chan struct{} // semaphore of half-open connections
+	admissionsMu sync.Mutex
+	admissions   map[netip.AddrPort]*admission // sources the gate admitted, until UDX accepts them
+	prefixes     map[netip.Prefix]int          // admissions by admissionPrefix
+	refusing     chan struct{}                 // semaphore of refusals being sent
+	queue        chan rawAccepted              // raw connections waiting for the upgrader
+	conns        chan tpt.CapableConn          // ready connections, native or upgraded
+	closeOnce    sync.Once
+	releaseOnce  sync.Once
+	closed       chan struct{}
+	err          error // set before closed is closed
+}
+
+// rawAccepted is a connection ready for the upgrader.
+type rawAccepted struct {
+	conn  *streamConn
+	scope network.ConnManagementScope
 }
 
 var _ tpt.GatedMaListener = (*rawListener)(nil)
 
-// Accept drains the UDX multiplexer and returns raw (unsecured, non-muxed)
-// connections. The upgrader's handleIncoming goroutine calls this in a tight
-// loop and spawns a goroutine per connection for the Noise + Yamux upgrade.
+func (t *Transport) newRawListener(m *udpMux) *rawListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &rawListener{
+		mux:        m,
+		transport:  t,
+		laddr:      m.laddr,
+		ctx:        ctx,
+		cancel:     cancel,
+		halfOpen:   make(chan struct{}, t.maxHalfOpen),
+		admissions: make(map[netip.AddrPort]*admission),
+		prefixes:   make(map[netip.Prefix]int),
+		refusing:   make(chan struct{}, maxRefusing),
+		queue:      make(chan rawAccepted, acceptQueueLen),
+		conns:      make(chan tpt.CapableConn),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Accept returns raw (unsecured, non-muxed) connections. The upgrader's
+// handleIncoming goroutine calls this in a tight loop and spawns a goroutine
+// per connection for the Noise + Yamux upgrade.
 //
-// Per-connection errors (stream failures, resource limits) are retried.
-// Only multiplexer-level errors (closed) are fatal and returned to the caller.
+// Only multiplexer-level errors (closed) are returned; per-connection
+// failures are handled by the accept loop.
 func (l *rawListener) Accept() (manet.Conn, network.ConnManagementScope, error) {
-	for {
-		ctx := context.Background()
-
-		udxConn, err := l.mux.Accept(ctx)
-		if err != nil {
-			return nil, nil, err
-		}
+	select {
+	case a := <-l.queue:
+		return a.conn, a.scope, nil
+	case <-l.closed:
+		return nil, nil, l.err
+	}
+}
 
-		// Accept stream 0 from the dialer (the upgrade stream)
-		stream0, err := udxConn.AcceptStream(ctx)
+// acceptLoop drains the UDX multiplexer, setting up each connection
+// concurrently, until the multiplexer fails or the listener is closed.
+func (l *rawListener) acceptLoop() {
+	for {
+		udxConn, err := l.mux.mux.Accept(l.ctx)
 		if err != nil {
-			udxConn.Close()
-			continue
+			l.closeWithErr(err)
+			return
 		}
+		l.handshakeDone(udxConn)
 
 		// Build remote multiaddr from connection's remote address
 		var remoteMaddr ma.Multiaddr
@@ -50,30 +194,235 @@ func (l *rawListener) Accept() (manet.Conn, network.ConnManagementScope, error)
 			remoteMaddr, _ = toUDXMultiaddr(udpAddr.IP.String(), udpAddr.Port)
 		}
 
-		rawConn := &streamConn{
-			stream:      stream0,
-			connection:  udxConn,
-			localMaddr:  l.laddr,
-			remoteMaddr: remoteMaddr,
+		connScope, ok := l.admissionOf(udxConn.RemoteAddr())
+		if !ok {
+			connScope, ok = l.admit(remoteMaddr)
+		}
+		if !ok {
+			l.refuse(udxConn)
+			l.finished(ErrConnRefused)
+			continue
 		}
 
-		// Get a connection scope from the resource manager
-		connScope, err := l.transport.rcmgr.OpenConnection(network.DirInbound, false, remoteMaddr)
+		select {
+		case l.halfOpen <- struct{}{}:
+			go func() {
+				defer func() { <-l.halfOpen }()
+				l.setup(udxConn, remoteMaddr, connScope)
+			}()
+		default:
+			connScope.Done()
+			l.refuse(udxConn)
+			l.finished(ErrConnRefused)
+		}
+	}
+}
+
+// admit runs the connection gater and the resource manager on a new inbound
+// connection, or on the first packet of a new source for gate.
+func (l *rawListener) admit(remoteMaddr ma.Multiaddr) (network.ConnManagementScope, bool) {
+	if remoteMaddr == nil {
+		return nil, false
+	}
+	gater := l.transport.gater
+	if gater != nil && !gater.InterceptAccept(&connMultiaddrs{local: l.laddr, remote: remoteMaddr}) {
+		return nil, false
+	}
+	connScope, err := l.transport.rcmgr.OpenConnection(network.DirInbound, false, remoteMaddr)
+	if err != nil {
+		return nil, false
+	}
+	if err := connScope.ReserveMemory(connMemory, network.ReservationPriorityMedium); err != nil {
+		connScope.Done()
+		return nil, false
+	}
+	return connScope, true
+}
+
+// refuse tells the dialer of a connection that wasn't admitted why it is
+// being closed, by answering on stream 0 with refusalMsg. Refusals are
+// best-effort: if too many are in flight, the connection is just closed.
+func (l *rawListener) refuse(udxConn *udx.Connection) {
+	select {
+	case l.refusing <- struct{}{}:
+	default:
+		udxConn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-l.refusing }()
+		defer udxConn.Close()
+
+		ctx, cancel := l.transport.withTimeout(l.ctx, refusalTimeout)
+		defer cancel()
+		stream0, err := udxConn.AcceptStream(ctx)
 		if err != nil {
-			rawConn.Close()
-			continue
+			return
+		}
+		deadline, _ := ctx.Deadline()
+		stream0.SetWriteDeadline(deadline)
+		if _, err := stream0.Write(refusalMsg); err != nil {
+			return
+		}
+		stream0.Close()
+		// Give the dialer until the deadline to read the refusal and close
+		// the connection itself.
+		stream0.SetReadDeadline(deadline)
+		io.Copy(io.Discard, stream0)
+	}()
+}
+
+// setup waits for stream 0, routes the connection to the native handshake or
+// the upgrader queue, and gives up after the transport's stream-0 timeout.
+// connScope is released if the connection doesn't make it.
+func (l *rawListener) setup(udxConn *udx.Connection, remoteMaddr ma.Multiaddr, connScope network.ConnManagementScope) {
+	ctx, cancel := l.transport.withTimeout(l.ctx, l.transport.stream0Timeout)
+	defer cancel()
+	l.transport.configureIdle(udxConn)
+	l.transport.configureMTU(udxConn)
+	cc := l.transport.configureCongestion(udxConn)
+
+	// Accept stream 0 from the dialer (the upgrade stream)
+	stream0, err := udxConn.AcceptStream(ctx)
+	if err != nil {
+		udxConn.Close()
+		connScope.Done()
+		l.finished(err)
+		return
+	}
+
+	// Peek the first byte: the native preamble starts with a zero byte,
+	// multistream-select never does.
+	deadline, _ := ctx.Deadline()
+	stream0.SetReadDeadline(deadline)
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(stream0, first); err != nil {
+		udxConn.Close()
+		connScope.Done()
+		l.finished(err)
+		return
+	}
+	stream0.SetReadDeadline(time.Time{})
+
+	l.transport.acquireMux(l.mux)
+	if m := l.transport.metrics; m != nil {
+		m.ConnOpened(udxConn, l.laddr)
+	}
+	trace := newConnTrace(l.transport.traceDir, "server", l.transport.clock, udxConn, l.laddr, remoteMaddr)
+	rawConn := &streamConn{
+		stream:     stream0,
+		connection: udxConn,
+		transport:  l.transport,
+		mux:        l.mux,
+		trace:      trace,
+		path:       l.transport.newConnPath(udxConn, l.mux.demux, cc, l.laddr, remoteMaddr, trace),
+		localMaddr: l.laddr,
+		preread:    first,
+	}
+
+	if first[0] == nativePreamble[0] && l.transport.native {
+		l.acceptNative(rawConn, connScope)
+		return
+	}
+
+	rawConn.trace.event(udxtrace.HandshakeStarted, map[string]any{"upgrader": true})
+	select {
+	case l.queue <- rawAccepted{conn: rawConn, scope: connScope}:
+		// Close may have drained the queue before the connection got in.
+		if l.ctx.Err() != nil {
+			l.drainQueue()
 		}
+	case <-ctx.Done():
+		rawConn.Close()
+		connScope.Done()
+		l.finished(ctx.Err())
+	}
+}
+
+// acceptNative runs the native handshake for an inbound connection and
+// delivers the result to Accept.
+func (l *rawListener) acceptNative(hs *streamConn, connScope network.ConnManagementScope) {
+	ctx, cancel := l.transport.withTimeout(l.ctx, l.transport.handshakeTimeout)
+	defer cancel()
+
+	c, err := l.transport.handshakeNative(ctx, hs, network.DirInbound, "", connScope)
+	l.finished(err)
+	if err != nil {
+		connScope.Done()
+		return
+	}
+	if !l.transport.addConn(c, l) {
+		c.Close()
+		return
+	}
+	// The connection is no longer half-open; don't hold its slot while
+	// waiting for the application to accept it.
+	go l.deliver(c)
+}
 
-		return rawConn, connScope, nil
+// deliver hands c to Accept, closing it instead if the listener is closed.
+// Connections a hole punch is waiting for go to the hole punch instead.
+func (l *rawListener) deliver(c tpt.CapableConn) bool {
+	if l.transport.deliverHolePunch(c) {
+		return true
 	}
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		c.Close()
+		return false
+	}
+}
+
+// finished records the outcome of setting up an inbound connection. The
+// outcome of upgrading one is only known if it succeeds, in acceptUpgraded.
+func (l *rawListener) finished(err error) {
+	if m := l.transport.metrics; m != nil {
+		m.ConnFinished(network.DirInbound, err)
+	}
+}
+
+func (l *rawListener) closeWithErr(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.closed)
+	})
 }
 
+// Close stops accepting. The socket stays open until the connections
+// accepted on it, or dialed from it, are closed too.
 func (l *rawListener) Close() error {
-	return l.mux.Close()
+	l.closeWithErr(tpt.ErrListenerClosed)
+	l.releaseOnce.Do(func() {
+		l.mux.demux.setValidation(nil)
+		l.mux.demux.setGate(nil, nil)
+		l.transport.removeListenMux(l.mux)
+		l.cancel()
+		l.releaseAdmissions()
+		l.drainQueue()
+		l.transport.releaseMux(l.mux)
+	})
+	return nil
+}
+
+// drainQueue closes the connections the upgrader hasn't taken. They hold
+// their UDX connection, their scope and a reference to the socket, and
+// aren't tracked by the transport until upgraded.
+func (l *rawListener) drainQueue() {
+	for {
+		select {
+		case a := <-l.queue:
+			a.conn.Close()
+			a.scope.Done()
+		default:
+			return
+		}
+	}
 }
 
 func (l *rawListener) Addr() net.Addr {
-	return l.mux.Addr()
+	return l.mux.mux.Addr()
 }
 
 func (l *rawListener) Multiaddr() ma.Multiaddr {
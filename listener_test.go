@@ -0,0 +1,225 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// dialRawUDX opens a bare UDX connection to addr that never opens stream 0.
+func dialRawUDX(t *testing.T, addr ma.Multiaddr) *udx.Connection {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := udx.NewMultiplexer(conn, udx.RealClock{})
+	t.Cleanup(func() { mux.Close() })
+
+	key, err := udxAddrKey(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp4", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := mux.Dial(ctx, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestTransport creates a transport with a fresh identity.
+func newTestTransport(t *testing.T, gater connmgr.ConnectionGater, rcmgr network.ResourceManager, opts ...Option) *Transport {
+	t.Helper()
+	key, _ := generateKey(t)
+	if gater != nil {
+		opts = append(opts, WithConnectionGater(gater))
+	}
+	tr, err := NewTransport(key, createUpgrader(t, key), rcmgr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// listenForTest listens on tr and accepts connections in the background.
+func listenForTest(t *testing.T, tr *Transport) (tpt.Listener, peer.ID, <-chan tpt.CapableConn) {
+	t.Helper()
+	ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan tpt.CapableConn, 16)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	return ln, tr.localPeer, accepted
+}
+
+// dialForTest dials addr from a new transport built with opts.
+func dialForTest(t *testing.T, addr ma.Multiaddr, p peer.ID, timeout time.Duration, opts ...Option) (tpt.CapableConn, error) {
+	t.Helper()
+	tr := newTestTransport(t, nil, nil, opts...)
+	t.Cleanup(func() { tr.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := tr.Dial(ctx, addr, p)
+	if err == nil {
+		t.Cleanup(func() { c.Close() })
+	}
+	return c, err
+}
+
+func TestAcceptNotBlockedByStalledPeer(t *testing.T) {
+	ln, serverID, accepted := listenForTest(t, newTestTransport(t, nil, nil))
+
+	// A peer that completes the UDX handshake but never opens stream 0.
+	dialRawUDX(t, ln.Multiaddr())
+
+	if _, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second); err != nil {
+		t.Fatal("dial:", err)
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted behind a stalled peer")
+	}
+}
+
+func TestAcceptHalfOpenLimit(t *testing.T) {
+	ln, serverID, accepted := listenForTest(t, newTestTransport(t, nil, nil,
+		WithMaxHalfOpenConns(1),
+		WithStream0Timeout(300*time.Millisecond),
+	))
+
+	// The stalled connection takes the only half-open slot, so a dial
+	// right after it is dropped.
+	dialRawUDX(t, ln.Multiaddr())
+	if _, err := dialForTest(t, ln.Multiaddr(), serverID, 200*time.Millisecond); err == nil {
+		t.Fatal("expected the dial to fail while the listener is full")
+	}
+
+	// Once the stalled connection times out, the slot frees up.
+	time.Sleep(300 * time.Millisecond)
+	if _, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second); err != nil {
+		t.Fatal("dial:", err)
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted after the stalled peer timed out")
+	}
+}
+
+// acceptGater rejects every inbound connection in InterceptAccept.
+type acceptGater struct {
+	intercepted atomic.Int32
+	secured     atomic.Int32
+}
+
+func (g *acceptGater) InterceptPeerDial(peer.ID) bool               { return true }
+func (g *acceptGater) InterceptAddrDial(peer.ID, ma.Multiaddr) bool { return true }
+func (g *acceptGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+func (g *acceptGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	g.intercepted.Add(1)
+	return false
+}
+
+func (g *acceptGater) InterceptSecured(network.Direction, peer.ID, network.ConnMultiaddrs) bool {
+	g.secured.Add(1)
+	return true
+}
+
+// limitedResourceManager refuses every connection.
+type limitedResourceManager struct {
+	network.NullResourceManager
+}
+
+func (*limitedResourceManager) OpenConnection(network.Direction, bool, ma.Multiaddr) (network.ConnManagementScope, error) {
+	return nil, network.ErrResourceLimitExceeded
+}
+
+func TestAcceptGaterRefusal(t *testing.T) {
+	for _, native := range []bool{true, false} {
+		var opts []Option
+		if !native {
+			opts = append(opts, DisableNativeMultiplexing())
+		}
+		gater := &acceptGater{}
+		ln, serverID, _ := listenForTest(t, newTestTransport(t, gater, nil))
+
+		_, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second, opts...)
+		if !errors.Is(err, ErrConnRefused) {
+			t.Fatalf("native=%t: expected ErrConnRefused, got %v", native, err)
+		}
+		if gater.intercepted.Load() != 1 {
+			t.Fatalf("native=%t: InterceptAccept called %d times", native, gater.intercepted.Load())
+		}
+		if gater.secured.Load() != 0 {
+			t.Fatalf("native=%t: refused connection got to the handshake", native)
+		}
+	}
+}
+
+func TestAcceptGatedBeforeUDX(t *testing.T) {
+	gater := &acceptGater{}
+	ln, _, _ := listenForTest(t, newTestTransport(t, gater, nil))
+
+	// A bare UDX dialer sends no padding, so it isn't told about the
+	// refusal, but its handshake never reaches the listener's UDX.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := udx.NewMultiplexer(conn, udx.RealClock{})
+	defer mux.Close()
+	key, _ := udxAddrKey(ln.Multiaddr())
+	raddr, _ := net.ResolveUDPAddr("udp4", key)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := mux.Dial(ctx, raddr); err == nil {
+		t.Fatal("UDX handshake completed with a refused source")
+	}
+	if gater.intercepted.Load() == 0 {
+		t.Fatal("InterceptAccept wasn't called")
+	}
+}
+
+func TestAcceptResourceLimitRefusal(t *testing.T) {
+	ln, serverID, _ := listenForTest(t, newTestTransport(t, nil, &limitedResourceManager{}))
+
+	_, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second)
+	if !errors.Is(err, ErrConnRefused) {
+		t.Fatalf("expected ErrConnRefused, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/metricshelper"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+const metricNamespace = "libp2p_udx"
+
+var (
+	connsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "connections_total",
+			Help:      "Dials and inbound connections by outcome",
+		},
+		[]string{"dir", "outcome"},
+	)
+	handshakeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Name:      "handshake_duration_seconds",
+			Help:      "Duration of the security handshake",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+		[]string{"dir", "security"},
+	)
+	connsActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "connections_active",
+			Help:      "Open UDX connections",
+		},
+		[]string{"ip_version"},
+	)
+	bytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "bytes_total",
+			Help:      "Bytes sent and received on UDX streams",
+		},
+		[]string{"dir"},
+	)
+	amplificationPackets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "amplification_limited_packets_total",
+			Help:      "Packets to unvalidated sources dropped by the anti-amplification limit",
+		},
+	)
+	amplificationBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "amplification_limited_bytes_total",
+			Help:      "Bytes of packets to unvalidated sources dropped by the anti-amplification limit",
+		},
+	)
+
+	rttDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricNamespace, "", "rtt_seconds"),
+		"Smoothed RTT of the open UDX connections",
+		nil, nil,
+	)
+	packetsLostDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricNamespace, "", "packets_lost_total"),
+		"Packets declared lost by UDX loss recovery",
+		nil, nil,
+	)
+	packetsRetransmittedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricNamespace, "", "packets_retransmitted_total"),
+		"Packets retransmitted by UDX loss recovery",
+		nil, nil,
+	)
+
+	rttBuckets = prometheus.ExponentialBuckets(0.001, 2, 14)
+
+	links = &linkCollector{conns: make(map[*udx.Connection]struct{})}
+
+	collectors = []prometheus.Collector{
+		connsTotal,
+		handshakeDuration,
+		connsActive,
+		bytesTotal,
+		amplificationPackets,
+		amplificationBytes,
+		links,
+	}
+)
+
+// MetricsTracer tracks the transport's connections. Pass one to the
+// transport with WithMetricsTracer.
+type MetricsTracer interface {
+	// ConnFinished records the outcome of a dial, or of setting up an
+	// inbound connection; err is nil on success.
+	ConnFinished(dir network.Direction, err error)
+	// HandshakeFinished records the duration of a successful handshake.
+	HandshakeFinished(dir network.Direction, security protocol.ID, d time.Duration)
+	// ConnOpened and ConnClosed bracket the lifetime of a UDX connection.
+	ConnOpened(c *udx.Connection, laddr ma.Multiaddr)
+	ConnClosed(c *udx.Connection, laddr ma.Multiaddr)
+	// BytesSent and BytesReceived count bytes on UDX streams.
+	BytesSent(n int)
+	BytesReceived(n int)
+	// AmplificationLimited counts a packet of n bytes dropped because its
+	// destination isn't validated and has sent too little.
+	AmplificationLimited(n int)
+}
+
+// metricsTracer records to the package's collectors. The byte counters are
+// bound to their labels once, as they are counted on every stream frame.
+type metricsTracer struct {
+	bytesSent, bytesReceived prometheus.Counter
+}
+
+var _ MetricsTracer = &metricsTracer{}
+
+type metricsTracerSetting struct {
+	reg prometheus.Registerer
+}
+
+// MetricsTracerOption configures a MetricsTracer created by
+// NewMetricsTracer.
+type MetricsTracerOption func(*metricsTracerSetting)
+
+// WithRegisterer sets the registerer the tracer's metrics are registered
+// with. A nil reg keeps prometheus.DefaultRegisterer.
+func WithRegisterer(reg prometheus.Registerer) MetricsTracerOption {
+	return func(s *metricsTracerSetting) {
+		if reg != nil {
+			s.reg = reg
+		}
+	}
+}
+
+// NewMetricsTracer creates a MetricsTracer and registers its metrics,
+// with prometheus.DefaultRegisterer unless WithRegisterer says otherwise.
+func NewMetricsTracer(opts ...MetricsTracerOption) MetricsTracer {
+	setting := &metricsTracerSetting{reg: prometheus.DefaultRegisterer}
+	for _, opt := range opts {
+		opt(setting)
+	}
+	metricshelper.RegisterCollectors(setting.reg, collectors...)
+	return &metricsTracer{
+		bytesSent:     bytesTotal.WithLabelValues("sent"),
+		bytesReceived: bytesTotal.WithLabelValues("received"),
+	}
+}
+
+func (mt *metricsTracer) ConnFinished(dir network.Direction, err error) {
+	connsTotal.WithLabelValues(metricshelper.GetDirection(dir), connOutcome(err)).Inc()
+}
+
+func (mt *metricsTracer) HandshakeFinished(dir network.Direction, security protocol.ID, d time.Duration) {
+	handshakeDuration.WithLabelValues(metricshelper.GetDirection(dir), string(security)).Observe(d.Seconds())
+}
+
+func (mt *metricsTracer) ConnOpened(c *udx.Connection, laddr ma.Multiaddr) {
+	connsActive.WithLabelValues(metricshelper.GetIPVersion(laddr)).Inc()
+	links.add(c)
+}
+
+func (mt *metricsTracer) ConnClosed(c *udx.Connection, laddr ma.Multiaddr) {
+	connsActive.WithLabelValues(metricshelper.GetIPVersion(laddr)).Dec()
+	links.remove(c)
+}
+
+func (mt *metricsTracer) BytesSent(n int) {
+	mt.bytesSent.Add(float64(n))
+}
+
+func (mt *metricsTracer) BytesReceived(n int) {
+	mt.bytesReceived.Add(float64(n))
+}
+
+func (mt *metricsTracer) AmplificationLimited(n int) {
+	amplificationPackets.Inc()
+	amplificationBytes.Add(float64(n))
+}
+
+// linkCollector reports RTT and loss of the open connections when scraped,
+// adding the totals of closed connections to keep the counters monotonic.
+type linkCollector struct {
+	mu                sync.Mutex
+	conns             map[*udx.Connection]struct{}
+	closedLost        uint64
+	closedRetransmits uint64
+}
+
+var _ prometheus.Collector = &linkCollector{}
+
+func (lc *linkCollector) add(c *udx.Connection) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.conns[c] = struct{}{}
+}
+
+func (lc *linkCollector) remove(c *udx.Connection) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if _, ok := lc.conns[c]; !ok {
+		return
+	}
+	delete(lc.conns, c)
+	if s, ok := linkStatsOf(c); ok {
+		lc.closedLost += s.PacketsLost
+		lc.closedRetransmits += s.PacketsRetransmitted
+	}
+}
+
+func (lc *linkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rttDesc
+	ch <- packetsLostDesc
+	ch <- packetsRetransmittedDesc
+}
+
+func (lc *linkCollector) Collect(ch chan<- prometheus.Metric) {
+	lc.mu.Lock()
+	lost, retransmits := lc.closedLost, lc.closedRetransmits
+	var (
+		count   uint64
+		sum     float64
+		buckets = make(map[float64]uint64, len(rttBuckets))
+	)
+	for c := range lc.conns {
+		s, ok := linkStatsOf(c)
+		if !ok {
+			continue
+		}
+		lost += s.PacketsLost
+		retransmits += s.PacketsRetransmitted
+
+		rtt := s.SmoothedRTT.Seconds()
+		count++
+		sum += rtt
+		for _, b := range rttBuckets {
+			if rtt <= b {
+				buckets[b]++
+			}
+		}
+	}
+	lc.mu.Unlock()
+
+	ch <- prometheus.MustNewConstHistogram(rttDesc, count, sum, buckets)
+	ch <- prometheus.MustNewConstMetric(packetsLostDesc, prometheus.CounterValue, float64(lost))
+	ch <- prometheus.MustNewConstMetric(packetsRetransmittedDesc, prometheus.CounterValue, float64(retransmits))
+}
+
+// connOutcome classifies the error a dial or an inbound connection failed
+// with.
+func connOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrConnRefused):
+		return "refused"
+	case errors.Is(err, network.ErrResourceLimitExceeded):
+		return "resource_limit"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
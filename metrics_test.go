@@ -0,0 +1,88 @@
+package udxtransport
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	mt := NewMetricsTracer(WithRegisterer(reg))
+
+	// The collectors are shared by all tracers, so compare against the
+	// values before the test.
+	success := func(dir string) float64 {
+		return testutil.ToFloat64(connsTotal.WithLabelValues(dir, "success"))
+	}
+	outbound, inbound := success("outbound"), success("inbound")
+	sent := testutil.ToFloat64(bytesTotal.WithLabelValues("sent"))
+	active := testutil.ToFloat64(connsActive.WithLabelValues("ip4"))
+
+	ln, serverID, accepted := listenForTest(t, newTestTransport(t, nil, nil, WithMetricsTracer(mt)))
+	c, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second, WithMetricsTracer(mt))
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	var sc tpt.CapableConn
+	select {
+	case a := <-accepted:
+		sc = a
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+
+	str, err := c.OpenStream(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	str.Close()
+
+	if got := success("outbound") - outbound; got != 1 {
+		t.Errorf("outbound successes: got %v, want 1", got)
+	}
+	if got := success("inbound") - inbound; got != 1 {
+		t.Errorf("inbound successes: got %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(connsActive.WithLabelValues("ip4")) - active; got != 2 {
+		t.Errorf("active connections: got %v, want 2", got)
+	}
+	if testutil.ToFloat64(bytesTotal.WithLabelValues("sent")) <= sent {
+		t.Error("sent bytes weren't counted")
+	}
+	if n, err := testutil.GatherAndCount(reg, "libp2p_udx_rtt_seconds", "libp2p_udx_handshake_duration_seconds"); err != nil || n == 0 {
+		t.Errorf("expected RTT and handshake metrics, got %d (%v)", n, err)
+	}
+
+	c.Close()
+	sc.Close()
+	if got := testutil.ToFloat64(connsActive.WithLabelValues("ip4")) - active; got != 0 {
+		t.Errorf("active connections after close: got %v, want 0", got)
+	}
+}
+
+func TestConnOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "success"},
+		{ErrConnRefused, "refused"},
+		{network.ErrResourceLimitExceeded, "resource_limit"},
+		{errors.Join(io.EOF, ErrConnRefused), "refused"},
+		{io.EOF, "error"},
+	} {
+		if got := connOutcome(tc.err); got != tc.want {
+			t.Errorf("connOutcome(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
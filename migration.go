@@ -0,0 +1,242 @@
+package udxtransport
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// pathHooker is implemented by udx.Connection when it reports the migrations
+// of established connections: once a packet of the connection arrives from a
+// new address and the path to it is validated, the hook is called with that
+// address. Without it, connections still follow what go-udx does about
+// migrations, but the transport doesn't learn of them: RemoteMultiaddr keeps
+// the old address, no EvtConnMigrated is emitted, and packets to the new
+// address aren't paced.
+type pathHooker interface {
+	SetPathHook(hook func(raddr net.Addr))
+}
+
+// EvtConnMigrated is emitted on the bus given with WithEventBus when a
+// connection moves to a new remote address. The connection itself carries
+// on: streams are unaffected and its RemoteMultiaddr reports NewRemote.
+type EvtConnMigrated struct {
+	Peer      peer.ID
+	Local     ma.Multiaddr
+	OldRemote ma.Multiaddr
+	NewRemote ma.Multiaddr
+}
+
+// connPath is the current remote address of a UDX connection, shared by its
+// stream 0 and the natively multiplexed connection built on it.
+type connPath struct {
+	transport *Transport
+	udxConn   *udx.Connection
+	demux     *packetDemux        // of the connection's socket
+	cc        *measuredController // the connection's congestion controller; nil if go-udx runs its own
+	pacer     *pacer              // nil if the connection isn't paced
+	local     ma.Multiaddr
+	trace     *connTrace
+	changed   chan struct{} // signaled on every migration
+
+	mu     sync.Mutex
+	remote ma.Multiaddr
+	addr   netip.AddrPort // remote, unless it isn't a UDP address
+	peer   peer.ID        // empty until the handshake is done
+	speaks bool           // the remote takes the transport's packets
+	closed bool
+}
+
+// newConnPath starts following the migrations of udxConn and pacing the
+// packets UDX sends on it at the rate of cc, its congestion controller, if
+// there is one.
+func (t *Transport) newConnPath(udxConn *udx.Connection, demux *packetDemux, cc *measuredController, local, remote ma.Multiaddr, trace *connTrace) *connPath {
+	p := &connPath{
+		transport: t,
+		udxConn:   udxConn,
+		demux:     demux,
+		cc:        cc,
+		local:     local,
+		trace:     trace,
+		changed:   make(chan struct{}, 1),
+		remote:    remote,
+	}
+	if ap, ok := addrPortOf(udxConn.RemoteAddr()); ok {
+		p.addr = ap
+		demux.addRemote(ap)
+		if demux.announced(ap) {
+			p.speaks = true
+			demux.addSpeaker(ap.Addr())
+		}
+		if t.pacing && cc != nil {
+			p.pacer = demux.pace(ap, cc.pacingRate)
+		}
+	}
+	if ph, ok := any(udxConn).(pathHooker); ok {
+		ph.SetPathHook(p.migrated)
+	}
+	return p
+}
+
+func (p *connPath) remoteMultiaddr() ma.Multiaddr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remote
+}
+
+// setPeer records the authenticated remote peer. Migrations are only
+// announced on the event bus from then on; earlier ones are still traced.
+func (p *connPath) setPeer(id peer.ID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peer = id
+}
+
+// negotiated records that the remote takes the transport's packets, as it
+// completed the native handshake. A connection accepted from a source that
+// padded is recorded so from the start. The socket sends retries to new
+// addresses at the remote's IP address from then on (see speaks).
+func (p *connPath) negotiated() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.speaks || !p.addr.IsValid() {
+		return
+	}
+	p.speaks = true
+	p.demux.addSpeaker(p.addr.Addr())
+}
+
+func (p *connPath) migrated(raddr net.Addr) {
+	udpAddr, ok := raddr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	newRemote, err := toUDXMultiaddr(udpAddr.IP.String(), udpAddr.Port)
+	if err != nil {
+		return
+	}
+
+	ap, ok := addrPortOf(raddr)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	oldRemote := p.remote
+	if p.closed || oldRemote.Equal(newRemote) {
+		p.mu.Unlock()
+		return
+	}
+	p.remote = newRemote
+	p.demux.moveRemote(p.addr, ap)
+	if p.speaks {
+		p.demux.removeSpeaker(p.addr.Addr())
+		p.demux.addSpeaker(ap.Addr())
+	}
+	p.addr = ap
+	id := p.peer
+	p.mu.Unlock()
+
+	// UDX validated the new path, so the anti-amplification limit is off,
+	// and the address needs no admission of its own.
+	p.demux.admitPath(ap)
+	if p.pacer != nil {
+		p.demux.movePacer(p.pacer, ap)
+	}
+
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+	p.trace.event(udxtrace.PathMigrated, map[string]any{
+		"old": oldRemote.String(),
+		"new": newRemote.String(),
+	})
+	if em := p.transport.migrations; em != nil && id != "" {
+		em.Emit(EvtConnMigrated{
+			Peer:      id,
+			Local:     p.local,
+			OldRemote: oldRemote,
+			NewRemote: newRemote,
+		})
+	}
+}
+
+// close stops following migrations and pacing.
+func (p *connPath) close() {
+	if ph, ok := any(p.udxConn).(pathHooker); ok {
+		ph.SetPathHook(nil)
+	}
+	p.mu.Lock()
+	closed := p.closed
+	if !closed {
+		p.closed = true
+		p.demux.removeRemote(p.addr)
+		if p.speaks {
+			p.demux.removeSpeaker(p.addr.Addr())
+		}
+	}
+	p.mu.Unlock()
+	if closed {
+		return
+	}
+	if p.pacer != nil {
+		p.demux.unpace(p.pacer)
+	}
+}
+
+// addRemote records an established connection to ap, whose retries the
+// socket answers (see answerRetry).
+func (d *packetDemux) addRemote(ap netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remotes[ap]++
+}
+
+// removeRemote forgets a connection to ap that closed. The zero AddrPort is
+// never recorded.
+func (d *packetDemux) removeRemote(ap netip.AddrPort) {
+	if !ap.IsValid() {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.remotes[ap]--; d.remotes[ap] <= 0 {
+		delete(d.remotes, ap)
+	}
+}
+
+// moveRemote records that a connection to from migrated to to.
+func (d *packetDemux) moveRemote(from, to netip.AddrPort) {
+	d.removeRemote(from)
+	d.addRemote(to)
+}
+
+// connected reports whether a connection to ap is established on the socket.
+func (d *packetDemux) connected(ap netip.AddrPort) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.remotes[ap] > 0
+}
+
+// addSpeaker records a connection to ip that negotiated the transport's
+// packets.
+func (d *packetDemux) addSpeaker(ip netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.speakers[ip]++
+}
+
+// removeSpeaker forgets a connection recorded by addSpeaker.
+func (d *packetDemux) removeSpeaker(ip netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.speakers[ip]--; d.speakers[ip] <= 0 {
+		delete(d.speakers, ip)
+	}
+}
@@ -0,0 +1,253 @@
+package udxtransport
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/network"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// rebindingProxy forwards UDP between a client and a target like a NAT,
+// from an outside port that rebind changes.
+type rebindingProxy struct {
+	public *net.UDPConn
+	target *net.UDPAddr
+
+	mu      sync.Mutex
+	client  *net.UDPAddr
+	outside *net.UDPConn
+	closed  bool
+}
+
+func newRebindingProxy(t *testing.T, target ma.Multiaddr) *rebindingProxy {
+	t.Helper()
+	key, err := udxAddrKey(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp4", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &rebindingProxy{public: public, target: targetAddr}
+	t.Cleanup(p.close)
+	p.rebind(t)
+	go p.readPublic()
+	return p
+}
+
+// addr is the multiaddr the client dials.
+func (p *rebindingProxy) addr() ma.Multiaddr {
+	a := p.public.LocalAddr().(*net.UDPAddr)
+	m, _ := toUDXMultiaddr(a.IP.String(), a.Port)
+	return m
+}
+
+// outsideAddr is the address the target sees packets from.
+func (p *rebindingProxy) outsideAddr() ma.Multiaddr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := p.outside.LocalAddr().(*net.UDPAddr)
+	m, _ := toUDXMultiaddr(a.IP.String(), a.Port)
+	return m
+}
+
+// rebind moves the client's traffic to a new outside port. The old one
+// stops forwarding, as if the NAT mapping had expired.
+func (p *rebindingProxy) rebind(t *testing.T) {
+	t.Helper()
+	outside, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	if p.outside != nil {
+		p.outside.Close()
+	}
+	p.outside = outside
+	p.mu.Unlock()
+	go p.readOutside(outside)
+}
+
+func (p *rebindingProxy) readPublic() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := p.public.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.client = from
+		outside := p.outside
+		p.mu.Unlock()
+		outside.WriteToUDP(buf[:n], p.target)
+	}
+}
+
+func (p *rebindingProxy) readOutside(outside *net.UDPConn) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := outside.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		client := p.client
+		p.mu.Unlock()
+		if client != nil {
+			p.public.WriteToUDP(buf[:n], client)
+		}
+	}
+}
+
+func (p *rebindingProxy) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.public.Close()
+	p.outside.Close()
+}
+
+// firstAcceptGater admits the first inbound connection and refuses every
+// other.
+type firstAcceptGater struct {
+	acceptGater
+}
+
+func (g *firstAcceptGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return g.intercepted.Add(1) == 1
+}
+
+func TestMigration(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		validation AddressValidation
+		refuse     bool // the gater refuses the new address
+		// An upgraded connection whose dialer didn't pad doesn't show it
+		// takes retries, so a new address the gater refuses is dropped.
+		nativeOnly bool
+	}{
+		{name: "default"},
+		{name: "validating", validation: ValidateAlways, refuse: true},
+		{name: "refusing", refuse: true, nativeOnly: true},
+	} {
+		for _, native := range []bool{true, false} {
+			if tc.nativeOnly && !native {
+				continue
+			}
+			name := tc.name + "/upgraded"
+			if native {
+				name = tc.name + "/native"
+			}
+			t.Run(name, func(t *testing.T) {
+				var opts []Option
+				if !native {
+					opts = append(opts, DisableNativeMultiplexing())
+				}
+				var gater connmgr.ConnectionGater
+				if tc.refuse {
+					gater = &firstAcceptGater{}
+				}
+				testMigration(t, gater, append(opts, WithAddressValidation(tc.validation)), opts)
+			})
+		}
+	}
+}
+
+// testMigration rebinds the client of a connection to a listener built with
+// gater and serverOpts, which the client, built with clientOpts, dials
+// through a rebindingProxy.
+func testMigration(t *testing.T, gater connmgr.ConnectionGater, serverOpts, clientOpts []Option) {
+	bus := eventbus.NewBus()
+	sub, err := bus.Subscribe(new(EvtConnMigrated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	rcmgr := &inboundResourceManager{}
+	server := newTestTransport(t, gater, rcmgr, append(serverOpts, WithEventBus(bus))...)
+	ln, serverID, accepted := listenForTest(t, server)
+	proxy := newRebindingProxy(t, ln.Multiaddr())
+	dialed, err := dialForTest(t, proxy.addr(), serverID, 5*time.Second, clientOpts...)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	var c tpt.CapableConn
+	select {
+	case c = <-accepted:
+		defer c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+
+	oldAddr := proxy.outsideAddr()
+	if !c.RemoteMultiaddr().Equal(oldAddr) {
+		t.Fatalf("remote address %s, want %s", c.RemoteMultiaddr(), oldAddr)
+	}
+
+	proxy.rebind(t)
+	newAddr := proxy.outsideAddr()
+	// The next packet from the client arrives from the new address
+	go func() {
+		str, err := dialed.OpenStream(t.Context())
+		if err == nil {
+			str.Write([]byte("after rebinding"))
+		}
+	}()
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtConnMigrated)
+		if evt.Peer != dialed.LocalPeer() {
+			t.Errorf("event for peer %s, want %s", evt.Peer, dialed.LocalPeer())
+		}
+		if !evt.OldRemote.Equal(oldAddr) || !evt.NewRemote.Equal(newAddr) {
+			t.Errorf("migrated from %s to %s, want %s to %s", evt.OldRemote, evt.NewRemote, oldAddr, newAddr)
+		}
+		if !evt.Local.Equal(ln.Multiaddr()) {
+			t.Errorf("event local address %s, want %s", evt.Local, ln.Multiaddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no migration event")
+	}
+	if !c.RemoteMultiaddr().Equal(newAddr) {
+		t.Errorf("remote address %s after migrating, want %s", c.RemoteMultiaddr(), newAddr)
+	}
+
+	// The connection carries on over the new path.
+	str, err := c.AcceptStream()
+	if err != nil {
+		t.Fatal("accept stream:", err)
+	}
+	buf := make([]byte, len("after rebinding"))
+	str.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(str, buf); err != nil || string(buf) != "after rebinding" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+
+	// The new address holds no admission of its own.
+	var open int
+	for _, s := range rcmgr.scopes() {
+		if _, _, done := s.state(); !done {
+			open++
+		}
+	}
+	if open != 1 {
+		t.Errorf("%d inbound scopes open after migrating, want the connection's", open)
+	}
+}
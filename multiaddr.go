@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	ma "github.com/multiformats/go-multiaddr"
+	mafmt "github.com/multiformats/go-multiaddr-fmt"
 )
 
 // P_UDX is the multiaddr protocol code for UDX.
@@ -23,17 +24,32 @@ func init() {
 	}
 }
 
-// isUDXMultiaddr returns true if the multiaddr contains a /udx component.
-func isUDXMultiaddr(addr ma.Multiaddr) bool {
-	found := false
-	ma.ForEach(addr, func(c ma.Component) bool {
-		if c.Protocol().Code == P_UDX {
-			found = true
-			return false
-		}
+// dialMatcher matches the addresses the transport can dial: an IP address
+// or DNS name, a UDP port and /udx, optionally followed by the peer ID.
+// Anything else, relay circuit addresses included, is left to other
+// transports.
+var dialMatcher = mafmt.Or(
+	mafmt.And(udxAddr, mafmt.Base(ma.P_P2P)),
+	udxAddr,
+)
+
+var udxAddr = mafmt.And(
+	mafmt.Or(mafmt.IP, mafmt.Base(ma.P_DNS), mafmt.DNS4, mafmt.DNS6),
+	mafmt.Base(ma.P_UDP),
+	mafmt.Base(P_UDX),
+)
+
+// isDNSMultiaddr returns true if the multiaddr starts with a /dns, /dns4 or
+// /dns6 component.
+func isDNSMultiaddr(addr ma.Multiaddr) bool {
+	if len(addr) == 0 {
+		return false
+	}
+	switch addr[0].Protocol().Code {
+	case ma.P_DNS, ma.P_DNS4, ma.P_DNS6:
 		return true
-	})
-	return found
+	}
+	return false
 }
 
 // fromUDXMultiaddr extracts host and port from a /ip4/<host>/udp/<port>/udx multiaddr.
@@ -0,0 +1,293 @@
+package udxtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
+)
+
+// nativeProtocolID identifies native stream multiplexing, where every libp2p
+// stream is its own UDX stream instead of a Yamux stream on stream 0.
+const nativeProtocolID protocol.ID = "/libp2p-udx/native/1.0.0"
+
+// nativePreamble is the first thing a dialer writes on stream 0 to offer
+// native multiplexing, and what a listener writes back to accept it. The
+// leading zero byte can never start a multistream-select message, so a
+// listener tells the two paths apart by peeking a single byte.
+var nativePreamble = []byte("\x00" + string(nativeProtocolID) + "\n")
+
+// resumePreamble takes the place of the native preamble in a handshake
+// resuming with a session ticket. It is just as long.
+var resumePreamble = []byte("\x00/libp2p-udx/resume/1.0.0\n")
+
+// refusalMsg is what a listener writes on stream 0 instead of a response when
+// it doesn't admit a connection. Like the native preamble it starts with a
+// zero byte, which no multistream-select message does.
+var refusalMsg = []byte("\x00/libp2p-udx/refused\n")
+
+// ErrConnRefused is returned by Dial when the listener refused the
+// connection, because of its connection gater or resource limits.
+var ErrConnRefused = errors.New("connection refused by listener")
+
+// sessionSecretLen is the size of the secret the handshake yields, from
+// which the native stream keys are derived.
+const sessionSecretLen = 32
+
+// defaultHandshakeTimeout bounds a listener's native handshake unless
+// WithHandshakeTimeout says otherwise.
+const defaultHandshakeTimeout = 15 * time.Second
+
+// legacyPeerTTL is how long a peer that didn't acknowledge the native
+// preamble is dialed straight through the upgrader.
+const legacyPeerTTL = time.Hour
+
+// paddingDelay is how long a dial to a peer the transport doesn't know waits
+// for UDX's handshake before it pads (see dialPadding).
+const paddingDelay = time.Second
+
+// errLegacyPeer is returned by the native handshake when the listener only
+// speaks the upgrader path.
+var errLegacyPeer = errors.New("peer does not support native multiplexing")
+
+// multistreamHeader is the first message of a multistream-select
+// negotiation, which a listener on the upgrader path sends right away.
+var multistreamHeader = []byte("\x13/multistream/1.0.0\n")
+
+// readPreamble reads and checks the other side's native or resume preamble,
+// reporting which it is. It returns ErrConnRefused if the listener refused
+// the connection instead, and errLegacyPeer if it started multistream-select.
+// Any other failure, such as a reset or truncated stream, is returned as is.
+func readPreamble(r io.Reader) (resume bool, err error) {
+	preamble := make([]byte, len(nativePreamble))
+	n, err := io.ReadFull(r, preamble)
+	if bytes.Equal(preamble[:n], refusalMsg) {
+		return false, ErrConnRefused
+	}
+	if bytes.HasPrefix(preamble[:n], multistreamHeader) {
+		return false, errLegacyPeer
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case bytes.Equal(preamble, nativePreamble):
+		return false, nil
+	case bytes.Equal(preamble, resumePreamble):
+		return true, nil
+	}
+	return false, fmt.Errorf("unexpected preamble %q", preamble)
+}
+
+// handshakeNative runs the built-in handshake on stream 0 and builds the
+// natively multiplexed connection. For inbound connections the dialer's
+// preamble is still unread in hs. On failure the UDX connection is closed;
+// the caller releases connScope.
+func (t *Transport) handshakeNative(ctx context.Context, hs *streamConn, dir network.Direction, p peer.ID, connScope network.ConnManagementScope) (_ *conn, err error) {
+	hs.trace.event(udxtrace.HandshakeStarted, nil)
+	defer func() {
+		if err != nil {
+			hs.trace.event(udxtrace.HandshakeFailed, map[string]any{"error": err.Error()})
+			hs.Close()
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		hs.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { hs.SetDeadline(t.clock.Now()) })
+	defer stop()
+
+	start := t.clock.Now()
+	var res *handshakeResult
+	var resuming *resumingHandshake // set if the dialer sends early data before the listener answers
+	if dir == network.DirOutbound {
+		res, resuming, err = t.dialHandshake(hs, p)
+	} else {
+		var tickets ticketOpener
+		if t.resumption {
+			tickets = t
+		}
+		res, err = handshakeInbound(hs, t.privKey, tickets)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errLegacyPeer) || errors.Is(err, ErrConnRefused) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	hs.SetDeadline(time.Time{})
+	hs.path.setPeer(res.remotePeer)
+	hs.path.negotiated()
+	t.markNative(res.remotePeer)
+	completed := map[string]any{
+		"peer":     res.remotePeer.String(),
+		"security": string(handshakeSecurityID),
+	}
+	if res.resumed {
+		completed["resumed"] = true
+	}
+	if resuming != nil {
+		completed["early_data"] = true
+	}
+	hs.trace.event(udxtrace.HandshakeCompleted, completed)
+	if t.metrics != nil {
+		t.metrics.HandshakeFinished(dir, handshakeSecurityID, t.clock.Now().Sub(start))
+	}
+
+	if t.gater != nil && !t.gater.InterceptSecured(dir, res.remotePeer, hs) {
+		return nil, fmt.Errorf("secured connection gated")
+	}
+	// Outbound scopes are attached to the expected peer before dialing
+	if connScope.PeerScope() == nil {
+		if err := connScope.SetPeer(res.remotePeer); err != nil {
+			return nil, fmt.Errorf("resource manager: %w", err)
+		}
+	}
+
+	keys, err := newSessionKeys(res, dir == network.DirOutbound)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{
+		udxConn:        hs.connection,
+		control:        &stream{str: hs.stream},
+		transport:      t,
+		mux:            hs.mux,
+		trace:          hs.trace,
+		scope:          connScope,
+		keys:           keys,
+		isDialer:       dir == network.DirOutbound,
+		localPeer:      t.localPeer,
+		localMultiaddr: hs.localMaddr,
+		remotePeerID:   res.remotePeer,
+		remotePubKey:   res.remotePub,
+		path:           hs.path,
+		done:           make(chan struct{}),
+	}
+	c.control.conn = c
+	c.initStreamIDs()
+	c.mtu.Store(int64(t.initialMTU))
+	c.registerPackets()
+	if !c.isDialer && t.resumption {
+		c.issueTicket()
+	}
+	if hs.mux.probing && t.maxMTU > t.minMTU {
+		c.probeAcks = make(chan int, 1)
+		go c.discoverMTU()
+	}
+	if resuming != nil {
+		go c.finishResumption(hs, resuming)
+	} else {
+		go c.readControl()
+	}
+	return c, nil
+}
+
+// dialHandshake runs the dialer's side of the handshake, resuming with a
+// session ticket from p if there is one. With early data on, a resumption
+// returns as soon as it is sent, along with the handshake to finish.
+func (t *Transport) dialHandshake(rw io.ReadWriter, p peer.ID) (*handshakeResult, *resumingHandshake, error) {
+	ticket, ok := t.takeTicket(p)
+	if !ok {
+		res, err := handshakeOutbound(rw, t.privKey, p)
+		return res, nil, err
+	}
+	r, err := startResumption(rw, t.privKey, ticket, t.earlyData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.earlyData {
+		res, err := r.early()
+		return res, r, err
+	}
+	res, err := r.finish(rw, p)
+	return res, nil, err
+}
+
+// finishResumption reads the listener's answer to a resumption the dialer
+// sent early data with, and keys the listener's direction. The connection
+// closes if the listener didn't resume.
+func (c *conn) finishResumption(hs *streamConn, r *resumingHandshake) {
+	hs.SetReadDeadline(c.transport.clock.Now().Add(c.transport.handshakeTimeout))
+	res, err := r.finish(hs, c.remotePeerID)
+	if err == nil {
+		err = c.keys.setRemote(res.secret)
+	}
+	if err != nil {
+		c.trace.event(udxtrace.HandshakeFailed, map[string]any{"error": err.Error()})
+		c.Close()
+		return
+	}
+	hs.SetReadDeadline(time.Time{})
+	c.readControl()
+}
+
+// dialsNative reports whether a dial to p should offer native multiplexing.
+func (t *Transport) dialsNative(p peer.ID) bool {
+	if !t.native {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	at, ok := t.legacyPeers[p]
+	if ok && t.clock.Now().Sub(at) > legacyPeerTTL {
+		delete(t.legacyPeers, p)
+		ok = false
+	}
+	return !ok
+}
+
+// markLegacy remembers that p only speaks the upgrader path.
+func (t *Transport) markLegacy(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.legacyPeers[p] = t.clock.Now()
+	delete(t.nativePeers, p)
+}
+
+// markNative remembers that p completed the native handshake, so it takes
+// the transport's own packets.
+func (t *Transport) markNative(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nativePeers[p] = t.clock.Now()
+	delete(t.legacyPeers, p)
+}
+
+// dialPadding says whether a dial to p pads ahead of UDX's handshake, and
+// after how long. Padding is a packet of this transport's, which a peer on
+// stock go-udx or dart-libp2p would receive as junk. A peer that completed
+// the native handshake is padded right away, and a peer that only speaks
+// the upgrader path never. A peer the transport doesn't know is padded only
+// if UDX's handshake hasn't completed after paddingDelay: a listener that
+// doesn't take the padding has answered by then, while one validating or
+// gating its sources waits for the padding before it answers.
+func (t *Transport) dialPadding(p peer.ID) (delay time.Duration, pad bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	if at, ok := t.nativePeers[p]; ok {
+		if now.Sub(at) <= legacyPeerTTL {
+			return 0, true
+		}
+		delete(t.nativePeers, p)
+	}
+	if at, ok := t.legacyPeers[p]; ok && now.Sub(at) <= legacyPeerTTL {
+		return 0, false
+	}
+	return paddingDelay, true
+}
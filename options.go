@@ -0,0 +1,314 @@
+package udxtransport
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/event"
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+// Option configures a Transport. Options are passed to NewTransport, or as
+// extra arguments to libp2p.Transport(NewTransport, opts...).
+type Option func(*Transport) error
+
+// DisableReuseport makes the transport dial from its own ephemeral-port
+// sockets instead of from its listeners' sockets. Outbound connections then
+// originate from a different port than the one the node advertises.
+func DisableReuseport() Option {
+	return func(t *Transport) error {
+		t.reuseport = false
+		return nil
+	}
+}
+
+// DisableNativeMultiplexing makes the transport run every connection through
+// the upgrader (Noise + Yamux on stream 0), as older releases did.
+func DisableNativeMultiplexing() Option {
+	return func(t *Transport) error {
+		t.native = false
+		return nil
+	}
+}
+
+// EnableDatagrams lets natively multiplexed connections carry unreliable
+// datagrams, reached through DatagramConn. Both sides must enable them.
+// Connections through the upgrader don't support datagrams.
+func EnableDatagrams() Option {
+	return func(t *Transport) error {
+		t.datagrams = true
+		return nil
+	}
+}
+
+// DisableResumption stops the transport from issuing session tickets to its
+// dialers and from resuming connections with the tickets it holds, so every
+// native connection runs the full handshake.
+func DisableResumption() Option {
+	return func(t *Transport) error {
+		t.resumption = false
+		return nil
+	}
+}
+
+// EnableEarlyData makes a dial resuming a native connection return as soon
+// as its ticket is sent, so the first streams go out without waiting a round
+// trip. Tickets are single use, so the listener refuses a replayed
+// resumption. But if the listener can't resume, for instance because it
+// restarted, the connection fails after Dial returned, and the next dial
+// runs the full handshake.
+func EnableEarlyData() Option {
+	return func(t *Transport) error {
+		t.earlyData = true
+		return nil
+	}
+}
+
+// WithTicketStore sets where the transport keeps the session tickets it
+// resumes connections with. The default is NewTicketCache(1024).
+func WithTicketStore(store TicketStore) Option {
+	return func(t *Transport) error {
+		if store == nil {
+			return errors.New("ticket store must not be nil")
+		}
+		t.ticketStore = store
+		return nil
+	}
+}
+
+// WithClock sets the clock handed to every UDX multiplexer the transport
+// creates, which the transport also keeps its own timestamps and runs its
+// timers and timeouts on. The default is the system's time.
+func WithClock(clock Clock) Option {
+	return func(t *Transport) error {
+		if clock == nil {
+			return errors.New("clock must not be nil")
+		}
+		t.clock = clock
+		return nil
+	}
+}
+
+// WithConnectionGater makes the transport consult gater before any work is
+// done for an inbound connection, and on native connections, which don't
+// pass through the upgrader, once the remote peer is authenticated. The
+// upgrader gates the connections it upgrades with its own gater.
+func WithConnectionGater(gater connmgr.ConnectionGater) Option {
+	return func(t *Transport) error {
+		if gater == nil {
+			return errors.New("connection gater must not be nil")
+		}
+		t.gater = gater
+		return nil
+	}
+}
+
+// WithEventBus makes the transport emit an EvtConnMigrated on bus whenever
+// one of its connections migrates to a new remote address.
+func WithEventBus(bus event.Bus) Option {
+	return func(t *Transport) error {
+		if bus == nil {
+			return errors.New("event bus must not be nil")
+		}
+		em, err := bus.Emitter(new(EvtConnMigrated))
+		if err != nil {
+			return fmt.Errorf("event bus: %w", err)
+		}
+		t.migrations = em
+		return nil
+	}
+}
+
+// WithListenPacket sets the function the transport opens its UDP sockets
+// with, for listening and for dialing, in place of net.ListenUDP. Tests use
+// it to run the transport over a simulated network such as udxsim.
+func WithListenPacket(f ListenPacketFunc) Option {
+	return func(t *Transport) error {
+		if f == nil {
+			return errors.New("listen packet function must not be nil")
+		}
+		t.listenPacket = f
+		return nil
+	}
+}
+
+// WithResolver sets the resolver Dial uses for /dns, /dns4 and /dns6
+// addresses. The default is madns.DefaultResolver, the one go-libp2p's swarm
+// uses unless configured otherwise.
+func WithResolver(r *madns.Resolver) Option {
+	return func(t *Transport) error {
+		if r == nil {
+			return errors.New("resolver must not be nil")
+		}
+		t.resolver = r
+		return nil
+	}
+}
+
+// WithSocketBuffers sets the kernel receive and send buffer sizes of the
+// transport's UDP sockets, in bytes. Zero leaves the system default.
+func WithSocketBuffers(read, write int) Option {
+	return func(t *Transport) error {
+		if read < 0 || write < 0 {
+			return errors.New("socket buffer sizes must not be negative")
+		}
+		t.readBuffer, t.writeBuffer = read, write
+		return nil
+	}
+}
+
+// WithHandshakeTimeout bounds how long a listener waits for an inbound native
+// handshake to complete. The default is 15 seconds.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(t *Transport) error {
+		if d <= 0 {
+			return errors.New("handshake timeout must be positive")
+		}
+		t.handshakeTimeout = d
+		return nil
+	}
+}
+
+// WithStream0Timeout bounds how long an inbound connection may take to open
+// stream 0 and send its first byte before the listener drops it. The default
+// is 10 seconds.
+func WithStream0Timeout(d time.Duration) Option {
+	return func(t *Transport) error {
+		if d <= 0 {
+			return errors.New("stream 0 timeout must be positive")
+		}
+		t.stream0Timeout = d
+		return nil
+	}
+}
+
+// WithIdleTimeout closes connections nothing has arrived on for d, which is
+// how a peer that went away, or whose NAT mapping expired, is noticed. Zero
+// disables it. The default is 30 seconds. NewTransport fails if go-udx can't
+// apply it.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(t *Transport) error {
+		if d < 0 {
+			return errors.New("idle timeout must not be negative")
+		}
+		t.idleTimeout, t.idleSet = d, true
+		return nil
+	}
+}
+
+// WithKeepAlive sets how often an idle connection sends a keep-alive, which
+// keeps NAT mappings open and the remote's idle timeout at bay. It must be
+// shorter than the idle timeout. Zero disables keep-alives. The default is
+// 15 seconds, below the UDP timeout of common NATs, or half the idle timeout
+// if that is shorter. NewTransport fails if go-udx can't apply it.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(t *Transport) error {
+		if interval < 0 {
+			return errors.New("keep-alive interval must not be negative")
+		}
+		t.keepAlive, t.keepAliveSet = interval, true
+		return nil
+	}
+}
+
+// WithMTU sets the path MTUs, in bytes of UDP payload: connections start at
+// initial, and path MTU discovery searches up to maximum and falls back to minimum
+// when the path stops carrying larger packets. minimum must be at least 1200,
+// the smallest MTU UDX works with. Setting minimum and maximum equal turns path MTU
+// discovery off. The default is 1200 up to 1452.
+//
+// Only natively multiplexed connections run discovery; connections through
+// the Upgrader keep initial. Discovery needs the don't-fragment bit, which is
+// only set on Linux, and only when go-udx takes the MTU found (see
+// StatsConn.PathMTU). Otherwise, connections over the operating system's
+// sockets never probe and keep initial.
+func WithMTU(initial, minimum, maximum int) Option {
+	return func(t *Transport) error {
+		if minimum < baseMTU || minimum > initial || initial > maximum || maximum > maxUDPPayload {
+			return fmt.Errorf("MTUs must satisfy %d <= minimum <= initial <= maximum <= %d", baseMTU, maxUDPPayload)
+		}
+		t.minMTU, t.initialMTU, t.maxMTU = minimum, initial, maximum
+		return nil
+	}
+}
+
+// WithCongestionControl sets the congestion control algorithm connections
+// run: NewReno, the default, Cubic, BBR or one of the caller's own, which
+// LinkStats reports. NewTransport fails if go-udx doesn't take congestion
+// controllers.
+func WithCongestionControl(cc CongestionControl) Option {
+	return func(t *Transport) error {
+		if cc.Name == "" || cc.New == nil {
+			return errors.New("congestion control needs a name and a constructor")
+		}
+		t.congestion, t.congestionSet = cc, true
+		return nil
+	}
+}
+
+// DisablePacing lets UDX's packets leave as soon as UDX sends them. By
+// default, the packets of every connection are spread out at a rate derived
+// from its congestion window and round-trip time, so a window doesn't leave
+// in one burst that overflows a shallow router queue. Without a congestion
+// controller of the transport's (see WithCongestionControl), connections
+// aren't paced anyway.
+func DisablePacing() Option {
+	return func(t *Transport) error {
+		t.pacing = false
+		return nil
+	}
+}
+
+// WithAddressValidation sets when listeners make new sources prove they own
+// their address before their packets reach UDX (see AddressValidation). The
+// default is ValidateNever.
+func WithAddressValidation(v AddressValidation) Option {
+	return func(t *Transport) error {
+		if v < ValidateNever || v > ValidateAlways {
+			return fmt.Errorf("unknown address validation mode %d", v)
+		}
+		t.validation = v
+		return nil
+	}
+}
+
+// WithMaxHalfOpenConns caps how many inbound connections each listener sets
+// up at once; further connections are dropped until one completes or times
+// out. The default is 128.
+func WithMaxHalfOpenConns(n int) Option {
+	return func(t *Transport) error {
+		if n <= 0 {
+			return errors.New("half-open connection limit must be positive")
+		}
+		t.maxHalfOpen = n
+		return nil
+	}
+}
+
+// WithMetricsTracer makes the transport report its connections to mt, such
+// as one created by NewMetricsTracer. By default nothing is recorded.
+func WithMetricsTracer(mt MetricsTracer) Option {
+	return func(t *Transport) error {
+		if mt == nil {
+			return errors.New("metrics tracer must not be nil")
+		}
+		t.metrics = mt
+		return nil
+	}
+}
+
+// WithTraceDir makes the transport write an event trace of every connection
+// to dir, one newline-delimited JSON file per connection. The udxtrace
+// package reads them back. dir is created if it doesn't exist.
+func WithTraceDir(dir string) Option {
+	return func(t *Transport) error {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("trace dir: %w", err)
+		}
+		t.traceDir = dir
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+package udxtransport
+
+import (
+	"testing"
+	"time"
+
+	udx "github.com/stephanfeb/go-udx"
+)
+
+func TestOptions(t *testing.T) {
+	key, _ := generateKey(t)
+	u := createUpgrader(t, key)
+
+	tr, err := NewTransport(key, u, nil,
+		DisableReuseport(),
+		DisableNativeMultiplexing(),
+		WithSocketBuffers(1<<20, 1<<20),
+		WithHandshakeTimeout(time.Second),
+		DisablePacing(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.reuseport || tr.native {
+		t.Fatal("reuseport and native multiplexing should be disabled")
+	}
+	if tr.readBuffer != 1<<20 || tr.writeBuffer != 1<<20 {
+		t.Fatal("socket buffers not applied")
+	}
+	if tr.handshakeTimeout != time.Second {
+		t.Fatal("handshake timeout not applied")
+	}
+	if tr.pacing {
+		t.Fatal("pacing should be disabled")
+	}
+
+	for _, opt := range []Option{
+		WithClock(nil),
+		WithSocketBuffers(-1, 0),
+		WithHandshakeTimeout(0),
+		WithEventBus(nil),
+		WithIdleTimeout(-1),
+		WithKeepAlive(-1),
+		WithMTU(1000, 1000, 1500),
+		WithMTU(1300, 1400, 1500),
+		WithMTU(1500, 1200, 1400),
+		WithMTU(1200, 1200, 70000),
+		WithAddressValidation(AddressValidation(7)),
+		WithCongestionControl(CongestionControl{Name: "none"}),
+	} {
+		if _, err := NewTransport(key, u, nil, opt); err == nil {
+			t.Fatal("expected an invalid option to fail NewTransport")
+		}
+	}
+	if _, err := NewTransport(key, u, nil, WithIdleTimeout(time.Second), WithKeepAlive(time.Second)); err == nil {
+		t.Fatal("expected a keep-alive interval as long as the idle timeout to fail NewTransport")
+	}
+
+	// The algorithm applies if go-udx takes congestion controllers.
+	tr, err = NewTransport(key, u, nil, WithCongestionControl(Cubic))
+	if _, ok := any((*udx.Connection)(nil)).(congestionControlled); !ok {
+		if err == nil {
+			t.Fatal("expected congestion control go-udx can't run to fail NewTransport")
+		}
+	} else if err != nil || tr.congestion.Name != "cubic" {
+		t.Fatal("congestion control not applied:", err)
+	}
+
+	// An idle timeout shorter than the default keep-alive interval brings
+	// the interval down with it.
+	tr, err = NewTransport(key, u, nil, WithIdleTimeout(10*time.Second))
+	if _, ok := any((*udx.Connection)(nil)).(idleConfigurer); !ok {
+		if err == nil {
+			t.Fatal("expected an idle timeout go-udx can't apply to fail NewTransport")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.keepAlive != 5*time.Second {
+		t.Fatalf("keep-alive interval %s with a 10s idle timeout, want 5s", tr.keepAlive)
+	}
+}
@@ -0,0 +1,223 @@
+package udxtransport
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// pacingGain is how much faster than a window per round trip packets
+	// are paced, so pacing doesn't hold the window back, as in RFC 9002.
+	pacingGain = 1.25
+	// pacingBurst is how many bytes may leave back to back after a pause.
+	pacingBurst = 2 * baseMTU
+	// pacingGranularity is the timer slack a pacer makes up for by sending
+	// that much of its rate at once; it sets the burst at high rates.
+	pacingGranularity = time.Millisecond
+	// maxPacedBytes bounds the bytes waiting in a pacer. UDX's window keeps
+	// them far below it.
+	maxPacedBytes = 1 << 20
+)
+
+// pacingRater is implemented by congestion controllers that know the rate to
+// pace at, such as BBR. Unlike the controller's other methods, PacingRate may
+// be called at any time.
+type pacingRater interface {
+	PacingRate() int
+}
+
+// pacingRate returns the rate in bytes per second to pace the connection's
+// packets at: the controller's own if it knows one, and pacingGain times a
+// window per smoothed round trip otherwise. It is 0 until there is a
+// round-trip time, which lets packets go out at once.
+func (m *measuredController) pacingRate() int {
+	if pr, ok := m.CongestionController.(pacingRater); ok {
+		if rate := pr.PacingRate(); rate > 0 {
+			return rate
+		}
+	}
+	srtt := time.Duration(m.srtt.Load())
+	if srtt <= 0 {
+		return 0
+	}
+	return int(pacingGain * float64(m.cwnd.Load()) / srtt.Seconds())
+}
+
+// pacer spreads the packets UDX sends to one remote out over time, at the
+// rate its congestion window allows, instead of letting a whole window out
+// at once to overflow the queue at the bottleneck. It is a token bucket: a
+// packet goes out while there are tokens left, and tokens come in at the
+// rate, up to a small burst. A packet without tokens waits in the pacer's
+// queue, which a goroutine of its own sends on as tokens come in. UDX's
+// write returns at once either way, so the socket's writes to other remotes
+// never wait on this one.
+type pacer struct {
+	conn  net.PacketConn
+	clock Clock
+	rate  func() int
+	ap    netip.AddrPort // guarded by the packetDemux's mu
+
+	mu      sync.Mutex
+	tokens  int       // bytes that may go out now; negative after a packet larger than the tokens left
+	refill  time.Time // when tokens were last added
+	current int       // the rate tokens were last added at
+	queue   []pacedPacket
+	queued  int  // bytes in queue
+	sending bool // the goroutine is writing a packet it took off the queue
+	wake    chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// pacedPacket is a packet waiting in a pacer's queue.
+type pacedPacket struct {
+	p    []byte
+	addr net.Addr
+}
+
+// send sends p at once if the pacer has tokens for it and nothing is
+// waiting, and queues it otherwise. A packet that doesn't fit in the queue
+// is dropped as if lost.
+func (pc *pacer) send(p []byte, addr net.Addr) (int, error) {
+	pc.mu.Lock()
+	if len(pc.queue) == 0 && !pc.sending && pc.take(len(p)) {
+		pc.mu.Unlock()
+		return pc.conn.WriteTo(p, addr)
+	}
+	if pc.queued+len(p) <= maxPacedBytes {
+		// The caller may reuse p once WriteTo returns.
+		pc.queue = append(pc.queue, pacedPacket{p: bytes.Clone(p), addr: addr})
+		pc.queued += len(p)
+	}
+	pc.mu.Unlock()
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// run sends the packets queued as the pacer's tokens allow, until the pacer
+// is closed and its queue empty.
+func (pc *pacer) run() {
+	var timer *clockTimer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		pc.mu.Lock()
+		pc.sending = false
+		if len(pc.queue) == 0 {
+			closed := pc.isClosed()
+			pc.mu.Unlock()
+			if closed {
+				return
+			}
+			select {
+			case <-pc.wake:
+			case <-pc.closed:
+			}
+			continue
+		}
+		next := pc.queue[0]
+		if !pc.take(len(next.p)) {
+			wait := time.Duration(float64(1-pc.tokens) / float64(pc.current) * float64(time.Second))
+			pc.mu.Unlock()
+			if timer == nil {
+				timer = newTimer(pc.clock, wait)
+			} else {
+				timer.Reset(wait)
+			}
+			select {
+			case <-timer.C:
+			case <-pc.closed:
+			}
+			continue
+		}
+		pc.queue[0] = pacedPacket{}
+		pc.queue = pc.queue[1:]
+		pc.queued -= len(next.p)
+		pc.sending = true
+		pc.mu.Unlock()
+		pc.conn.WriteTo(next.p, next.addr)
+	}
+}
+
+// take reports whether a packet of n bytes may go out now, taking its tokens
+// if so. Once the pacer is closed, every packet may.
+func (pc *pacer) take(n int) bool {
+	if pc.isClosed() {
+		return true
+	}
+	now := pc.clock.Now()
+	pc.current = pc.rate()
+	if pc.current <= 0 {
+		pc.refill = now
+		return true
+	}
+	burst := max(pacingBurst, pc.current*int(pacingGranularity)/int(time.Second))
+	tokens := float64(pc.tokens) + float64(pc.current)*now.Sub(pc.refill).Seconds()
+	pc.tokens = int(min(tokens, float64(burst)))
+	pc.refill = now
+	if pc.tokens <= 0 {
+		return false
+	}
+	pc.tokens -= n
+	return true
+}
+
+func (pc *pacer) isClosed() bool {
+	select {
+	case <-pc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops pacing, letting the packets waiting for tokens go at once.
+func (pc *pacer) close() {
+	pc.once.Do(func() { close(pc.closed) })
+}
+
+// pace starts pacing the packets to ap at rate.
+func (d *packetDemux) pace(ap netip.AddrPort, rate func() int) *pacer {
+	pc := &pacer{conn: d.PacketConn, clock: d.clock, rate: rate, ap: ap, wake: make(chan struct{}, 1), closed: make(chan struct{})}
+	go pc.run()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pacers[ap] = pc
+	return pc
+}
+
+// movePacer paces the packets to ap with pc, which paced another address.
+func (d *packetDemux) movePacer(pc *pacer, ap netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pacers[pc.ap] == pc {
+		delete(d.pacers, pc.ap)
+	}
+	pc.ap = ap
+	d.pacers[ap] = pc
+}
+
+// unpace stops pacing with pc.
+func (d *packetDemux) unpace(pc *pacer) {
+	d.mu.Lock()
+	if d.pacers[pc.ap] == pc {
+		delete(d.pacers, pc.ap)
+	}
+	d.mu.Unlock()
+	pc.close()
+}
+
+func (d *packetDemux) pacerOf(ap netip.AddrPort) *pacer {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.pacers[ap]
+}
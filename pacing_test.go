@@ -0,0 +1,117 @@
+package udxtransport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxsim"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+func TestPacer(t *testing.T) {
+	n := udxsim.NewNetwork(1, udxsim.Link{})
+	defer n.Close()
+	listen := func(ip net.IP) net.PacketConn {
+		pc, err := n.Host(ip).ListenPacket("udp4", &net.UDPAddr{Port: 4001})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	sender, receiver := listen(net.IPv4(10, 0, 0, 1)), listen(net.IPv4(10, 0, 0, 2))
+	other := listen(net.IPv4(10, 0, 0, 3))
+	demux := newPacketDemux(sender, systemClock{}, newTokenKeys(udx.RealClock{}), nil)
+	ap, _ := addrPortOf(receiver.LocalAddr())
+	const rate = 100_000
+	pc := demux.pace(ap, func() int { return rate })
+	// write writes packets to the receiver, reporting how long it took.
+	write := func(packets int) time.Duration {
+		start := time.Now()
+		for range packets {
+			demux.WriteTo(make([]byte, 1000), receiver.LocalAddr())
+		}
+		return time.Since(start)
+	}
+
+	// A burst of 20 packets of 1000 bytes leaves at 100 kB/s, after the
+	// first pacingBurst bytes, while the writes return at once.
+	start := time.Now()
+	if d := write(20); d > 50*time.Millisecond {
+		t.Errorf("writing 20 paced packets took %s", d)
+	}
+	buf := make([]byte, 2048)
+	var arrived []time.Duration
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range 20 {
+		if _, _, err := receiver.ReadFrom(buf); err != nil {
+			t.Fatalf("%d packets arrived: %v", len(arrived), err)
+		}
+		arrived = append(arrived, time.Since(start))
+	}
+	if arrived[1] > 50*time.Millisecond {
+		t.Errorf("burst of two packets took %s", arrived[1])
+	}
+	if want := time.Duration(20_000-pacingBurst) * time.Second / rate; arrived[19] < want*9/10 {
+		t.Errorf("20 packets took %s, want at least %s", arrived[19], want)
+	}
+
+	// Packets held back for one remote don't hold up the socket's writes to
+	// another.
+	demux.unpace(pc)
+	pc = demux.pace(ap, func() int { return 1 })
+	write(20)
+	for i := range 3 {
+		if _, _, err := receiver.ReadFrom(buf); err != nil {
+			t.Fatalf("%d packets arrived: %v", i, err)
+		}
+	}
+	start = time.Now()
+	demux.WriteTo([]byte("unpaced"), other.LocalAddr())
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := other.ReadFrom(buf); err != nil {
+		t.Fatal("packet to another remote:", err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("packet to another remote took %s", d)
+	}
+	receiver.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := receiver.ReadFrom(buf); err == nil {
+		t.Fatal("packet left a pacer at 1 byte per second")
+	}
+
+	// Closing a pacer sends the packets it holds back at once.
+	start = time.Now()
+	demux.unpace(pc)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := range 17 {
+		if _, _, err := receiver.ReadFrom(buf); err != nil {
+			t.Fatalf("%d packets arrived after closing the pacer: %v", i, err)
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("17 unpaced packets took %s", d)
+	}
+}
+
+func TestPacingReducesLoss(t *testing.T) {
+	// A home router's queue holds a few packets, far less than the
+	// bandwidth-delay product.
+	shallow := ccBottleneck
+	shallow.Queue = 4 * ccPacketSize
+	// Pausing for longer than a round trip between writes leaves the whole
+	// window open, for the next write to go out in one burst.
+	const pause = 50 * time.Millisecond
+	for _, cc := range congestionControls {
+		t.Run(cc.Name, func(t *testing.T) {
+			// The share of the packets sent that overflowed the queue.
+			lossRate := func(c udxsim.Counters) float64 { return float64(c.Overflowed) / float64(c.Sent) }
+			_, unpaced := runCCFlows(t, cc, shallow, 1, pause, false)
+			_, paced := runCCFlows(t, cc, shallow, 1, pause, true)
+			if lossRate(paced) > lossRate(unpaced)*0.8 {
+				t.Errorf("%.1f%% of packets overflowed the queue paced, %.1f%% unpaced", lossRate(paced)*100, lossRate(unpaced)*100)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package udxtransport
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// MTUs count the bytes of UDP payload.
+const (
+	// baseMTU is the smallest path MTU UDX works with, and the floor path MTU
+	// discovery falls back to.
+	baseMTU = 1200
+	// defaultMaxMTU is the UDP payload of a 1500 byte Ethernet frame over
+	// IPv6.
+	defaultMaxMTU = 1452
+	maxUDPPayload = 65527
+
+	pmtuMaxProbes     = 3                // probes of one size before it counts as too big, MAX_PROBES of RFC 8899
+	pmtuSearchStep    = 16               // the search stops once the sizes left are fewer
+	pmtuRaiseInterval = 10 * time.Minute // how long a finished search stands, PMTU_RAISE_TIMER of RFC 8899
+	minProbeTimeout   = 100 * time.Millisecond
+	maxProbeTimeout   = time.Second
+)
+
+// mtuSetter is implemented by udx.Connection when it sizes its packets to a
+// path MTU the transport gives it. The don't-fragment bit is set on the whole
+// socket, so UDX's packets would be dropped above the path MTU if UDX didn't
+// know it. Without it, the bit stays off, and path MTU discovery only runs on
+// sockets that never fragment.
+type mtuSetter interface {
+	SetMTU(n int)
+}
+
+// configureMTU hands the initial MTU to c, a udx.Connection, if go-udx takes
+// it.
+func (t *Transport) configureMTU(c any) {
+	if ms, ok := c.(mtuSetter); ok {
+		ms.SetMTU(t.initialMTU)
+	}
+}
+
+// canProbe sets the don't-fragment bit on conn's packets, so probes above the
+// path MTU are dropped instead of fragmented, and reports whether path MTU
+// discovery can run on conn. Sockets that aren't the operating system's,
+// like udxsim's, never fragment.
+func canProbe(conn net.PacketConn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	if _, ok := any((*udx.Connection)(nil)).(mtuSetter); !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	return setDontFragment(raw) == nil
+}
+
+// pathMTU returns the path MTU the connection's packets are sized to.
+func (c *conn) pathMTU() int {
+	return int(c.mtu.Load())
+}
+
+// setMTU changes the path MTU, handing it to go-udx if it takes it. done
+// marks the end of a search.
+func (c *conn) setMTU(n int, done bool) {
+	if c.closed.Load() {
+		return
+	}
+	if old := c.mtu.Swap(int64(n)); old == int64(n) && !done {
+		return
+	}
+	if ms, ok := any(c.udxConn).(mtuSetter); ok {
+		ms.SetMTU(n)
+	}
+	c.trace.event(udxtrace.MTUUpdated, map[string]any{"mtu": n, "done": done})
+}
+
+// receiveProbe acknowledges a probe of size bytes.
+func (c *conn) receiveProbe(size int) {
+	select {
+	case <-c.pkts.announced:
+	default:
+		return
+	}
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], uint16(size))
+	c.sendPacket(packetProbeAck, payload[:])
+}
+
+// receiveProbeAck hands the size of an acknowledged probe to discoverMTU.
+func (c *conn) receiveProbeAck(payload []byte) {
+	if len(payload) != 2 || c.probeAcks == nil {
+		return
+	}
+	select {
+	case c.probeAcks <- int(binary.BigEndian.Uint16(payload)):
+	default:
+	}
+}
+
+// discoverMTU runs datagram packetization layer path MTU discovery (RFC
+// 8899) on the connection. Once the remote has announced its receiver ID, it
+// searches for the largest probe that gets through, up to the transport's
+// maximum MTU, and confirms that size every keep-alive interval. When probes
+// of the confirmed size stop getting through, the path has become a black
+// hole for them and the MTU falls back to the minimum. A migration restarts
+// the search from the initial MTU, and a finished search is repeated after
+// pmtuRaiseInterval. It returns when the connection is closed.
+func (c *conn) discoverMTU() {
+	select {
+	case <-c.pkts.announced:
+	case <-c.done:
+		return
+	}
+	t := c.transport
+	confirmInterval := t.keepAlive
+	if confirmInterval == 0 {
+		confirmInterval = defaultKeepAlive
+	}
+	p := &mtuProber{conn: c}
+
+	for !c.closed.Load() {
+		p.search()
+
+		confirm := newTicker(t.clock, confirmInterval)
+		raise := newTimer(t.clock, pmtuRaiseInterval)
+	wait:
+		for {
+			select {
+			case <-confirm.C:
+				if mtu := c.pathMTU(); mtu > t.minMTU && !p.probe(mtu) {
+					c.setMTU(t.minMTU, false)
+					break wait
+				}
+			case <-raise.C:
+				if c.pathMTU() < t.maxMTU {
+					break wait
+				}
+				raise.Reset(pmtuRaiseInterval)
+			case <-c.path.changed:
+				c.setMTU(t.initialMTU, false)
+				p.rtt = 0
+				break wait
+			case <-c.done:
+				break wait
+			}
+		}
+		confirm.Stop()
+		raise.Stop()
+	}
+}
+
+// mtuProber sends the probes of one connection's path MTU discovery.
+type mtuProber struct {
+	conn *conn
+	rtt  time.Duration // of the last acknowledged probe; 0 before the first
+}
+
+// search raises the path MTU to the largest size, up to the transport's
+// maximum, a probe gets through at. An unconfirmed MTU that no probe gets
+// through at falls to the minimum first.
+func (p *mtuProber) search() {
+	c, t := p.conn, p.conn.transport
+	lo := c.pathMTU()
+	if lo > t.minMTU && !p.probe(lo) {
+		lo = t.minMTU
+		c.setMTU(lo, false)
+	}
+	// Most paths carry the maximum, so try it first.
+	hi, size := t.maxMTU, t.maxMTU
+	for size > lo && !c.closed.Load() {
+		if p.probe(size) {
+			lo = size
+			c.setMTU(lo, false)
+		} else {
+			hi = size - 1
+		}
+		if hi-lo < pmtuSearchStep {
+			break
+		}
+		size = (lo + hi + 1) / 2
+	}
+	c.setMTU(lo, true)
+}
+
+// probe sends up to pmtuMaxProbes probes of size bytes and reports whether
+// one was acknowledged.
+func (p *mtuProber) probe(size int) bool {
+	c, clock := p.conn, p.conn.transport.clock
+	padding := make([]byte, size-packetHeaderLen-c.keys.local.Overhead())
+	for range pmtuMaxProbes {
+		sent := clock.Now()
+		if _, err := c.sendPacket(packetProbe, padding); err != nil {
+			// Larger than the local interface's MTU.
+			return false
+		}
+		timer := newTimer(clock, p.timeout())
+	wait:
+		for {
+			select {
+			case n := <-c.probeAcks:
+				if n == size {
+					timer.Stop()
+					p.rtt = clock.Now().Sub(sent)
+					return true
+				}
+			case <-timer.C:
+				break wait
+			case <-c.done:
+				timer.Stop()
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// timeout is how long a probe waits for its acknowledgement: three round
+// trips, within bounds. Before a probe has been acknowledged, the round trip
+// is UDX's smoothed RTT, if go-udx exposes it.
+func (p *mtuProber) timeout() time.Duration {
+	rtt := p.rtt
+	if rtt == 0 {
+		s, ok := linkStatsOf(p.conn.udxConn)
+		if !ok || s.SmoothedRTT == 0 {
+			return maxProbeTimeout
+		}
+		rtt = s.SmoothedRTT
+	}
+	return min(max(3*rtt, minProbeTimeout), maxProbeTimeout)
+}
@@ -0,0 +1,89 @@
+package udxtransport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxsim"
+)
+
+// waitMTU waits for the path MTU of c to settle within pmtuSearchStep below
+// linkMTU.
+func waitMTU(t *testing.T, c tpt.CapableConn, linkMTU int) {
+	t.Helper()
+	var sc StatsConn
+	if !c.As(&sc) {
+		t.Fatal("connection isn't a StatsConn")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mtu := sc.PathMTU()
+		if mtu <= linkMTU && mtu > linkMTU-pmtuSearchStep {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("path MTU is %d over a link with an MTU of %d", mtu, linkMTU)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPathMTUDiscovery(t *testing.T) {
+	n := udxsim.NewNetwork(1, udxsim.Link{Latency: time.Millisecond, MTU: 1400})
+	defer n.Close()
+	clientIP, serverIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	opts := []Option{WithKeepAlive(100 * time.Millisecond)}
+	server := newTestTransport(t, nil, nil, append(opts, WithListenPacket(n.Host(serverIP).ListenPacket))...)
+	defer server.Close()
+	ln, err := server.Listen(ma.StringCast("/ip4/10.0.0.2/udp/4001/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan tpt.CapableConn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	client := newTestTransport(t, nil, nil, append(opts, WithListenPacket(n.Host(clientIP).ListenPacket))...)
+	defer client.Close()
+	dialed, err := client.Dial(context.Background(), ln.Multiaddr(), server.localPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sconn tpt.CapableConn
+	select {
+	case sconn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+
+	waitMTU(t, dialed, 1400)
+	waitMTU(t, sconn, 1400)
+
+	// The path shrinks: the confirmation probes stop getting through, and
+	// the MTU falls back before the search finds the new one.
+	n.SetLink(clientIP, serverIP, udxsim.Link{Latency: time.Millisecond, MTU: 1300})
+	n.SetLink(serverIP, clientIP, udxsim.Link{Latency: time.Millisecond, MTU: 1300})
+	waitMTU(t, dialed, 1300)
+	waitMTU(t, sconn, 1300)
+	if n.Counters().TooBig == 0 {
+		t.Error("no probe was too big for the path")
+	}
+}
+
+func TestPathMTUDiscoveryOff(t *testing.T) {
+	_, _, dialed, _ := connectedPeers(t, WithMTU(1280, 1280, 1280))
+	c := dialed.(*conn)
+	if c.probeAcks != nil {
+		t.Error("path MTU discovery runs with the minimum and maximum MTU equal")
+	}
+	if mtu := c.pathMTU(); mtu != 1280 {
+		t.Errorf("path MTU is %d, want 1280", mtu)
+	}
+}
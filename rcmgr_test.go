@@ -0,0 +1,158 @@
+package udxtransport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// recordingScope records what a transport does with a connection scope.
+type recordingScope struct {
+	network.NullScope
+
+	mu       sync.Mutex
+	peer     peer.ID
+	reserved int
+	done     bool
+}
+
+func (s *recordingScope) SetPeer(p peer.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peer != "" {
+		return errors.New("connection scope already attached to a peer")
+	}
+	s.peer = p
+	return nil
+}
+
+func (s *recordingScope) PeerScope() network.PeerScope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peer == "" {
+		return nil
+	}
+	return &network.NullScope{}
+}
+
+func (s *recordingScope) ReserveMemory(size int, _ uint8) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reserved += size
+	return nil
+}
+
+func (s *recordingScope) Done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+}
+
+func (s *recordingScope) state() (peer.ID, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer, s.reserved, s.done
+}
+
+// recordingResourceManager hands out recordingScopes for outbound
+// connections.
+type recordingResourceManager struct {
+	network.NullResourceManager
+
+	mu       sync.Mutex
+	outbound []*recordingScope
+}
+
+func (r *recordingResourceManager) OpenConnection(dir network.Direction, _ bool, _ ma.Multiaddr) (network.ConnManagementScope, error) {
+	if dir != network.DirOutbound {
+		return &network.NullScope{}, nil
+	}
+	s := &recordingScope{}
+	r.mu.Lock()
+	r.outbound = append(r.outbound, s)
+	r.mu.Unlock()
+	return s, nil
+}
+
+func (r *recordingResourceManager) lastOutbound(t *testing.T) *recordingScope {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.outbound) == 0 {
+		t.Fatal("no outbound connection scope was opened")
+	}
+	return r.outbound[len(r.outbound)-1]
+}
+
+func TestDialResourceLimitBeforeDialing(t *testing.T) {
+	tr := newTestTransport(t, nil, &limitedResourceManager{})
+	_, serverID := generateKey(t)
+
+	// Nothing listens there: a dial that got as far as the network would
+	// run into the context deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := tr.Dial(ctx, ma.StringCast("/ip4/127.0.0.1/udp/9/udx"), serverID)
+	if !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("expected ErrResourceLimitExceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("dial did network work before checking the resource manager")
+	}
+}
+
+func TestDialScope(t *testing.T) {
+	ln, serverID, accepted := listenForTest(t, newTestTransport(t, nil, nil))
+	rcmgr := &recordingResourceManager{}
+	client := newTestTransport(t, nil, rcmgr)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, ln.Multiaddr(), serverID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	(<-accepted).Close()
+
+	scope := rcmgr.lastOutbound(t)
+	p, reserved, done := scope.state()
+	if p != serverID {
+		t.Fatalf("scope attached to %q, want %s", p, serverID)
+	}
+	if reserved != connMemory {
+		t.Fatalf("reserved %d bytes, want %d", reserved, connMemory)
+	}
+	if done {
+		t.Fatal("scope released while the connection is open")
+	}
+	c.Close()
+	if _, _, done := scope.state(); !done {
+		t.Fatal("scope not released on Close")
+	}
+}
+
+func TestDialScopeReleasedOnError(t *testing.T) {
+	ln, _, _ := listenForTest(t, newTestTransport(t, nil, nil))
+	rcmgr := &recordingResourceManager{}
+	client := newTestTransport(t, nil, rcmgr)
+	defer client.Close()
+
+	// The handshake fails on the peer ID mismatch.
+	_, wrongID := generateKey(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Dial(ctx, ln.Multiaddr(), wrongID); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if _, _, done := rcmgr.lastOutbound(t).state(); !done {
+		t.Fatal("scope not released after a failed dial")
+	}
+}
@@ -0,0 +1,248 @@
+package udxtransport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A listener hands every dialer of a native connection a session ticket on
+// stream 0: a resumption secret, and the secret sealed together with the
+// dialer's public key under a key only the listener's transport knows. The
+// next dial to the listener sends the ticket instead of running the full
+// handshake (see handshake.go), which spares both sides their signatures
+// and lets the listener accept the connection a round trip earlier. With
+// early data on, the dialer doesn't wait for the listener's answer at all.
+//
+// A ticket is good for one resumption: dialers take it out of their store,
+// and listeners refuse a ticket they resumed with before, so a recorded
+// resumption can't be replayed. Listeners keep their ticket keys in memory
+// only, so their tickets die with them.
+const (
+	// ticketLifetime is how long a ticket can be resumed with. It must not
+	// be longer than tokenRotation, as tickets are sealed under keys derived
+	// from the address validation secrets.
+	ticketLifetime = time.Hour
+	ticketNonceLen = 12
+	// maxUsedTickets bounds the tickets a transport remembers having resumed
+	// with. Once that many are unexpired, resumptions fall back to the full
+	// handshake.
+	maxUsedTickets = 1 << 16
+	// defaultTicketCacheSize is how many peers the default TicketStore keeps
+	// a ticket for.
+	defaultTicketCacheSize = 1024
+)
+
+var errTicketRejected = errors.New("listener rejected the session ticket")
+
+// SessionTicket resumes native connections to the peer that issued it.
+type SessionTicket struct {
+	Ticket  []byte    // opaque to the dialer
+	Secret  []byte    // resumption secret
+	PubKey  ic.PubKey // the issuer's key
+	Expires time.Time
+}
+
+// TicketStore keeps the session tickets a transport resumes connections
+// with, by the peer that issued them. It must be safe for concurrent use.
+type TicketStore interface {
+	// Put stores a ticket from p, replacing the one stored before.
+	Put(p peer.ID, t SessionTicket)
+	// Take removes the ticket stored for p and returns it. Tickets are
+	// single use, so a store must not return one twice.
+	Take(p peer.ID) (SessionTicket, bool)
+}
+
+// NewTicketCache returns a TicketStore keeping tickets in memory for up to
+// size peers. Once full, it drops the ticket that expires first. It is the
+// default store, with room for 1024 peers.
+func NewTicketCache(size int) TicketStore {
+	return &ticketCache{size: size, tickets: make(map[peer.ID]SessionTicket)}
+}
+
+type ticketCache struct {
+	size int
+
+	mu      sync.Mutex
+	tickets map[peer.ID]SessionTicket
+}
+
+func (tc *ticketCache) Put(p peer.ID, t SessionTicket) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.tickets[p]; !ok && len(tc.tickets) >= tc.size {
+		var first peer.ID
+		for q, t := range tc.tickets {
+			if first == "" || t.Expires.Before(tc.tickets[first].Expires) {
+				first = q
+			}
+		}
+		delete(tc.tickets, first)
+	}
+	tc.tickets[p] = t
+}
+
+func (tc *ticketCache) Take(p peer.ID) (SessionTicket, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	t, ok := tc.tickets[p]
+	delete(tc.tickets, p)
+	return t, ok
+}
+
+// takeTicket returns an unexpired ticket to resume a connection to p with.
+func (t *Transport) takeTicket(p peer.ID) (SessionTicket, bool) {
+	if !t.resumption || p == "" {
+		return SessionTicket{}, false
+	}
+	ticket, ok := t.ticketStore.Take(p)
+	if !ok || !t.clock.Now().Before(ticket.Expires) || ticket.PubKey == nil || !p.MatchesPublicKey(ticket.PubKey) {
+		return SessionTicket{}, false
+	}
+	return ticket, true
+}
+
+func ticketAEAD(secret []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, nil, "libp2p-udx ticket key", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTicket seals a resumption secret and the dialer's key into a ticket.
+func (t *Transport) sealTicket(secret []byte, remote ic.PubKey) ([]byte, error) {
+	pub, err := ic.MarshalPublicKey(remote)
+	if err != nil {
+		return nil, err
+	}
+	now := t.clock.Now()
+	current, _ := t.tokens.secrets(now)
+	aead, err := ticketAEAD(current)
+	if err != nil {
+		return nil, err
+	}
+	plain := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	plain = append(append(plain, secret...), pub...)
+	ticket := make([]byte, ticketNonceLen, ticketNonceLen+len(plain)+aead.Overhead())
+	rand.Read(ticket)
+	return aead.Seal(ticket, ticket, plain, nil), nil
+}
+
+// openTicket returns the resumption secret and dialer's key of a ticket the
+// transport sealed less than ticketLifetime ago.
+func (t *Transport) openTicket(ticket []byte) ([]byte, ic.PubKey, bool) {
+	if len(ticket) < ticketNonceLen {
+		return nil, nil, false
+	}
+	now := t.clock.Now()
+	current, previous := t.tokens.secrets(now)
+	for _, secret := range [][]byte{current, previous} {
+		if secret == nil {
+			continue
+		}
+		aead, err := ticketAEAD(secret)
+		if err != nil {
+			return nil, nil, false
+		}
+		plain, err := aead.Open(nil, ticket[:ticketNonceLen], ticket[ticketNonceLen:], nil)
+		if err != nil {
+			continue
+		}
+		if len(plain) < 8+sessionSecretLen {
+			return nil, nil, false
+		}
+		issued := time.Unix(0, int64(binary.BigEndian.Uint64(plain[:8])))
+		if age := now.Sub(issued); age < 0 || age > ticketLifetime {
+			return nil, nil, false
+		}
+		pub, err := ic.UnmarshalPublicKey(plain[8+sessionSecretLen:])
+		if err != nil {
+			return nil, nil, false
+		}
+		return plain[8 : 8+sessionSecretLen], pub, true
+	}
+	return nil, nil, false
+}
+
+// usedTickets remembers the tickets a transport resumed with until they
+// expire, so each resumes one connection only.
+type usedTickets struct {
+	mu    sync.Mutex
+	nonce map[[ticketNonceLen]byte]time.Time // when the ticket expires
+}
+
+// firstUse reports whether ticket wasn't resumed with before, and marks it
+// used.
+func (t *Transport) firstUse(ticket []byte) bool {
+	now := t.clock.Now()
+	u := &t.usedTickets
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.nonce == nil {
+		u.nonce = make(map[[ticketNonceLen]byte]time.Time)
+	}
+	nonce := [ticketNonceLen]byte(ticket[:ticketNonceLen])
+	if _, ok := u.nonce[nonce]; ok {
+		return false
+	}
+	if len(u.nonce) >= maxUsedTickets {
+		for n, expires := range u.nonce {
+			if !now.Before(expires) {
+				delete(u.nonce, n)
+			}
+		}
+		if len(u.nonce) >= maxUsedTickets {
+			return false
+		}
+	}
+	u.nonce[nonce] = now.Add(ticketLifetime)
+	return true
+}
+
+// issueTicket sends the dialer of an inbound connection a session ticket.
+// A failed write shows up as a failure of the connection's streams.
+func (c *conn) issueTicket() {
+	secret := make([]byte, sessionSecretLen)
+	rand.Read(secret)
+	ticket, err := c.transport.sealTicket(secret, c.remotePubKey)
+	if err != nil {
+		return
+	}
+	payload := binary.BigEndian.AppendUint32(nil, uint32(ticketLifetime/time.Second))
+	payload = append(append(payload, secret...), ticket...)
+	c.control.wmu.Lock()
+	defer c.control.wmu.Unlock()
+	c.control.writeFrame(frameTicket, payload)
+}
+
+// storeTicket stores the session ticket of a ticket frame from the listener.
+func (c *conn) storeTicket(payload []byte) error {
+	if !c.isDialer || len(payload) <= 4+sessionSecretLen {
+		return errStreamProtocol
+	}
+	if !c.transport.resumption {
+		return nil
+	}
+	lifetime := time.Duration(binary.BigEndian.Uint32(payload[:4])) * time.Second
+	c.transport.ticketStore.Put(c.remotePeerID, SessionTicket{
+		Ticket:  append([]byte(nil), payload[4+sessionSecretLen:]...),
+		Secret:  append([]byte(nil), payload[4:4+sessionSecretLen]...),
+		PubKey:  c.remotePubKey,
+		Expires: c.transport.clock.Now().Add(lifetime),
+	})
+	return nil
+}
@@ -0,0 +1,224 @@
+package udxtransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+)
+
+// resumeOverPipe resumes with ticket against listener over a pipe.
+func resumeOverPipe(t *testing.T, listener *Transport, ticket SessionTicket, earlyData bool) (out, in *handshakeResult, outErr, inErr error) {
+	t.Helper()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	type result struct {
+		res *handshakeResult
+		err error
+	}
+	inbound := make(chan result, 1)
+	go func() {
+		res, err := handshakeInbound(b, listener.privKey, listener)
+		if err != nil {
+			b.Close()
+		}
+		inbound <- result{res, err}
+	}()
+
+	dialer, _ := generateKey(t)
+	r, err := startResumption(a, dialer, ticket, earlyData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, outErr = r.finish(a, listener.localPeer)
+	if outErr != nil {
+		a.Close()
+	}
+	res := <-inbound
+	return out, res.res, outErr, res.err
+}
+
+func TestHandshakeResumption(t *testing.T) {
+	listener := newTestTransport(t, nil, nil)
+	_, dialerID := generateKey(t)
+	dialerPub, err := dialerID.ExtractPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, sessionSecretLen)
+	rand.Read(secret)
+	sealed, err := listener.sealTicket(secret, dialerPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := SessionTicket{Ticket: sealed, Secret: secret, PubKey: listener.privKey.GetPublic()}
+
+	out, in, outErr, inErr := resumeOverPipe(t, listener, ticket, false)
+	if outErr != nil || inErr != nil {
+		t.Fatalf("resumption failed: %v, %v", outErr, inErr)
+	}
+	if !out.resumed || !in.resumed {
+		t.Fatal("handshake wasn't resumed")
+	}
+	if out.remotePeer != listener.localPeer {
+		t.Errorf("dialer saw %s, want %s", out.remotePeer, listener.localPeer)
+	}
+	if !bytes.Equal(out.secret, in.secret) || out.earlySecret != nil || in.earlySecret != nil {
+		t.Error("stream secrets differ")
+	}
+
+	// A replayed ticket falls back to the full handshake, which the dialer
+	// finishes.
+	out, in, outErr, inErr = resumeOverPipe(t, listener, ticket, false)
+	if outErr != nil || inErr != nil {
+		t.Fatalf("fallback failed: %v, %v", outErr, inErr)
+	}
+	if out.resumed || in.resumed || !bytes.Equal(out.secret, in.secret) {
+		t.Error("replayed ticket didn't fall back to the full handshake")
+	}
+
+	// With early data, it fails instead.
+	_, _, outErr, inErr = resumeOverPipe(t, listener, ticket, true)
+	if !errors.Is(outErr, errTicketRejected) || !errors.Is(inErr, errTicketRejected) {
+		t.Errorf("replayed ticket with early data: got %v, %v", outErr, inErr)
+	}
+
+	// A ticket with a wrong secret doesn't resume.
+	forged := ticket
+	forged.Secret = make([]byte, sessionSecretLen)
+	if sealed, err = listener.sealTicket(secret, dialerPub); err != nil {
+		t.Fatal(err)
+	}
+	forged.Ticket = sealed
+	out, _, outErr, inErr = resumeOverPipe(t, listener, forged, false)
+	if outErr != nil || inErr != nil || out.resumed {
+		t.Errorf("ticket with the wrong secret: resumed %v, errors %v, %v", out != nil && out.resumed, outErr, inErr)
+	}
+}
+
+func TestTicketCache(t *testing.T) {
+	store := NewTicketCache(2)
+	now := time.Now()
+	ids := []peer.ID{"a", "b", "c"}
+	for i, id := range ids {
+		store.Put(id, SessionTicket{Ticket: []byte{byte(i)}, Expires: now.Add(time.Duration(3-i) * time.Minute)})
+	}
+	// The full cache dropped the ticket expiring first.
+	if _, ok := store.Take("b"); ok {
+		t.Error("ticket expiring first wasn't dropped")
+	}
+	if ticket, ok := store.Take("a"); !ok || ticket.Ticket[0] != 0 {
+		t.Error("ticket of a is gone")
+	}
+	if _, ok := store.Take("a"); ok {
+		t.Error("ticket taken twice")
+	}
+}
+
+// echoOnce echoes a stream the remote opens on c.
+func echoOnce(c tpt.CapableConn) {
+	str, err := c.AcceptStream()
+	if err != nil {
+		return
+	}
+	defer str.Close()
+	io.Copy(str, str)
+}
+
+func TestResumption(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Resumed", nil},
+		{"EarlyData", []Option{EnableEarlyData()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newTestTransport(t, nil, nil)
+			defer server.Close()
+			ln, serverID, accepted := listenForTest(t, server)
+			client := newTestTransport(t, nil, nil, tc.opts...)
+			defer client.Close()
+
+			for i := range 2 {
+				if i == 1 {
+					// The first connection left a ticket behind.
+					deadline := time.Now().Add(5 * time.Second)
+					for {
+						ticket, ok := client.ticketStore.Take(serverID)
+						if ok {
+							client.ticketStore.Put(serverID, ticket)
+							break
+						}
+						if time.Now().After(deadline) {
+							t.Fatal("no session ticket")
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				c, err := client.Dial(ctx, ln.Multiaddr(), serverID)
+				cancel()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				str, err := c.OpenStream(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := str.Write([]byte("ping")); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case sc := <-accepted:
+					defer sc.Close()
+					go echoOnce(sc)
+				case <-time.After(5 * time.Second):
+					t.Fatal("connection wasn't accepted")
+				}
+				str.SetReadDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(str, buf); err != nil || string(buf) != "ping" {
+					t.Fatalf("echo: %q, %v", buf, err)
+				}
+				str.Close()
+			}
+			server.usedTickets.mu.Lock()
+			used := len(server.usedTickets.nonce)
+			server.usedTickets.mu.Unlock()
+			if used != 1 {
+				t.Errorf("server resumed with %d tickets, want 1", used)
+			}
+		})
+	}
+}
+
+func TestResumptionDisabled(t *testing.T) {
+	server := newTestTransport(t, nil, nil, DisableResumption())
+	defer server.Close()
+	ln, serverID, _ := listenForTest(t, server)
+	client := newTestTransport(t, nil, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, ln.Multiaddr(), serverID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := client.ticketStore.Take(serverID); ok {
+		t.Error("listener with resumption disabled issued a ticket")
+	}
+}
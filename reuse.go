@@ -0,0 +1,217 @@
+package udxtransport
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/libp2p/go-netroute"
+	ma "github.com/multiformats/go-multiaddr"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// ListenPacketFunc opens a UDP socket on laddr, which is nil for an ephemeral
+// port. network is "udp4" or "udp6". The socket's LocalAddr must be a
+// *net.UDPAddr.
+type ListenPacketFunc func(network string, laddr *net.UDPAddr) (net.PacketConn, error)
+
+// listenUDP is the default ListenPacketFunc, opening operating system sockets.
+func listenUDP(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// udpMux holds a UDP socket and its UDX multiplexer. A listener's mux is
+// shared with the connections accepted on it and, with port reuse, the
+// connections dialed from it; it is closed once the last of them is done.
+type udpMux struct {
+	conn  net.PacketConn
+	demux *packetDemux // what mux reads from
+	mux   *udx.Multiplexer
+	laddr ma.Multiaddr
+	refs  int // guarded by Transport.mu
+
+	probing bool // path MTU probes can't be fragmented
+}
+
+// newUDPMux applies the socket options to conn and starts a multiplexer on
+// it. The caller holds the first reference.
+func (t *Transport) newUDPMux(conn net.PacketConn) (*udpMux, error) {
+	if t.readBuffer > 0 {
+		rb, ok := conn.(interface{ SetReadBuffer(int) error })
+		if !ok {
+			return nil, fmt.Errorf("setting read buffer: not supported by %T", conn)
+		}
+		if err := rb.SetReadBuffer(t.readBuffer); err != nil {
+			return nil, fmt.Errorf("setting read buffer: %w", err)
+		}
+	}
+	if t.writeBuffer > 0 {
+		wb, ok := conn.(interface{ SetWriteBuffer(int) error })
+		if !ok {
+			return nil, fmt.Errorf("setting write buffer: not supported by %T", conn)
+		}
+		if err := wb.SetWriteBuffer(t.writeBuffer); err != nil {
+			return nil, fmt.Errorf("setting write buffer: %w", err)
+		}
+	}
+	localUDP, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("socket address %v isn't a UDP address", conn.LocalAddr())
+	}
+	laddr, _ := toUDXMultiaddr(localUDP.IP.String(), localUDP.Port)
+	demux := newPacketDemux(conn, t.clock, t.tokens, t.metrics)
+	return &udpMux{
+		conn:    conn,
+		demux:   demux,
+		mux:     udx.NewMultiplexer(demux, t.clock),
+		laddr:   laddr,
+		refs:    1,
+		probing: canProbe(conn),
+	}, nil
+}
+
+func (m *udpMux) ip() net.IP {
+	return m.conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// acquireMux adds a reference to m for a connection using its socket.
+func (t *Transport) acquireMux(m *udpMux) {
+	t.mu.Lock()
+	m.refs++
+	t.mu.Unlock()
+}
+
+// releaseMux drops a reference to m, closing it with the last one.
+func (t *Transport) releaseMux(m *udpMux) {
+	t.mu.Lock()
+	m.refs--
+	last := m.refs == 0
+	t.mu.Unlock()
+	if last {
+		m.mux.Close()
+	}
+}
+
+// getOutboundMux returns the mux to dial raddr from, with a reference held
+// for the new connection. Like go-libp2p's QUIC reuse it prefers a listener
+// bound to the source IP of the route to raddr, then one bound to the
+// unspecified address, and otherwise falls back to a shared socket on an
+// ephemeral port, created lazily per address family.
+func (t *Transport) getOutboundMux(udpNetwork string, raddr *net.UDPAddr) (*udpMux, error) {
+	source := t.routeSource(raddr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, ErrTransportClosed
+	}
+
+	if m := t.reusableMuxLocked(udpNetwork, source); m != nil {
+		m.refs++
+		return m, nil
+	}
+
+	isV6 := (udpNetwork == "udp6")
+	m := t.outboundV4
+	if isV6 {
+		m = t.outboundV6
+	}
+	if m == nil {
+		// Bind ephemeral port once
+		localConn, err := t.listenPacket(udpNetwork, nil)
+		if err != nil {
+			return nil, err
+		}
+		m, err = t.newUDPMux(localConn)
+		if err != nil {
+			localConn.Close()
+			return nil, err
+		}
+		if isV6 {
+			t.outboundV6 = m
+		} else {
+			t.outboundV4 = m
+		}
+	}
+	m.refs++
+	return m, nil
+}
+
+// getListenMux returns the listener mux getOutboundMux would dial raddr
+// from, with a reference held, or nil if there is none.
+func (t *Transport) getListenMux(udpNetwork string, raddr *net.UDPAddr) *udpMux {
+	source := t.routeSource(raddr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.reusableMuxLocked(udpNetwork, source)
+	if m != nil {
+		m.refs++
+	}
+	return m
+}
+
+// routeSource returns the source IP of the route to raddr, or nil if it
+// isn't known.
+func (t *Transport) routeSource(raddr *net.UDPAddr) net.IP {
+	t.mu.Lock()
+	routes := t.routes
+	t.mu.Unlock()
+
+	if routes == nil {
+		return nil
+	}
+	if _, _, src, err := routes.Route(raddr.IP); err == nil && !src.IsUnspecified() {
+		return src
+	}
+	return nil
+}
+
+// reusableMuxLocked picks a listener mux to dial from, or nil.
+func (t *Transport) reusableMuxLocked(udpNetwork string, source net.IP) *udpMux {
+	if !t.reuseport {
+		return nil
+	}
+	var global *udpMux
+	for _, m := range t.listenMuxes {
+		ip := m.ip()
+		if (ip.To4() == nil) != (udpNetwork == "udp6") {
+			continue
+		}
+		if source != nil && ip.Equal(source) {
+			return m
+		}
+		if ip.IsUnspecified() && global == nil {
+			global = m
+		}
+	}
+	return global
+}
+
+// addListenMux makes a listener's mux available for dialing.
+func (t *Transport) addListenMux(m *udpMux) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listenMuxes = append(t.listenMuxes, m)
+	if t.reuseport {
+		// Assume the system's routes may have changed if we're adding a new
+		// listener. Ignore the error; without routes we only reuse listeners
+		// on the unspecified address.
+		t.routes, _ = netroute.New()
+	}
+}
+
+// removeListenMux stops dialing from a closed listener's mux.
+func (t *Transport) removeListenMux(m *udpMux) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, lm := range t.listenMuxes {
+		if lm == m {
+			t.listenMuxes = append(t.listenMuxes[:i], t.listenMuxes[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package udxtransport
+
+import (
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDialReusesListenPort(t *testing.T) {
+	serverKey, serverID := generateKey(t)
+	clientKey, _ := generateKey(t)
+
+	serverTr, err := NewTransport(serverKey, createUpgrader(t, serverKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTr, err := NewTransport(clientKey, createUpgrader(t, clientKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientLn, err := clientTr.Listen(ma.StringCast("/ip4/0.0.0.0/udp/0/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientLn.Close()
+
+	c := testListenAndDial(t, serverTr, serverID, clientTr)
+	if !c.LocalMultiaddr().Equal(clientLn.Multiaddr()) {
+		t.Fatalf("dialed from %s, want listen address %s", c.LocalMultiaddr(), clientLn.Multiaddr())
+	}
+}
+
+func TestDialDisableReuseport(t *testing.T) {
+	serverKey, serverID := generateKey(t)
+	clientKey, _ := generateKey(t)
+
+	serverTr, err := NewTransport(serverKey, createUpgrader(t, serverKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTr, err := NewTransport(clientKey, createUpgrader(t, clientKey), nil, DisableReuseport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientTr.Close()
+
+	clientLn, err := clientTr.Listen(ma.StringCast("/ip4/0.0.0.0/udp/0/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientLn.Close()
+
+	c := testListenAndDial(t, serverTr, serverID, clientTr)
+	if c.LocalMultiaddr().Equal(clientLn.Multiaddr()) {
+		t.Fatalf("dialed from the listen address %s with port reuse disabled", c.LocalMultiaddr())
+	}
+}
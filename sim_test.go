@@ -0,0 +1,75 @@
+package udxtransport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxsim"
+)
+
+// simPeers returns a listener on host 10.0.0.2 and a transport on host
+// 10.0.0.1 of network n.
+func simPeers(t *testing.T, n *udxsim.Network) (client *Transport, ln ma.Multiaddr, server *Transport) {
+	t.Helper()
+	server = newTestTransport(t, nil, nil, WithListenPacket(n.Host(net.IPv4(10, 0, 0, 2)).ListenPacket))
+	l, err := server.Listen(ma.StringCast("/ip4/10.0.0.2/udp/4001/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	client = newTestTransport(t, nil, nil, WithListenPacket(n.Host(net.IPv4(10, 0, 0, 1)).ListenPacket))
+	t.Cleanup(func() { client.Close() })
+	return client, l.Multiaddr(), server
+}
+
+func TestSimulatedNetwork(t *testing.T) {
+	n := udxsim.NewNetwork(1, udxsim.Link{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.2})
+	defer n.Close()
+	client, addr, server := simPeers(t, n)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	c, err := client.Dial(ctx, addr, server.localPeer)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer c.Close()
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("dial took %s over a link with a 20ms RTT", d)
+	}
+	if c.RemotePeer() != server.localPeer {
+		t.Fatal("remote peer mismatch")
+	}
+	if n.Counters().Sent == 0 {
+		t.Fatal("nothing went over the simulated network")
+	}
+}
+
+func TestSimulatedNetworkPartition(t *testing.T) {
+	n := udxsim.NewNetwork(1, udxsim.Link{Loss: 1})
+	defer n.Close()
+	client, addr, server := simPeers(t, n)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if c, err := client.Dial(ctx, addr, server.localPeer); err == nil {
+		c.Close()
+		t.Fatal("expected the dial to fail")
+	}
+	if c := n.Counters(); c.Delivered != 0 || c.Lost == 0 {
+		t.Fatalf("unexpected counters %+v", c)
+	}
+}
@@ -0,0 +1,168 @@
+package udxtransport
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// LinkStats is a snapshot of the loss recovery and congestion control state
+// of the UDX connection under a libp2p connection. The window, smoothed RTT
+// and bytes in flight come from the congestion controller the transport
+// runs for the connection, or from go-udx if it runs its own. The RTT
+// variance and the packet counters always come from go-udx. Whatever go-udx
+// doesn't expose is 0.
+type LinkStats struct {
+	SmoothedRTT          time.Duration // 0 until the first acknowledgement
+	RTTVar               time.Duration
+	CongestionWindow     int // bytes
+	BytesInFlight        int // bytes sent but not yet acknowledged
+	PacketsLost          uint64
+	PacketsRetransmitted uint64
+	MTU                  int // current path MTU in bytes, as PathMTU reports it
+	// CongestionControl names the algorithm set with WithCongestionControl;
+	// it is empty if go-udx runs its own.
+	CongestionControl string
+}
+
+// StatsConn is implemented by the connections Dial and Accept return, natively
+// multiplexed or upgraded. Behind the swarm, get it with As:
+//
+//	var sc udxtransport.StatsConn
+//	if conn.As(&sc) {
+//		stats := sc.LinkStats()
+//	}
+type StatsConn interface {
+	// LinkStats returns the current state of the UDX connection.
+	LinkStats() LinkStats
+	// PathMTU returns the path MTU in bytes of UDP payload the connection's
+	// packets are sized to: on native connections the one path MTU
+	// discovery found, which doesn't need go-udx to expose its state.
+	// Connections through the Upgrader don't run discovery, and report
+	// UDX's own MTU, or the initial one.
+	PathMTU() int
+}
+
+// udxStats is implemented by udx.Connection when it exposes the state of its
+// loss recovery and congestion control.
+type udxStats interface {
+	SmoothedRTT() time.Duration
+	RTTVar() time.Duration
+	CongestionWindow() int
+	BytesInFlight() int
+	PacketsLost() uint64
+	PacketsRetransmitted() uint64
+	MTU() int
+}
+
+// linkStatsOf reads the stats of c, if its go-udx exposes them.
+func linkStatsOf(c *udx.Connection) (LinkStats, bool) {
+	s, ok := any(c).(udxStats)
+	if !ok {
+		return LinkStats{}, false
+	}
+	return LinkStats{
+		SmoothedRTT:          s.SmoothedRTT(),
+		RTTVar:               s.RTTVar(),
+		CongestionWindow:     s.CongestionWindow(),
+		BytesInFlight:        s.BytesInFlight(),
+		PacketsLost:          s.PacketsLost(),
+		PacketsRetransmitted: s.PacketsRetransmitted(),
+		MTU:                  s.MTU(),
+	}, true
+}
+
+// linkStats returns the stats of the path's connection, all but its MTU.
+func (p *connPath) linkStats() LinkStats {
+	s, _ := linkStatsOf(p.udxConn)
+	s.MTU = 0
+	if p.cc == nil {
+		return s
+	}
+	s.SmoothedRTT = time.Duration(p.cc.srtt.Load())
+	s.CongestionWindow = int(p.cc.cwnd.Load())
+	s.BytesInFlight = int(p.cc.inFlight.Load())
+	s.CongestionControl = p.transport.congestion.Name
+	return s
+}
+
+// streamConnKey is the key under which stream 0 is passed to the upgrader in
+// ConnStats.Extra. The upgrader hands the stats on to the upgraded
+// connection, which is how the listener finds the UDX connection under it.
+type streamConnKey struct{}
+
+// upgradedConn is a connection set up by the upgrader, with access to the
+// stream 0 under it.
+type upgradedConn struct {
+	tpt.CapableConn
+	raw *streamConn
+}
+
+var _ StatsConn = (*upgradedConn)(nil)
+
+// wrapUpgraded wraps a connection from the upgrader. It returns c as it is if
+// it doesn't run on a streamConn.
+func wrapUpgraded(c tpt.CapableConn) tpt.CapableConn {
+	cs, ok := c.(network.ConnStat)
+	if !ok {
+		return c
+	}
+	sc, ok := cs.Stat().Extra[streamConnKey{}].(*streamConn)
+	if !ok {
+		return c
+	}
+	return &upgradedConn{CapableConn: c, raw: sc}
+}
+
+func (c *upgradedConn) Close() error {
+	c.raw.transport.removeConn(c)
+	return c.CapableConn.Close()
+}
+
+func (c *upgradedConn) CloseWithError(errCode network.ConnErrorCode) error {
+	c.raw.transport.removeConn(c)
+	return c.CapableConn.CloseWithError(errCode)
+}
+
+func (c *upgradedConn) LinkStats() LinkStats {
+	s := c.raw.path.linkStats()
+	s.MTU = c.PathMTU()
+	return s
+}
+
+// PathMTU returns UDX's MTU, or the initial MTU if its state isn't exposed.
+// Upgraded connections don't run path MTU discovery: their streams are
+// secured by the Upgrader, so they have no keys to seal probes with.
+func (c *upgradedConn) PathMTU() int {
+	if s, ok := linkStatsOf(c.raw.connection); ok {
+		return s.MTU
+	}
+	return c.raw.transport.initialMTU
+}
+
+func (c *upgradedConn) As(target any) bool {
+	switch t := target.(type) {
+	case **udx.Connection:
+		*t = c.raw.connection
+		return true
+	case *StatsConn:
+		*t = c
+		return true
+	}
+	return c.CapableConn.As(target)
+}
+
+// Stat passes on the upgrader's stats, which the swarm reads.
+func (c *upgradedConn) Stat() network.ConnStats {
+	if cs, ok := c.CapableConn.(network.ConnStat); ok {
+		return cs.Stat()
+	}
+	return network.ConnStats{}
+}
+
+func (c *upgradedConn) String() string {
+	return fmt.Sprint(c.CapableConn)
+}
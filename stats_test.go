@@ -0,0 +1,59 @@
+package udxtransport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+)
+
+func TestLinkStats(t *testing.T) {
+	for _, native := range []bool{true, false} {
+		var opts []Option
+		if !native {
+			opts = append(opts, DisableNativeMultiplexing())
+		}
+		ln, serverID, accepted := listenForTest(t, newTestTransport(t, nil, nil, opts...))
+		dialed, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second, opts...)
+		if err != nil {
+			t.Fatalf("native=%t: dial: %v", native, err)
+		}
+		var acceptedConn tpt.CapableConn
+		select {
+		case acceptedConn = <-accepted:
+			defer acceptedConn.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("native=%t: connection wasn't accepted", native)
+		}
+
+		for _, c := range []tpt.CapableConn{dialed, acceptedConn} {
+			if _, ok := c.(StatsConn); !ok {
+				t.Errorf("native=%t: %T doesn't implement StatsConn", native, c)
+			}
+			var sc StatsConn
+			if !c.As(&sc) {
+				t.Fatalf("native=%t: As(*StatsConn) failed", native)
+			}
+			if mtu := sc.PathMTU(); mtu < baseMTU {
+				t.Errorf("native=%t: path MTU %d", native, mtu)
+			}
+			// The handshake's packets are acknowledged shortly.
+			stats := sc.LinkStats()
+			for deadline := time.Now().Add(5 * time.Second); stats.SmoothedRTT == 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+				stats = sc.LinkStats()
+			}
+			if stats.SmoothedRTT <= 0 || stats.MTU <= 0 || stats.CongestionWindow <= 0 {
+				t.Errorf("native=%t: unexpected stats %+v", native, stats)
+			}
+		}
+
+		if !native {
+			// The swarm still sees the upgrader's stats.
+			if _, ok := dialed.(network.ConnStat); !ok {
+				t.Error("upgraded connection lost its Stat method")
+			}
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package udxtransport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// Frame types on a native stream. Every frame is sealed with the writer's
+// session key, using the stream ID and the frame's sequence number as the
+// nonce, so frames can't be replayed, reordered or moved between streams.
+const (
+	frameData     byte = iota // payload is application data
+	frameFin                  // sender won't write any more data
+	frameReset                // sender abandoned the stream; payload is a 4-byte error code
+	frameClose                // on stream 0 only: sender is closing the connection; payload is a 4-byte error code
+	frameReceiver             // on stream 0 only: payload is the sender's 8-byte receiver ID for transport packets and the 2-byte size of the largest datagram it takes
+	frameTicket               // on stream 0 only, from the listener: payload is a session ticket's 4-byte lifetime in seconds, resumption secret and ticket
+)
+
+const (
+	streamIDLen     = 8 // cleartext stream ID written by the opener
+	frameLenSize    = 2 // big-endian length prefix of a sealed frame
+	maxFramePayload = 16 << 10
+	resetTimeout    = time.Second // how long Reset tries to deliver the reset frame
+)
+
+var (
+	errStreamProtocol = errors.New("native stream protocol violation")
+	errReadClosed     = errors.New("stream closed for reading")
+	errWriteClosed    = errors.New("stream closed for writing")
+)
+
+// stream is a network.MuxedStream carried on its own udx.Stream, so a lost
+// packet only stalls the libp2p stream it belongs to.
+type stream struct {
+	str      *udx.Stream
+	conn     *conn
+	accepted bool // opened by the remote; the ID arrives in a header
+
+	idOnce    sync.Once
+	id        uint64
+	idErr     error
+	traceOnce sync.Once // the stream_closed event
+	doneOnce  sync.Once // telling the connection the stream is done
+
+	mu          sync.Mutex // guards the state below
+	readClosed  bool
+	writeClosed bool
+	remoteFin   bool
+	resetErr    error
+
+	rmu   sync.Mutex // serializes readers
+	rbuf  []byte     // sealed bytes read from str but not yet opened
+	plain []byte     // opened payload not yet returned to the reader
+	rseq  uint32
+
+	wmu  sync.Mutex // serializes writers
+	wbuf []byte
+	wseq uint32
+}
+
+var _ network.MuxedStream = (*stream)(nil)
+
+// streamID returns the stream's ID. For accepted streams it is read from the
+// opener's header on first use, so AcceptStream never blocks on one peer.
+func (s *stream) streamID() (uint64, error) {
+	s.idOnce.Do(func() {
+		if s.accepted {
+			s.id, s.idErr = s.conn.readStreamHeader(s.str)
+			if s.idErr == nil {
+				s.conn.trace.event(udxtrace.StreamOpened, map[string]any{"stream_id": s.id, "initiator": "remote"})
+			}
+		}
+	})
+	return s.id, s.idErr
+}
+
+func (s *stream) nonce(seq uint32) []byte {
+	var n [12]byte
+	binary.BigEndian.PutUint64(n[:8], s.id)
+	binary.BigEndian.PutUint32(n[8:], seq)
+	return n[:]
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	if _, err := s.streamID(); err != nil {
+		return 0, err
+	}
+
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for {
+		s.mu.Lock()
+		resetErr, readClosed, remoteFin := s.resetErr, s.readClosed, s.remoteFin
+		s.mu.Unlock()
+
+		switch {
+		case resetErr != nil:
+			return 0, resetErr
+		case readClosed:
+			return 0, errReadClosed
+		case len(s.plain) > 0:
+			n := copy(p, s.plain)
+			s.plain = s.plain[n:]
+			return n, nil
+		case remoteFin:
+			return 0, io.EOF
+		}
+
+		typ, payload, err := s.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case frameData:
+			s.plain = payload
+		case frameFin:
+			s.mu.Lock()
+			s.remoteFin = true
+			s.mu.Unlock()
+		case frameReset:
+			if err := s.remoteReset(payload); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, errStreamProtocol
+		}
+	}
+}
+
+// remoteReset records the remote's reset frame.
+func (s *stream) remoteReset(payload []byte) error {
+	if len(payload) != 4 {
+		return errStreamProtocol
+	}
+	code := network.StreamErrorCode(binary.BigEndian.Uint32(payload))
+	s.mu.Lock()
+	if s.resetErr == nil {
+		s.resetErr = &network.StreamError{ErrorCode: code, Remote: true}
+	}
+	s.mu.Unlock()
+	// The remote abandoned the stream, so a drain needn't wait for it to be
+	// closed here.
+	s.done()
+	return nil
+}
+
+// readFrame reads and opens the next frame. A partially received frame is
+// kept across calls, so a Read that hits its deadline can be retried.
+func (s *stream) readFrame() (byte, []byte, error) {
+	remote := s.conn.keys.waitRemote(s.conn.done)
+	if remote == nil {
+		return 0, nil, s.conn.streamErr(net.ErrClosed)
+	}
+	var buf [4096]byte
+	for {
+		if len(s.rbuf) >= frameLenSize {
+			n := int(binary.BigEndian.Uint16(s.rbuf))
+			if n < 1+remote.Overhead() {
+				return 0, nil, errStreamProtocol
+			}
+			if len(s.rbuf) >= frameLenSize+n {
+				sealed := s.rbuf[frameLenSize : frameLenSize+n]
+				s.rbuf = s.rbuf[frameLenSize+n:]
+				plain, err := remote.Open(sealed[:0], s.nonce(s.rseq), sealed, nil)
+				if err != nil {
+					return 0, nil, errStreamProtocol
+				}
+				s.rseq++
+				return plain[0], plain[1:], nil
+			}
+		}
+
+		n, err := s.str.Read(buf[:])
+		s.rbuf = append(s.rbuf, buf[:n]...)
+		if m := s.conn.transport.metrics; m != nil {
+			m.BytesReceived(n)
+		}
+		if err != nil && n == 0 {
+			if err == io.EOF {
+				// The remote closes its udx.Stream only after a fin or
+				// reset frame, so a bare EOF means the stream was torn down.
+				return 0, nil, s.conn.streamErr(network.ErrReset)
+			}
+			return 0, nil, s.conn.streamErr(err)
+		}
+	}
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	if _, err := s.streamID(); err != nil {
+		return 0, err
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		resetErr, writeClosed := s.resetErr, s.writeClosed
+		s.mu.Unlock()
+		if resetErr != nil {
+			return written, resetErr
+		}
+		if writeClosed {
+			return written, errWriteClosed
+		}
+
+		chunk := p[:min(len(p), maxFramePayload)]
+		if err := s.writeFrame(frameData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame seals and writes a single frame. The caller holds wmu.
+func (s *stream) writeFrame(typ byte, payload []byte) error {
+	if s.wseq == math.MaxUint32 {
+		return errStreamProtocol
+	}
+	aead := s.conn.keys.local
+	size := frameLenSize + 1 + len(payload) + aead.Overhead()
+	if cap(s.wbuf) < size {
+		s.wbuf = make([]byte, size)
+	}
+	frame := s.wbuf[:size]
+	binary.BigEndian.PutUint16(frame, uint16(size-frameLenSize))
+	frame[frameLenSize] = typ
+	copy(frame[frameLenSize+1:], payload)
+	plain := frame[frameLenSize : frameLenSize+1+len(payload)]
+	aead.Seal(plain[:0], s.nonce(s.wseq), plain, nil)
+	s.wseq++
+
+	n, err := s.str.Write(frame)
+	if m := s.conn.transport.metrics; m != nil {
+		m.BytesSent(n)
+	}
+	if err != nil {
+		return s.conn.streamErr(err)
+	}
+	return nil
+}
+
+// CloseWrite sends a fin frame; the remote reads io.EOF once it has
+// consumed everything written before it.
+func (s *stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.writeClosed || s.resetErr != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	s.mu.Unlock()
+
+	if _, err := s.streamID(); err != nil {
+		return err
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.writeFrame(frameFin, nil)
+}
+
+// CloseRead discards anything the remote sends from now on. Its frames are
+// read and dropped in the background until it finishes or resets the
+// stream, so its writes don't stall waiting for a reader.
+func (s *stream) CloseRead() error {
+	if s.closeRead() {
+		go s.discard()
+	}
+	return nil
+}
+
+// closeRead closes the stream for reading, reporting whether the remote may
+// still send on it.
+func (s *stream) closeRead() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readClosed {
+		return false
+	}
+	s.readClosed = true
+	return !s.remoteFin && s.resetErr == nil
+}
+
+// discard reads and drops frames until the remote's fin or reset frame, or
+// until the stream fails.
+func (s *stream) discard() {
+	if _, err := s.streamID(); err != nil {
+		return
+	}
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	s.plain = nil
+	for {
+		typ, payload, err := s.readFrame()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameData:
+		case frameReset:
+			s.remoteReset(payload)
+			return
+		default: // a fin, or a protocol violation
+			return
+		}
+	}
+}
+
+func (s *stream) Close() error {
+	err := s.CloseWrite()
+	s.closeRead()
+	s.str.Close()
+	s.traceClosed(nil)
+	s.done()
+	return err
+}
+
+// done tells the connection the stream is finished, once.
+func (s *stream) done() {
+	s.doneOnce.Do(s.conn.streamDone)
+}
+
+// traceClosed records the end of the stream, once.
+func (s *stream) traceClosed(data map[string]any) {
+	if s.conn.trace == nil {
+		return
+	}
+	s.traceOnce.Do(func() {
+		// Close and Reset have read the ID by now, so this doesn't block
+		id, err := s.streamID()
+		if err != nil {
+			return
+		}
+		if data == nil {
+			data = make(map[string]any)
+		}
+		data["stream_id"] = id
+		s.conn.trace.event(udxtrace.StreamClosed, data)
+	})
+}
+
+func (s *stream) Reset() error {
+	return s.ResetWithError(0)
+}
+
+// ResetWithError abandons the stream in both directions and tells the
+// remote why. Pending reads and writes are unblocked first.
+func (s *stream) ResetWithError(errCode network.StreamErrorCode) error {
+	s.mu.Lock()
+	if s.resetErr != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.resetErr = &network.StreamError{ErrorCode: errCode}
+	s.mu.Unlock()
+
+	now := s.conn.transport.clock.Now()
+	s.str.SetReadDeadline(now)
+	s.str.SetWriteDeadline(now)
+
+	s.wmu.Lock()
+	if _, err := s.streamID(); err == nil {
+		var code [4]byte
+		binary.BigEndian.PutUint32(code[:], uint32(errCode))
+		s.str.SetWriteDeadline(now.Add(resetTimeout))
+		s.writeFrame(frameReset, code[:])
+	}
+	s.wmu.Unlock()
+
+	s.traceClosed(map[string]any{"reset": true, "error_code": uint32(errCode)})
+	s.done()
+	return s.str.Close()
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	if err := s.str.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.str.SetWriteDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	return s.str.SetReadDeadline(t)
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	return s.str.SetWriteDeadline(t)
+}
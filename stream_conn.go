@@ -2,29 +2,84 @@ package udxtransport
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/network"
 	ma "github.com/multiformats/go-multiaddr"
 	udx "github.com/stephanfeb/go-udx"
 )
 
 // streamConn wraps a UDX stream (stream 0) as a net.Conn with multiaddr info.
-// This is passed to the go-libp2p upgrader which layers Noise + Yamux on top.
+// On the upgrader path it is passed to the go-libp2p upgrader, which layers
+// Noise + Yamux on top; on the native path it carries the handshake.
 type streamConn struct {
-	stream      *udx.Stream
-	connection  *udx.Connection
-	localMaddr  ma.Multiaddr
-	remoteMaddr ma.Multiaddr
+	stream     *udx.Stream
+	connection *udx.Connection
+	transport  *Transport
+	mux        *udpMux // socket the connection runs on; released on Close
+	trace      *connTrace
+	path       *connPath // remote address, which changes if the connection migrates
+	localMaddr ma.Multiaddr
+	preread    []byte // bytes peeked by the listener, returned before the stream's
+
+	// watchRefusal is set on dialed connections handed to the upgrader: the
+	// first byte read is checked for a listener's refusal.
+	watchRefusal bool
+	refused      atomic.Bool
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // net.Conn interface
 
-func (sc *streamConn) Read(p []byte) (int, error)  { return sc.stream.Read(p) }
-func (sc *streamConn) Write(p []byte) (int, error) { return sc.stream.Write(p) }
+func (sc *streamConn) Read(p []byte) (int, error) {
+	if len(sc.preread) > 0 {
+		n := copy(p, sc.preread)
+		sc.preread = sc.preread[n:]
+		return n, nil
+	}
+	n, err := sc.stream.Read(p)
+	if m := sc.transport.metrics; m != nil {
+		m.BytesReceived(n)
+	}
+	if sc.watchRefusal && n > 0 {
+		sc.watchRefusal = false
+		if p[0] == refusalMsg[0] {
+			sc.refused.Store(true)
+			return 0, ErrConnRefused
+		}
+	}
+	return n, err
+}
+
+func (sc *streamConn) Write(p []byte) (int, error) {
+	n, err := sc.stream.Write(p)
+	if m := sc.transport.metrics; m != nil {
+		m.BytesSent(n)
+	}
+	return n, err
+}
 
 func (sc *streamConn) Close() error {
-	sc.stream.Close()
-	return sc.connection.Close()
+	sc.closeOnce.Do(func() {
+		sc.stream.Close()
+		sc.closeErr = sc.connection.Close()
+		sc.path.close()
+		sc.transport.releaseMux(sc.mux)
+		if m := sc.transport.metrics; m != nil {
+			m.ConnClosed(sc.connection, sc.localMaddr)
+		}
+		sc.trace.close()
+	})
+	return sc.closeErr
+}
+
+// Stat passes sc on to the connection the upgrader makes of it.
+func (sc *streamConn) Stat() network.ConnStats {
+	return network.ConnStats{Stats: network.Stats{Extra: map[any]any{streamConnKey{}: sc}}}
 }
 
 func (sc *streamConn) LocalAddr() net.Addr  { return sc.connection.LocalAddr() }
@@ -48,4 +103,4 @@ func (sc *streamConn) SetWriteDeadline(t time.Time) error {
 // manet.Conn interface (multiaddr-aware net.Conn)
 
 func (sc *streamConn) LocalMultiaddr() ma.Multiaddr  { return sc.localMaddr }
-func (sc *streamConn) RemoteMultiaddr() ma.Multiaddr { return sc.remoteMaddr }
+func (sc *streamConn) RemoteMultiaddr() ma.Multiaddr { return sc.path.remoteMultiaddr() }
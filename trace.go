@@ -0,0 +1,174 @@
+package udxtransport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// traceStatsInterval is how often a traced connection's link stats are
+// checked for changes.
+const traceStatsInterval = 50 * time.Millisecond
+
+// packetHooker is implemented by udx.Connection when it reports individual
+// packets to a hook, with kind "sent", "received" or "acked". Without it,
+// traces have no packet events.
+type packetHooker interface {
+	SetPacketHook(hook func(kind string, seq uint32, size int))
+}
+
+// connTrace writes the event trace of one connection to a file in the
+// directory given with WithTraceDir. Its methods do nothing on a nil
+// *connTrace, which is what connections get when tracing is off.
+type connTrace struct {
+	udxConn *udx.Connection
+	clock   Clock
+	start   time.Time
+	stop    chan struct{}
+	done    chan struct{} // closed when the stats poller returns
+
+	closeOnce sync.Once
+	mu        sync.Mutex
+	f         *os.File
+	enc       *json.Encoder
+	closed    bool
+}
+
+// newConnTrace starts the trace of udxConn in dir, with role "client" or
+// "server". Tracing is best-effort: if the file can't be created, the
+// connection goes untraced.
+func newConnTrace(dir, role string, clock Clock, udxConn *udx.Connection, local, remote ma.Multiaddr) *connTrace {
+	if dir == "" {
+		return nil
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	start := clock.Now()
+	name := fmt.Sprintf("%d_%s_%s%s", start.UnixNano(), role, hex.EncodeToString(id[:]), udxtrace.FileExt)
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil
+	}
+
+	ct := &connTrace{
+		udxConn: udxConn,
+		clock:   clock,
+		start:   start,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		f:       f,
+		enc:     json.NewEncoder(f),
+	}
+	ct.enc.Encode(udxtrace.Header{
+		Format:        "NDJSON",
+		Title:         "libp2p-udx",
+		VantagePoint:  udxtrace.VantagePoint{Type: role},
+		ReferenceTime: float64(start.UnixMicro()) / 1000,
+	})
+	ct.event(udxtrace.ConnectionStarted, map[string]any{
+		"local":  local.String(),
+		"remote": remote.String(),
+	})
+
+	if ph, ok := any(udxConn).(packetHooker); ok {
+		ph.SetPacketHook(ct.packet)
+	}
+	if _, ok := linkStatsOf(udxConn); ok {
+		go ct.pollStats()
+	} else {
+		close(ct.done)
+	}
+	return ct
+}
+
+// event appends an event to the trace.
+func (ct *connTrace) event(name string, data map[string]any) {
+	if ct == nil {
+		return
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.closed {
+		return
+	}
+	ct.enc.Encode(udxtrace.Event{
+		Time: float64(ct.clock.Now().Sub(ct.start).Microseconds()) / 1000,
+		Name: name,
+		Data: data,
+	})
+}
+
+func (ct *connTrace) packet(kind string, seq uint32, size int) {
+	data := map[string]any{"packet_number": seq, "size": size}
+	switch kind {
+	case "sent":
+		ct.event(udxtrace.PacketSent, data)
+	case "received":
+		ct.event(udxtrace.PacketReceived, data)
+	case "acked":
+		ct.event(udxtrace.PacketsAcked, map[string]any{"packet_number": seq})
+	}
+}
+
+// pollStats records changes to the link stats as metrics_updated events, and
+// increases of the loss count as packet_lost events. It only runs if go-udx
+// exposes the stats.
+func (ct *connTrace) pollStats() {
+	defer close(ct.done)
+	ticker := newTicker(ct.clock, traceStatsInterval)
+	defer ticker.Stop()
+
+	var last LinkStats
+	for first := true; ; first = false {
+		s, _ := linkStatsOf(ct.udxConn)
+		if s.PacketsLost > last.PacketsLost {
+			ct.event(udxtrace.PacketLost, map[string]any{"count": s.PacketsLost - last.PacketsLost})
+		}
+		if first || s.SmoothedRTT != last.SmoothedRTT || s.RTTVar != last.RTTVar ||
+			s.CongestionWindow != last.CongestionWindow || s.BytesInFlight != last.BytesInFlight || s.MTU != last.MTU {
+			ct.event(udxtrace.MetricsUpdated, map[string]any{
+				"smoothed_rtt":      float64(s.SmoothedRTT.Microseconds()) / 1000,
+				"rtt_variance":      float64(s.RTTVar.Microseconds()) / 1000,
+				"congestion_window": s.CongestionWindow,
+				"bytes_in_flight":   s.BytesInFlight,
+				"mtu":               s.MTU,
+			})
+		}
+		last = s
+
+		select {
+		case <-ticker.C:
+		case <-ct.stop:
+			return
+		}
+	}
+}
+
+// close ends the trace with a connection_closed event.
+func (ct *connTrace) close() {
+	if ct == nil {
+		return
+	}
+	ct.closeOnce.Do(func() {
+		if ph, ok := any(ct.udxConn).(packetHooker); ok {
+			ph.SetPacketHook(nil)
+		}
+		close(ct.stop)
+		<-ct.done
+		ct.event(udxtrace.ConnectionClosed, nil)
+
+		ct.mu.Lock()
+		defer ct.mu.Unlock()
+		ct.closed = true
+		ct.f.Close()
+	})
+}
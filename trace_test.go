@@ -0,0 +1,76 @@
+package udxtransport
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
+	udx "github.com/stephanfeb/go-udx"
+)
+
+func TestTrace(t *testing.T) {
+	dir := t.TempDir()
+	ln, serverID, accepted := listenForTest(t, newTestTransport(t, nil, nil, WithTraceDir(dir)))
+	c, err := dialForTest(t, ln.Multiaddr(), serverID, 5*time.Second, WithTraceDir(dir))
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	sc := <-accepted
+
+	str, err := c.OpenStream(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	str.Close()
+	sstr, err := sc.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(sstr); err != nil {
+		t.Fatal(err)
+	}
+	sstr.Close()
+	c.Close()
+	sc.Close()
+
+	traces, err := udxtrace.LoadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces, got %d", len(traces))
+	}
+	_, exposesStats := any((*udx.Connection)(nil)).(udxStats)
+	_, hooksPackets := any((*udx.Connection)(nil)).(packetHooker)
+	roles := make(map[string]bool)
+	for _, tr := range traces {
+		s := tr.Summarize()
+		roles[s.VantagePoint] = true
+		if s.Events[udxtrace.ConnectionStarted] != 1 || !s.Closed {
+			t.Errorf("%s: connection not started and closed once: %v", s.VantagePoint, s.Events)
+		}
+		if s.HandshakeError != "" || s.Events[udxtrace.HandshakeCompleted] != 1 {
+			t.Errorf("%s: handshake didn't complete: %s", s.VantagePoint, s)
+		}
+		if s.StreamsOpened != 1 || s.Events[udxtrace.StreamClosed] != 1 {
+			t.Errorf("%s: expected one stream opened and closed: %v", s.VantagePoint, s.Events)
+		}
+		if !hooksPackets {
+			t.Logf("%s: go-udx doesn't report packets, so no packet events", s.VantagePoint)
+		} else if s.PacketsSent == 0 || s.PacketsReceived == 0 {
+			t.Errorf("%s: no packets traced: %s", s.VantagePoint, s)
+		}
+		if !exposesStats {
+			t.Logf("%s: go-udx doesn't expose link stats, so no metrics_updated events", s.VantagePoint)
+		} else if len(tr.Filter(udxtrace.MetricsUpdated)) == 0 {
+			t.Errorf("%s: no metrics_updated events", s.VantagePoint)
+		}
+	}
+	if !roles["client"] || !roles["server"] {
+		t.Errorf("expected a client and a server trace, got %v", roles)
+	}
+}
@@ -2,41 +2,87 @@ package udxtransport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/libp2p/go-libp2p/core/connmgr"
 	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	tpt "github.com/libp2p/go-libp2p/core/transport"
+	"github.com/libp2p/go-netroute"
 	ma "github.com/multiformats/go-multiaddr"
-	udx "github.com/stephanfeb/go-udx"
+	madns "github.com/multiformats/go-multiaddr-dns"
+	"github.com/stephanfeb/go-libp2p-udx-transport/udxtrace"
 )
 
-// outboundMux holds a shared UDP socket and multiplexer for outbound connections.
-type outboundMux struct {
-	conn *net.UDPConn
-	mux  *udx.Multiplexer
-}
-
 // Transport implements the go-libp2p Transport interface using UDX.
 type Transport struct {
 	privKey   ic.PrivKey
 	localPeer peer.ID
 	upgrader  tpt.Upgrader
+	gater     connmgr.ConnectionGater // nil unless WithConnectionGater is given
 	rcmgr     network.ResourceManager
-
-	mu         sync.Mutex
-	outboundV4 *outboundMux // lazily created on first IPv4 dial
-	outboundV6 *outboundMux // lazily created on first IPv6 dial
+	native    bool // offer native multiplexing when dialing, accept it when listening
+	reuseport bool // dial from listener sockets when one fits
+	datagrams bool // announce datagram support on native connections
+
+	validation AddressValidation // when listeners validate new sources
+	tokens     *tokenKeys        // address validation tokens; their secrets also seal session tickets
+
+	resumption  bool        // issue session tickets on native connections, and resume with them
+	earlyData   bool        // don't wait for the listener's answer to a resumption
+	ticketStore TicketStore // session tickets to resume with
+	usedTickets usedTickets // tickets resumed with, refused a second time
+
+	clock                   Clock
+	listenPacket            ListenPacketFunc
+	resolver                *madns.Resolver
+	readBuffer, writeBuffer int // UDP socket buffer sizes; 0 keeps the system default
+	handshakeTimeout        time.Duration
+	stream0Timeout          time.Duration     // limit on an inbound connection opening stream 0
+	maxHalfOpen             int               // inbound connections being set up, per listener
+	idleTimeout, keepAlive  time.Duration     // 0 disables either
+	idleSet, keepAliveSet   bool              // whether WithIdleTimeout, WithKeepAlive were given
+	minMTU, initialMTU      int               // bytes of UDP payload
+	maxMTU                  int               // path MTU discovery is off if it equals minMTU
+	congestion              CongestionControl // NewReno unless WithCongestionControl is given
+	congestionSet           bool              // whether WithCongestionControl was given
+	pacing                  bool
+	metrics                 MetricsTracer // nil unless WithMetricsTracer is given
+	traceDir                string        // where connection traces go; empty if off
+	migrations              event.Emitter // emits EvtConnMigrated; nil unless WithEventBus is given
+
+	mu          sync.Mutex
+	outboundV4  *udpMux               // lazily created on first IPv4 dial without a reusable listener
+	outboundV6  *udpMux               // lazily created on first IPv6 dial without a reusable listener
+	listenMuxes []*udpMux             // sockets of open listeners, for port reuse
+	routes      netroute.Router       // picks the listener to dial from; nil if unavailable
+	legacyPeers map[peer.ID]time.Time // peers that only speak the upgrader path
+	nativePeers map[peer.ID]time.Time // peers that completed the native handshake
+	listeners   map[*listener]struct{}
+	conns       map[liveConn]*rawListener // connections handed out, with the listener that accepted them
+	closed      bool
+
+	holePunchingMx sync.Mutex
+	holePunching   map[holePunchKey]*activeHolePunch
 }
 
 var _ tpt.Transport = (*Transport)(nil)
 
+// ErrTransportClosed is returned by Dial and Listen once the transport is
+// closed.
+var ErrTransportClosed = errors.New("transport closed")
+
 // NewTransport creates a new UDX transport with the given upgrader.
-// The upgrader handles security (Noise) and stream muxing (Yamux).
-func NewTransport(key ic.PrivKey, u tpt.Upgrader, rcmgr network.ResourceManager) (*Transport, error) {
+// Connections between peers that both support it use native UDX stream
+// multiplexing; otherwise the upgrader handles security (Noise) and stream
+// muxing (Yamux) on stream 0.
+func NewTransport(key ic.PrivKey, u tpt.Upgrader, rcmgr network.ResourceManager, opts ...Option) (*Transport, error) {
 	localPeer, err := peer.IDFromPrivateKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("deriving peer ID: %w", err)
@@ -46,52 +92,77 @@ func NewTransport(key ic.PrivKey, u tpt.Upgrader, rcmgr network.ResourceManager)
 		rcmgr = &network.NullResourceManager{}
 	}
 
-	return &Transport{
-		privKey:   key,
-		localPeer: localPeer,
-		upgrader:  u,
-		rcmgr:     rcmgr,
-	}, nil
+	t := &Transport{
+		privKey:     key,
+		localPeer:   localPeer,
+		upgrader:    u,
+		rcmgr:       rcmgr,
+		native:      true,
+		reuseport:   true,
+		resumption:  true,
+		congestion:  NewReno,
+		pacing:      true,
+		legacyPeers: make(map[peer.ID]time.Time),
+		nativePeers: make(map[peer.ID]time.Time),
+		listeners:   make(map[*listener]struct{}),
+		conns:       make(map[liveConn]*rawListener),
+
+		clock:            systemClock{},
+		listenPacket:     listenUDP,
+		resolver:         madns.DefaultResolver,
+		handshakeTimeout: defaultHandshakeTimeout,
+		stream0Timeout:   defaultStream0Timeout,
+		maxHalfOpen:      defaultMaxHalfOpen,
+		idleTimeout:      defaultIdleTimeout,
+		keepAlive:        defaultKeepAlive,
+		minMTU:           baseMTU,
+		initialMTU:       baseMTU,
+		maxMTU:           defaultMaxMTU,
+
+		holePunching: make(map[holePunchKey]*activeHolePunch),
+	}
+	for _, opt := range opts {
+		if err := opt(t); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.checkIdle(); err != nil {
+		return nil, err
+	}
+	if err := t.checkCongestion(); err != nil {
+		return nil, err
+	}
+	t.tokens = newTokenKeys(t.clock)
+	if t.ticketStore == nil {
+		t.ticketStore = NewTicketCache(defaultTicketCacheSize)
+	}
+	return t, nil
 }
 
-// getOutboundMux returns the shared outbound multiplexer for the given UDP
-// network ("udp4" or "udp6"), creating it lazily on first use.
-func (t *Transport) getOutboundMux(udpNetwork string) (*udx.Multiplexer, ma.Multiaddr, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// connMemory is the memory a UDX connection's buffers are accounted for
+// against its resource scope.
+const connMemory = 256 << 10
 
-	isV6 := (udpNetwork == "udp6")
-	om := t.outboundV4
-	if isV6 {
-		om = t.outboundV6
-	}
-	if om != nil {
-		localUDP := om.conn.LocalAddr().(*net.UDPAddr)
-		localMaddr, _ := toUDXMultiaddr(localUDP.IP.String(), localUDP.Port)
-		return om.mux, localMaddr, nil
+// Dial dials a remote peer over UDX. Native multiplexing is offered first;
+// peers that only speak the upgrader path are redialed through it. For the
+// server side of a simultaneous connect, Dial punches a hole instead.
+func (t *Transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	c, err := t.dial(ctx, raddr, p)
+	if t.metrics != nil {
+		t.metrics.ConnFinished(network.DirOutbound, err)
 	}
+	return c, err
+}
 
-	// Bind ephemeral port once
-	localConn, err := net.ListenUDP(udpNetwork, nil)
-	if err != nil {
-		return nil, nil, err
+func (t *Transport) dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	if t.isClosed() {
+		return nil, ErrTransportClosed
 	}
-	mux := udx.NewMultiplexer(localConn, udx.RealClock{})
-	om = &outboundMux{conn: localConn, mux: mux}
-
-	if isV6 {
-		t.outboundV6 = om
-	} else {
-		t.outboundV4 = om
+	raddr, err := t.resolveDNS(ctx, raddr)
+	if err != nil {
+		return nil, err
 	}
 
-	localUDP := localConn.LocalAddr().(*net.UDPAddr)
-	localMaddr, _ := toUDXMultiaddr(localUDP.IP.String(), localUDP.Port)
-	return mux, localMaddr, nil
-}
-
-// Dial dials a remote peer over UDX.
-func (t *Transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
 	host, port, err := fromUDXMultiaddr(raddr)
 	if err != nil {
 		return nil, fmt.Errorf("parsing multiaddr: %w", err)
@@ -108,58 +179,191 @@ func (t *Transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tp
 		udpNetwork = "udp6"
 	}
 
-	mux, localMaddr, err := t.getOutboundMux(udpNetwork)
+	if ok, isClient, _ := network.GetSimultaneousConnect(ctx); ok && !isClient {
+		return t.holePunch(ctx, udpNetwork, remoteAddr, p)
+	}
+
+	// Reserve the connection before doing any work for it
+	connScope, err := t.rcmgr.OpenConnection(network.DirOutbound, false, raddr)
 	if err != nil {
-		return nil, fmt.Errorf("outbound mux: %w", err)
+		return nil, fmt.Errorf("resource manager: %w", err)
+	}
+	c, err := t.dialWithScope(ctx, udpNetwork, remoteAddr, raddr, p, connScope)
+	if err != nil {
+		connScope.Done()
+		return nil, err
 	}
+	return c, nil
+}
 
-	udxConn, err := mux.Dial(ctx, remoteAddr)
+// dialWithScope dials p within connScope, which the caller releases if the
+// dial fails.
+func (t *Transport) dialWithScope(ctx context.Context, udpNetwork string, remoteAddr *net.UDPAddr, raddr ma.Multiaddr, p peer.ID, connScope network.ConnManagementScope) (tpt.CapableConn, error) {
+	if err := connScope.SetPeer(p); err != nil {
+		return nil, fmt.Errorf("resource manager: %w", err)
+	}
+	if err := connScope.ReserveMemory(connMemory, network.ReservationPriorityHigh); err != nil {
+		return nil, fmt.Errorf("resource manager: %w", err)
+	}
+
+	if t.dialsNative(p) {
+		c, err := t.dialNative(ctx, udpNetwork, remoteAddr, raddr, p, connScope)
+		if !errors.Is(err, errLegacyPeer) {
+			return c, err
+		}
+		t.markLegacy(p)
+	}
+	return t.dialUpgraded(ctx, udpNetwork, remoteAddr, raddr, p, connScope)
+}
+
+// dialStream0 dials remoteAddr and opens stream 0, which carries either the
+// native handshake or the upgrader's negotiation. What the transport knows of
+// p decides whether the dial pads.
+func (t *Transport) dialStream0(ctx context.Context, udpNetwork string, remoteAddr *net.UDPAddr, raddr ma.Multiaddr, p peer.ID) (*streamConn, error) {
+	m, err := t.getOutboundMux(udpNetwork, remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("outbound mux: %w", err)
+	}
+	delay, pad := t.dialPadding(p)
+	dialCtx, refused, done := m.startDial(ctx, remoteAddr, delay, pad)
+	udxConn, err := m.mux.Dial(dialCtx, remoteAddr)
+	done()
 	if err != nil {
+		t.releaseMux(m)
+		if refused() {
+			return nil, ErrConnRefused
+		}
 		return nil, fmt.Errorf("dialing: %w", err)
 	}
+	t.configureIdle(udxConn)
+	t.configureMTU(udxConn)
+	cc := t.configureCongestion(udxConn)
 
-	// Open stream 0 as the raw connection for the upgrader
 	stream0, err := udxConn.OpenStream(ctx)
 	if err != nil {
 		udxConn.Close()
+		t.releaseMux(m)
 		return nil, fmt.Errorf("opening upgrade stream: %w", err)
 	}
 
-	rawConn := &streamConn{
-		stream:      stream0,
-		connection:  udxConn,
-		localMaddr:  localMaddr,
-		remoteMaddr: raddr,
+	if t.metrics != nil {
+		t.metrics.ConnOpened(udxConn, m.laddr)
 	}
+	trace := newConnTrace(t.traceDir, "client", t.clock, udxConn, m.laddr, raddr)
+	return &streamConn{
+		stream:     stream0,
+		connection: udxConn,
+		transport:  t,
+		mux:        m,
+		trace:      trace,
+		path:       t.newConnPath(udxConn, m.demux, cc, m.laddr, raddr, trace),
+		localMaddr: m.laddr,
+	}, nil
+}
 
-	// Get a connection scope from the resource manager
-	connScope, err := t.rcmgr.OpenConnection(network.DirOutbound, false, raddr)
+// dialNative dials with native stream multiplexing. It returns errLegacyPeer
+// if the listener answers the native preamble with multistream-select.
+func (t *Transport) dialNative(ctx context.Context, udpNetwork string, remoteAddr *net.UDPAddr, raddr ma.Multiaddr, p peer.ID, connScope network.ConnManagementScope) (tpt.CapableConn, error) {
+	hs, err := t.dialStream0(ctx, udpNetwork, remoteAddr, raddr, p)
 	if err != nil {
-		rawConn.Close()
-		return nil, fmt.Errorf("resource manager: %w", err)
+		return nil, err
+	}
+	c, err := t.handshakeNative(ctx, hs, network.DirOutbound, p, connScope)
+	if err != nil {
+		return nil, err
+	}
+	if !t.addConn(c, nil) {
+		c.Close()
+		return nil, ErrTransportClosed
+	}
+	return c, nil
+}
+
+// dialUpgraded dials with stream 0 as the raw connection for the upgrader.
+func (t *Transport) dialUpgraded(ctx context.Context, udpNetwork string, remoteAddr *net.UDPAddr, raddr ma.Multiaddr, p peer.ID, connScope network.ConnManagementScope) (tpt.CapableConn, error) {
+	rawConn, err := t.dialStream0(ctx, udpNetwork, remoteAddr, raddr, p)
+	if err != nil {
+		return nil, err
 	}
 
 	// Upgrader handles Noise + Yamux negotiation
-	return t.upgrader.Upgrade(ctx, t, rawConn, network.DirOutbound, p, connScope)
+	rawConn.watchRefusal = true
+	rawConn.trace.event(udxtrace.HandshakeStarted, map[string]any{"upgrader": true})
+	start := t.clock.Now()
+	c, err := t.upgrader.Upgrade(ctx, t, rawConn, network.DirOutbound, p, connScope)
+	if err != nil {
+		if rawConn.refused.Load() {
+			err = ErrConnRefused
+		}
+		rawConn.trace.event(udxtrace.HandshakeFailed, map[string]any{"error": err.Error()})
+		return nil, err
+	}
+	rawConn.trace.event(udxtrace.HandshakeCompleted, map[string]any{
+		"peer":     c.RemotePeer().String(),
+		"security": string(c.ConnState().Security),
+	})
+	if t.metrics != nil {
+		t.metrics.HandshakeFinished(network.DirOutbound, c.ConnState().Security, t.clock.Now().Sub(start))
+	}
+	rawConn.path.setPeer(c.RemotePeer())
+	uc := &upgradedConn{CapableConn: c, raw: rawConn}
+	if !t.addConn(uc, nil) {
+		uc.Close()
+		return nil, ErrTransportClosed
+	}
+	return uc, nil
 }
 
-// Close shuts down the shared outbound multiplexers and their UDP sockets.
+// Close closes every listener and connection the transport has handed out,
+// and the shared outbound sockets. Dial and Listen fail with
+// ErrTransportClosed from then on. Use Drain to shut down gracefully.
 func (t *Transport) Close() error {
 	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.outboundV4 != nil {
-		t.outboundV4.mux.Close()
-		t.outboundV4 = nil
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	listeners := make([]*listener, 0, len(t.listeners))
+	for l := range t.listeners {
+		listeners = append(listeners, l)
 	}
-	if t.outboundV6 != nil {
-		t.outboundV6.mux.Close()
-		t.outboundV6 = nil
+	conns := make([]liveConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	outbound := []*udpMux{t.outboundV4, t.outboundV6}
+	t.outboundV4, t.outboundV6 = nil, nil
+	t.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	for _, m := range outbound {
+		if m != nil {
+			m.mux.Close()
+		}
+	}
+	if t.migrations != nil {
+		t.migrations.Close()
 	}
 	return nil
 }
 
+func (t *Transport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
 // Listen listens for incoming UDX connections.
 func (t *Transport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
+	if t.isClosed() {
+		return nil, ErrTransportClosed
+	}
 	host, port, err := fromUDXMultiaddr(laddr)
 	if err != nil {
 		return nil, fmt.Errorf("parsing multiaddr: %w", err)
@@ -175,28 +379,59 @@ func (t *Transport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
 	if udpAddr.IP.To4() == nil {
 		udpNetwork = "udp6"
 	}
-	udpConn, err := net.ListenUDP(udpNetwork, udpAddr)
+	udpConn, err := t.listenPacket(udpNetwork, udpAddr)
 	if err != nil {
 		return nil, fmt.Errorf("listening: %w", err)
 	}
 
-	mux := udx.NewMultiplexer(udpConn, udx.RealClock{})
-
-	// Build actual listen multiaddr (with resolved port if 0)
-	actualAddr := udpConn.LocalAddr().(*net.UDPAddr)
-	actualMaddr, _ := toUDXMultiaddr(actualAddr.IP.String(), actualAddr.Port)
+	// The mux's multiaddr carries the actual port if 0 was requested
+	m, err := t.newUDPMux(udpConn)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	t.addListenMux(m)
 
-	raw := &rawListener{
-		mux:       mux,
-		transport: t,
-		laddr:     actualMaddr,
+	raw := t.newRawListener(m)
+	m.demux.setGate(raw.gate, raw.releaseAdmission)
+	if t.validation != ValidateNever {
+		m.demux.setValidation(raw.mustValidate)
+	}
+	go raw.acceptLoop()
+	l := &listener{
+		raw:      raw,
+		upgraded: t.upgrader.UpgradeGatedMaListener(t, raw),
+	}
+	go l.acceptUpgraded()
+	if !t.addListener(l) {
+		l.Close()
+		return nil, ErrTransportClosed
 	}
-	return t.upgrader.UpgradeGatedMaListener(t, raw), nil
+	return l, nil
 }
 
 // CanDial returns true if this transport can dial the given multiaddr.
 func (t *Transport) CanDial(addr ma.Multiaddr) bool {
-	return isUDXMultiaddr(addr)
+	return dialMatcher.Matches(addr)
+}
+
+// resolveDNS resolves a /dns, /dns4 or /dns6 host in raddr with the
+// transport's resolver and returns the first resolved address. Other
+// addresses are returned as they are.
+func (t *Transport) resolveDNS(ctx context.Context, raddr ma.Multiaddr) (ma.Multiaddr, error) {
+	if !isDNSMultiaddr(raddr) {
+		return raddr, nil
+	}
+	addrs, err := t.resolver.Resolve(ctx, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", raddr, err)
+	}
+	for _, addr := range addrs {
+		if _, _, err := fromUDXMultiaddr(addr); err == nil {
+			return addr, nil
+		}
+	}
+	return nil, fmt.Errorf("resolving %s: no addresses", raddr)
 }
 
 // Protocols returns the protocol codes handled by this transport.
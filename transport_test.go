@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"net"
 	"testing"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/libp2p/go-libp2p/p2p/net/upgrader"
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
 	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
 )
 
 func generateKey(t *testing.T) (ic.PrivKey, peer.ID) {
@@ -66,14 +68,70 @@ func TestCanDial(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	udxAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/udp/1234/udx")
-	tcpAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1234")
+	_, id := generateKey(t)
+	valid := []string{
+		"/ip4/127.0.0.1/udp/1234/udx",
+		"/ip6/::1/udp/1234/udx",
+		"/dns/example.com/udp/1234/udx",
+		"/dns4/example.com/udp/1234/udx",
+		"/dns6/example.com/udp/1234/udx",
+		"/ip4/127.0.0.1/udp/1234/udx/p2p/" + id.String(),
+	}
+	invalid := []string{
+		"/ip4/127.0.0.1/tcp/1234",
+		"/ip4/127.0.0.1/udp/1234",
+		"/ip4/127.0.0.1/tcp/1234/udx",
+		"/udx/ip4/127.0.0.1/udp/1234",
+		"/ip4/127.0.0.1/udx",
+		"/dnsaddr/example.com/udp/1234/udx",
+		"/ip4/127.0.0.1/udp/1234/udx/p2p/" + id.String() + "/p2p-circuit",
+		"/ip4/127.0.0.1/udp/1234/udx/p2p/" + id.String() + "/p2p-circuit/p2p/" + id.String(),
+		"/ip4/127.0.0.1/udp/1234/quic-v1",
+	}
+	for _, addr := range valid {
+		if !tr.CanDial(ma.StringCast(addr)) {
+			t.Errorf("should be able to dial %s", addr)
+		}
+	}
+	for _, addr := range invalid {
+		if tr.CanDial(ma.StringCast(addr)) {
+			t.Errorf("should not be able to dial %s", addr)
+		}
+	}
+}
+
+// staticResolver resolves every name to 127.0.0.1 and ::1, in that order.
+type staticResolver struct{}
+
+func (staticResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}, {IP: net.IPv6loopback}}, nil
+}
+
+func (staticResolver) LookupTXT(context.Context, string) ([]string, error) {
+	return nil, nil
+}
 
-	if !tr.CanDial(udxAddr) {
-		t.Fatal("should be able to dial /udx address")
+func TestDialDNS(t *testing.T) {
+	resolver, err := madns.NewResolver(madns.WithDefaultResolver(staticResolver{}))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if tr.CanDial(tcpAddr) {
-		t.Fatal("should not be able to dial /tcp address")
+	ln, serverID, accepted := listenForTest(t, newTestTransport(t, nil, nil))
+	port, err := ln.Multiaddr().ValueForProtocol(ma.P_UDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, proto := range []string{"dns", "dns4"} {
+		addr := ma.StringCast(fmt.Sprintf("/%s/udx.test/udp/%s/udx", proto, port))
+		c, err := dialForTest(t, addr, serverID, 5*time.Second, WithResolver(resolver))
+		if err != nil {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		(<-accepted).Close()
+		if !c.RemoteMultiaddr().Equal(ln.Multiaddr()) {
+			t.Fatalf("dialed %s, want %s", c.RemoteMultiaddr(), ln.Multiaddr())
+		}
 	}
 }
 
@@ -97,34 +155,21 @@ func TestProxy(t *testing.T) {
 	}
 }
 
-func TestListenAndDial(t *testing.T) {
-	serverKey, serverID := generateKey(t)
-	clientKey, _ := generateKey(t)
-
-	// Create server transport with Noise + Yamux upgrader
-	serverU := createUpgrader(t, serverKey)
-	serverTr, err := NewTransport(serverKey, serverU, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+// testListenAndDial listens on serverTr, dials it from clientTr, and echoes
+// data over a stream. It returns the client's connection.
+func testListenAndDial(t *testing.T, serverTr *Transport, serverID peer.ID, clientTr *Transport) tpt.CapableConn {
+	t.Helper()
 
 	listenAddr, _ := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/udx")
 	ln, err := serverTr.Listen(listenAddr)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer ln.Close()
+	t.Cleanup(func() { ln.Close() })
 
 	actualAddr := ln.Multiaddr()
 	t.Logf("Listening on %s", actualAddr)
 
-	// Create client transport with Noise + Yamux upgrader
-	clientU := createUpgrader(t, clientKey)
-	clientTr, err := NewTransport(clientKey, clientU, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -143,7 +188,7 @@ func TestListenAndDial(t *testing.T) {
 		}
 		serverReady <- serverResult{serverConn, nil}
 
-		// Accept a stream (this is a Yamux stream now)
+		// Accept a stream (a native UDX stream or a Yamux stream)
 		s, err := serverConn.AcceptStream()
 		if err != nil {
 			echoDone <- fmt.Errorf("accept stream: %w", err)
@@ -171,7 +216,7 @@ func TestListenAndDial(t *testing.T) {
 	if err != nil {
 		t.Fatal("dial:", err)
 	}
-	defer clientConn.Close()
+	t.Cleanup(func() { clientConn.Close() })
 
 	t.Log("Dial succeeded, peer:", clientConn.RemotePeer())
 
@@ -180,7 +225,7 @@ func TestListenAndDial(t *testing.T) {
 	if sr.err != nil {
 		t.Fatal("server accept:", sr.err)
 	}
-	defer sr.conn.Close()
+	t.Cleanup(func() { sr.conn.Close() })
 	t.Log("Server accepted connection")
 
 	// Verify connection properties
@@ -191,13 +236,13 @@ func TestListenAndDial(t *testing.T) {
 		t.Fatal("remote peer mismatch")
 	}
 
-	// Open a stream (Yamux stream) and send data
+	// Open a stream and send data
 	s, err := clientConn.OpenStream(ctx)
 	if err != nil {
 		t.Fatal("open stream:", err)
 	}
 
-	testData := []byte("hello from libp2p over UDX with Noise+Yamux!")
+	testData := []byte("hello from libp2p over UDX!")
 	_, err = s.Write(testData)
 	if err != nil {
 		t.Fatal("write:", err)
@@ -224,6 +269,51 @@ func TestListenAndDial(t *testing.T) {
 		t.Fatal("server timed out")
 	}
 
+	return clientConn
+}
+
+func TestListenAndDial(t *testing.T) {
+	serverKey, serverID := generateKey(t)
+	clientKey, _ := generateKey(t)
+
+	serverTr, err := NewTransport(serverKey, createUpgrader(t, serverKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTr, err := NewTransport(clientKey, createUpgrader(t, clientKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testListenAndDial(t, serverTr, serverID, clientTr)
+	if mux := c.ConnState().StreamMultiplexer; mux != nativeProtocolID {
+		t.Fatalf("muxer: got %s, want %s", mux, nativeProtocolID)
+	}
+	t.Log("Listen → Dial → native UDX streams echo test PASSED")
+}
+
+func TestListenAndDialUpgraded(t *testing.T) {
+	serverKey, serverID := generateKey(t)
+	clientKey, _ := generateKey(t)
+
+	// A server without native multiplexing forces the client to fall back
+	// to the upgrader after its native preamble goes unanswered.
+	serverTr, err := NewTransport(serverKey, createUpgrader(t, serverKey), nil, DisableNativeMultiplexing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTr, err := NewTransport(clientKey, createUpgrader(t, clientKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testListenAndDial(t, serverTr, serverID, clientTr)
+	if mux := c.ConnState().StreamMultiplexer; mux != yamux.ID {
+		t.Fatalf("muxer: got %s, want %s", mux, yamux.ID)
+	}
+	if clientTr.dialsNative(serverID) {
+		t.Fatal("server should be remembered as a legacy peer")
+	}
 	t.Log("Listen → Dial → Noise → Yamux → Stream echo test PASSED")
 }
 
@@ -244,3 +334,71 @@ func TestMultiaddr(t *testing.T) {
 		t.Fatalf("parsed: host=%s port=%d", host, port)
 	}
 }
+
+func TestRemoteStreamIDs(t *testing.T) {
+	c := &conn{} // a listener, so the remote opens even IDs
+	c.initStreamIDs()
+	for _, tc := range []struct {
+		id   uint64
+		want bool
+	}{
+		{6, true},  // 2 and 4 are skipped
+		{4, true},  // read out of order
+		{4, false}, // reused
+		{6, false},
+		{2, true},
+		{8, true},
+		{12 + 2*streamIDWindow, true}, // 10 falls out of the window
+		{10, false},
+		{14, true},
+	} {
+		if got := c.acceptRemoteID(tc.id); got != tc.want {
+			t.Errorf("stream %d accepted %v, want %v", tc.id, got, tc.want)
+		}
+	}
+	if len(c.skippedIDs) > streamIDWindow {
+		t.Errorf("%d skipped IDs kept", len(c.skippedIDs))
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	_, _, dialed, accepted := connectedPeers(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := dialed.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := accepted.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.CloseRead()
+	if _, err := rs.Read(make([]byte, 1)); err == nil {
+		t.Error("read after CloseRead succeeded")
+	}
+
+	// Far more than UDX buffers for a stream nobody reads.
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, 8<<20))
+		if err == nil {
+			err = s.CloseWrite()
+		}
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("writes to a stream the remote closed for reading stalled")
+	}
+	if _, err := rs.Write([]byte("still writable")); err != nil {
+		t.Errorf("write after CloseRead: %v", err)
+	}
+}
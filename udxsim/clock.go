@@ -0,0 +1,124 @@
+package udxsim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a network: when packets are sent, and the
+// timers that deliver them and expire read deadlines. It has the method set
+// of udxtransport.Clock, so one clock can drive a network and the transports
+// on it.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f once d has passed, unless stop is called first.
+	// stop reports whether it prevented the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// systemClock is the default Clock, on the system's time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// ManualClock is a Clock that only moves when Advance is called, for tests
+// that must not depend on the scheduler: packets due at the same virtual time
+// are delivered in the same order on every run.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers timerHeap
+	seq    uint64
+}
+
+var _ Clock = (*ManualClock)(nil)
+
+// NewManualClock returns a ManualClock reading start.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f for when the clock has advanced by d. A function
+// that is already due runs on the next call to Advance.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &manualTimer{at: c.now.Add(d), seq: c.seq, f: f}
+	heap.Push(&c.timers, t)
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if t.index < 0 {
+			return false
+		}
+		heap.Remove(&c.timers, t.index)
+		return true
+	}
+}
+
+// Advance moves the clock forward by d, calling the functions that come due
+// on the way in order of due time, with the clock reading their due time.
+// They run on the calling goroutine, so they have run when Advance returns,
+// and may schedule further functions, which run too if they are due by the
+// end of d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].at.After(end) {
+		t := heap.Pop(&c.timers).(*manualTimer)
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type manualTimer struct {
+	at    time.Time
+	seq   uint64
+	f     func()
+	index int // in the heap, or -1 once popped or removed
+}
+
+type timerHeap []*manualTimer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *timerHeap) Push(x any) {
+	t := x.(*manualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
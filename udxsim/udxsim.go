@@ -0,0 +1,502 @@
+// Package udxsim is an in-memory UDP network for testing the UDX transport
+// under adverse conditions without touching the operating system's sockets.
+// Each simulated host opens its sockets with Host.ListenPacket, which plugs
+// into udxtransport.WithListenPacket.
+//
+// Links between hosts add latency and jitter, and lose, duplicate, reorder
+// and rate-limit packets, dropping those that overflow a rate-limited link's
+// queue. Like a path with the don't-fragment bit set, a link with an MTU
+// drops packets larger than it. Every such decision is drawn from a random
+// source seeded by the caller, so the same seed and the same sequence of
+// packets meet the same conditions. Delays run on the network's Clock: the
+// system's by default, where they are best kept in the milliseconds for
+// tests to stay fast, or a ManualClock given with WithClock, which holds
+// packets until the test advances it past their delivery time.
+//
+// A socket can also forge the source address of its packets with
+// PacketConn.Spoof, to play an attacker reflecting traffic at a victim.
+package udxsim
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inboxLen is how many packets a socket buffers before dropping, like a
+// kernel receive buffer.
+const inboxLen = 1024
+
+// firstEphemeralPort is where ports picked for port 0 start.
+const firstEphemeralPort = 49152
+
+// Link describes the conditions packets meet in one direction between two
+// hosts. The zero Link delivers every packet at once.
+type Link struct {
+	Latency   time.Duration // one-way delay
+	Jitter    time.Duration // random extra delay, up to this much
+	Loss      float64       // probability a packet is dropped
+	Duplicate float64       // probability a packet is delivered twice
+	Reorder   float64       // probability a packet skips the latency, overtaking those before it
+	Bandwidth int           // bytes per second; 0 is unlimited
+	Queue     int           // bytes a link with a bandwidth holds, the packet being sent included, like a router's buffer; 0 is unlimited
+	MTU       int           // largest packet carried, in bytes of UDP payload; 0 is unlimited
+}
+
+// Counters tally what happened to the packets sent on a network.
+type Counters struct {
+	Sent       int
+	Lost       int
+	Duplicated int
+	Delivered  int
+	Dropped    int // no socket at the destination, or its buffer was full
+	TooBig     int // larger than the link's MTU
+	Overflowed int // the link's queue was full
+}
+
+// Network is a simulated network. Create one with NewNetwork.
+type Network struct {
+	clock     Clock
+	mu        sync.Mutex
+	rng       *rand.Rand
+	def       Link
+	links     map[linkKey]*linkState
+	conns     map[netip.AddrPort]*PacketConn
+	counters  Counters
+	pending   deliveryHeap
+	seq       uint64
+	timerAt   time.Time   // when the armed delivery timer fires
+	stopTimer func() bool // nil unless a delivery timer is armed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Option configures a Network.
+type Option func(*Network)
+
+// WithClock runs the network on clock instead of the system's time.
+func WithClock(clock Clock) Option {
+	return func(n *Network) {
+		n.clock = clock
+	}
+}
+
+type linkKey struct {
+	from, to netip.Addr
+}
+
+type linkState struct {
+	Link
+	busyUntil time.Time // when the link finishes sending the packets queued on it
+}
+
+// NewNetwork creates a network whose links default to def, drawing its
+// random decisions from seed.
+func NewNetwork(seed uint64, def Link, opts ...Option) *Network {
+	n := &Network{
+		clock:  systemClock{},
+		rng:    rand.New(rand.NewPCG(seed, seed)),
+		def:    def,
+		links:  make(map[linkKey]*linkState),
+		conns:  make(map[netip.AddrPort]*PacketConn),
+		closed: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// SetLink sets the conditions of packets sent from one host to another.
+func (n *Network) SetLink(from, to net.IP, l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[linkKey{from: addrOf(from), to: addrOf(to)}] = &linkState{Link: l}
+}
+
+// Counters returns what happened to the packets sent so far.
+func (n *Network) Counters() Counters {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.counters
+}
+
+// Close closes every socket on the network and drops packets in flight.
+func (n *Network) Close() error {
+	n.closeOnce.Do(func() {
+		n.mu.Lock()
+		close(n.closed)
+		if n.stopTimer != nil {
+			n.stopTimer()
+			n.stopTimer = nil
+		}
+		n.pending = nil
+		conns := make([]*PacketConn, 0, len(n.conns))
+		for _, c := range n.conns {
+			conns = append(conns, c)
+		}
+		n.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+// Host returns the host with the given IP address.
+func (n *Network) Host(ip net.IP) *Host {
+	return &Host{net: n, ip: addrOf(ip)}
+}
+
+// Host is a machine on a simulated network.
+type Host struct {
+	net *Network
+	ip  netip.Addr
+}
+
+// ListenPacket opens a socket on h. It has the signature of
+// udxtransport.ListenPacketFunc: an unspecified or missing laddr binds to h's
+// address, and port 0 picks a free port.
+func (h *Host) ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	if (network == "udp4" && h.ip.Is6()) || (network == "udp6" && !h.ip.Is6()) {
+		return nil, fmt.Errorf("udxsim: host %s has no %s address", h.ip, network)
+	}
+	port := 0
+	if laddr != nil {
+		if laddr.IP != nil && !laddr.IP.IsUnspecified() && addrOf(laddr.IP) != h.ip {
+			return nil, fmt.Errorf("udxsim: %s isn't an address of host %s", laddr.IP, h.ip)
+		}
+		port = laddr.Port
+	}
+
+	n := h.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	if port == 0 {
+		for port = firstEphemeralPort; ; port++ {
+			if _, ok := n.conns[netip.AddrPortFrom(h.ip, uint16(port))]; !ok {
+				break
+			}
+		}
+	}
+	key := netip.AddrPortFrom(h.ip, uint16(port))
+	if _, ok := n.conns[key]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: net.UDPAddrFromAddrPort(key), Err: errors.New("address already in use")}
+	}
+	c := &PacketConn{
+		net:    n,
+		key:    key,
+		addr:   net.UDPAddrFromAddrPort(key),
+		inbox:  make(chan packet, inboxLen),
+		closed: make(chan struct{}),
+	}
+	c.readDeadline.clock = n.clock
+	c.readDeadline.expired = make(chan struct{})
+	n.conns[key] = c
+	return c, nil
+}
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// send runs a packet through the link from src to dst.
+func (n *Network) send(src netip.AddrPort, dst netip.AddrPort, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if isClosed(n.closed) {
+		return
+	}
+	n.counters.Sent++
+
+	k := linkKey{from: src.Addr(), to: dst.Addr()}
+	l, ok := n.links[k]
+	if !ok {
+		l = &linkState{Link: n.def}
+		n.links[k] = l
+	}
+	if l.MTU > 0 && len(data) > l.MTU {
+		n.counters.TooBig++
+		return
+	}
+	if l.Loss > 0 && n.rng.Float64() < l.Loss {
+		n.counters.Lost++
+		return
+	}
+	copies := 1
+	if l.Duplicate > 0 && n.rng.Float64() < l.Duplicate {
+		copies = 2
+		n.counters.Duplicated++
+	}
+
+	now := n.clock.Now()
+	departure := now
+	if l.Bandwidth > 0 && l.Queue > 0 && l.busyUntil.After(now) {
+		queued := int(l.busyUntil.Sub(now) * time.Duration(l.Bandwidth) / time.Second)
+		if queued+len(data) > l.Queue {
+			n.counters.Overflowed++
+			return
+		}
+	}
+	if l.Bandwidth > 0 {
+		departure = maxTime(now, l.busyUntil).Add(time.Duration(len(data)) * time.Second / time.Duration(l.Bandwidth))
+		l.busyUntil = departure
+	}
+	pkt := packet{data: append([]byte(nil), data...), from: net.UDPAddrFromAddrPort(src)}
+	for range copies {
+		delay := l.Latency
+		if l.Jitter > 0 {
+			delay += time.Duration(n.rng.Int64N(int64(l.Jitter)))
+		}
+		if l.Reorder > 0 && n.rng.Float64() < l.Reorder {
+			delay = 0
+		}
+		n.seq++
+		heap.Push(&n.pending, delivery{at: departure.Add(delay), seq: n.seq, to: dst, pkt: pkt})
+	}
+	n.deliverDueLocked()
+}
+
+// deliverDueLocked hands the packets that are due to their destination
+// sockets, in order of due time and, for equal times, of sending, and arms a
+// timer on the clock for the next one.
+func (n *Network) deliverDueLocked() {
+	now := n.clock.Now()
+	for len(n.pending) > 0 && !n.pending[0].at.After(now) {
+		d := heap.Pop(&n.pending).(delivery)
+		n.deliverLocked(d)
+	}
+	if len(n.pending) == 0 {
+		return
+	}
+	at := n.pending[0].at
+	if n.stopTimer != nil {
+		if !n.timerAt.After(at) {
+			return
+		}
+		n.stopTimer()
+	}
+	n.timerAt = at
+	n.stopTimer = n.clock.AfterFunc(at.Sub(now), func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if isClosed(n.closed) || !n.timerAt.Equal(at) {
+			return // closed, or replaced by an earlier timer
+		}
+		n.stopTimer = nil
+		n.deliverDueLocked()
+	})
+}
+
+func (n *Network) deliverLocked(d delivery) {
+	c, ok := n.conns[d.to]
+	if !ok {
+		n.counters.Dropped++
+		return
+	}
+	select {
+	case c.inbox <- d.pkt:
+		n.counters.Delivered++
+	default:
+		n.counters.Dropped++
+	}
+}
+
+// PacketConn is a socket on a simulated network. It implements
+// net.PacketConn.
+type PacketConn struct {
+	net       *Network
+	key       netip.AddrPort
+	addr      *net.UDPAddr
+	inbox     chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+	spoofed   atomic.Pointer[netip.AddrPort] // source written on packets instead of key
+
+	readDeadline deadline
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if isClosed(c.closed) {
+		return 0, nil, c.opError("read", net.ErrClosed)
+	}
+	expired := c.readDeadline.wait()
+	if isClosed(expired) {
+		return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+	}
+	select {
+	case pkt := <-c.inbox:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-c.closed:
+		return 0, nil, c.opError("read", net.ErrClosed)
+	case <-expired:
+		return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+	}
+}
+
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", fmt.Errorf("udxsim: not a UDP address: %v", addr))
+	}
+	from := c.key
+	if spoofed := c.spoofed.Load(); spoofed != nil {
+		from = *spoofed
+	}
+	c.net.send(from, netip.AddrPortFrom(addrOf(to.IP), uint16(to.Port)), p)
+	return len(p), nil
+}
+
+// Spoof makes the socket send its packets with from as their source, as an
+// attacker forging its address would. Answers go to from, not to the socket.
+// A nil from restores the socket's own address.
+func (c *PacketConn) Spoof(from *net.UDPAddr) {
+	if from == nil {
+		c.spoofed.Store(nil)
+		return
+	}
+	ap := netip.AddrPortFrom(addrOf(from.IP), uint16(from.Port))
+	c.spoofed.Store(&ap)
+}
+
+// Close closes the socket and frees its port.
+func (c *PacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.net.mu.Lock()
+		if c.net.conns[c.key] == c {
+			delete(c.net.conns, c.key)
+		}
+		c.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing: writes never block.
+func (c *PacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *PacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
+
+// deadline is a read deadline, like the one of net.Pipe: expired is closed
+// once it passes, and replaced when it is moved.
+type deadline struct {
+	clock   Clock
+	mu      sync.Mutex
+	stop    func() bool // nil unless a timer is armed
+	expired chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil && !d.stop() {
+		<-d.expired // the timer's function is closing it
+	}
+	d.stop = nil
+
+	closed := isClosed(d.expired)
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if dur := t.Sub(d.clock.Now()); dur > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.stop = d.clock.AfterFunc(dur, func() { close(expired) })
+		return
+	}
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+type delivery struct {
+	at  time.Time
+	seq uint64
+	to  netip.AddrPort
+	pkt packet
+}
+
+type deliveryHeap []delivery
+
+func (h deliveryHeap) Len() int { return len(h) }
+func (h deliveryHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h deliveryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *deliveryHeap) Push(x any)   { *h = append(*h, x.(delivery)) }
+func (h *deliveryHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
+
+func addrOf(ip net.IP) netip.Addr {
+	a, _ := netip.AddrFromSlice(ip)
+	return a.Unmap()
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
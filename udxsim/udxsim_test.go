@@ -0,0 +1,279 @@
+package udxsim
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	hostA = net.IPv4(10, 0, 0, 1)
+	hostB = net.IPv4(10, 0, 0, 2)
+)
+
+func pair(t *testing.T, n *Network) (a, b net.PacketConn) {
+	t.Helper()
+	a, err := n.Host(hostA).ListenPacket("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = n.Host(hostB).ListenPacket("udp4", &net.UDPAddr{Port: 4001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// receive reads packets from c until it has been idle for a while.
+func receive(c net.PacketConn, idle time.Duration) []byte {
+	var got []byte
+	buf := make([]byte, 64)
+	for {
+		c.SetReadDeadline(time.Now().Add(idle))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return got
+		}
+		got = append(got, buf[:n]...)
+	}
+}
+
+func send(t *testing.T, from, to net.PacketConn, count int) {
+	t.Helper()
+	for i := range count {
+		if _, err := from.WriteTo([]byte{byte(i)}, to.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	n := NewNetwork(1, Link{})
+	defer n.Close()
+	a, b := pair(t, n)
+
+	if got := b.LocalAddr().String(); got != "10.0.0.2:4001" {
+		t.Fatalf("unexpected address %s", got)
+	}
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	size, from, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:size]) != "hello" || from.String() != a.LocalAddr().String() {
+		t.Fatalf("got %q from %s", buf[:size], from)
+	}
+
+	if _, err := n.Host(hostB).ListenPacket("udp4", &net.UDPAddr{Port: 4001}); err == nil {
+		t.Fatal("expected the port to be in use")
+	}
+	if _, err := n.Host(hostB).ListenPacket("udp4", &net.UDPAddr{IP: hostA}); err == nil {
+		t.Fatal("expected an error for another host's address")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	n := NewNetwork(1, Link{})
+	defer n.Close()
+	_, b := pair(t, n)
+
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := b.ReadFrom(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	b.Close()
+	if _, _, err := b.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	n := NewNetwork(1, Link{Latency: 30 * time.Millisecond})
+	defer n.Close()
+	a, b := pair(t, n)
+
+	start := time.Now()
+	send(t, a, b, 1)
+	if _, _, err := b.ReadFrom(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("packet arrived after %s", d)
+	}
+}
+
+func TestOrderWithoutReordering(t *testing.T) {
+	n := NewNetwork(1, Link{Latency: time.Millisecond})
+	defer n.Close()
+	a, b := pair(t, n)
+
+	send(t, a, b, 100)
+	got := receive(b, 50*time.Millisecond)
+	if len(got) != 100 {
+		t.Fatalf("got %d packets", len(got))
+	}
+	for i, v := range got {
+		if int(v) != i {
+			t.Fatalf("packet %d arrived at position %d", v, i)
+		}
+	}
+}
+
+func TestImpairmentsAreSeeded(t *testing.T) {
+	run := func(seed uint64) ([]byte, Counters) {
+		n := NewNetwork(seed, Link{Loss: 0.3, Duplicate: 0.1})
+		defer n.Close()
+		a, b := pair(t, n)
+		send(t, a, b, 200)
+		return receive(b, 50*time.Millisecond), n.Counters()
+	}
+
+	got1, c1 := run(7)
+	got2, c2 := run(7)
+	if string(got1) != string(got2) || c1 != c2 {
+		t.Fatal("the same seed gave different results")
+	}
+	if c1.Lost == 0 || c1.Duplicated == 0 {
+		t.Fatalf("expected losses and duplicates: %+v", c1)
+	}
+	if c1.Delivered != 200-c1.Lost+c1.Duplicated || len(got1) != c1.Delivered {
+		t.Fatalf("inconsistent counters %+v for %d packets received", c1, len(got1))
+	}
+}
+
+func TestReorder(t *testing.T) {
+	n := NewNetwork(3, Link{Latency: 10 * time.Millisecond, Reorder: 0.2})
+	defer n.Close()
+	a, b := pair(t, n)
+
+	send(t, a, b, 100)
+	got := receive(b, 50*time.Millisecond)
+	if len(got) != 100 {
+		t.Fatalf("got %d packets", len(got))
+	}
+	reordered := false
+	for i := 1; i < len(got); i++ {
+		if got[i] < got[i-1] {
+			reordered = true
+		}
+	}
+	if !reordered {
+		t.Fatal("expected packets out of order")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	n := NewNetwork(1, Link{})
+	defer n.Close()
+	a, b := pair(t, n)
+	// 10 packets of 1000 bytes at 100 kB/s take 100ms.
+	n.SetLink(hostA, hostB, Link{Bandwidth: 100_000})
+
+	start := time.Now()
+	for range 10 {
+		a.WriteTo(make([]byte, 1000), b.LocalAddr())
+	}
+	buf := make([]byte, 1000)
+	for range 10 {
+		if _, _, err := b.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("10 kB went through a 100 kB/s link in %s", d)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	n := NewNetwork(1, Link{})
+	defer n.Close()
+	a, b := pair(t, n)
+	// Of a burst of 10 packets of 1000 bytes at 10 kB/s, a 3000 byte queue
+	// holds three, counting the one being sent.
+	n.SetLink(hostA, hostB, Link{Bandwidth: 10_000, Queue: 3000})
+
+	for range 10 {
+		a.WriteTo(make([]byte, 1000), b.LocalAddr())
+	}
+	if c := n.Counters(); c.Overflowed != 7 {
+		t.Fatalf("%d packets overflowed the queue, want 7", c.Overflowed)
+	}
+}
+
+func TestMTU(t *testing.T) {
+	n := NewNetwork(1, Link{MTU: 1000})
+	defer n.Close()
+	a, b := pair(t, n)
+
+	a.WriteTo(make([]byte, 1001), b.LocalAddr())
+	a.WriteTo(make([]byte, 1000), b.LocalAddr())
+	buf := make([]byte, 2000)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if m, _, err := b.ReadFrom(buf); err != nil || m != 1000 {
+		t.Fatalf("read %d bytes, %v; want the 1000 byte packet", m, err)
+	}
+	if c := n.Counters(); c.TooBig != 1 || c.Delivered != 1 {
+		t.Fatalf("unexpected counters %+v", c)
+	}
+}
+
+func TestSpoof(t *testing.T) {
+	n := NewNetwork(1, Link{})
+	defer n.Close()
+	a, b := pair(t, n)
+	forged := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 4001}
+
+	a.(*PacketConn).Spoof(forged)
+	a.WriteTo([]byte{1}, b.LocalAddr())
+	buf := make([]byte, 8)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if _, from, err := b.ReadFrom(buf); err != nil || from.String() != forged.String() {
+		t.Fatalf("packet came from %v (%v), want %s", from, err, forged)
+	}
+
+	a.(*PacketConn).Spoof(nil)
+	a.WriteTo([]byte{2}, b.LocalAddr())
+	if _, from, err := b.ReadFrom(buf); err != nil || from.String() != a.LocalAddr().String() {
+		t.Fatalf("packet came from %v (%v), want %s", from, err, a.LocalAddr())
+	}
+}
+
+func TestManualClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	n := NewNetwork(1, Link{Latency: 10 * time.Millisecond, Bandwidth: 1000}, WithClock(clock))
+	defer n.Close()
+	a, b := pair(t, n)
+
+	// Ten bytes at 1000 bytes per second leave the link after 10ms, and
+	// arrive 10ms later.
+	if _, err := a.WriteTo(make([]byte, 10), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(19 * time.Millisecond)
+	if got := n.Counters().Delivered; got != 0 {
+		t.Fatalf("%d packets delivered before their time", got)
+	}
+	clock.Advance(time.Millisecond)
+	if got := n.Counters().Delivered; got != 1 {
+		t.Fatalf("%d packets delivered on time", got)
+	}
+	if size, _, err := b.ReadFrom(make([]byte, 16)); err != nil || size != 10 {
+		t.Fatalf("read %d bytes: %v", size, err)
+	}
+
+	b.SetReadDeadline(clock.Now().Add(5 * time.Millisecond))
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := b.ReadFrom(make([]byte, 16))
+		errc <- err
+	}()
+	clock.Advance(5 * time.Millisecond)
+	if err := <-errc; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
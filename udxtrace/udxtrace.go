@@ -0,0 +1,236 @@
+// Package udxtrace defines the per-connection event traces the UDX transport
+// writes when configured with WithTraceDir, and loads them back for tests
+// and debugging.
+//
+// A trace is a newline-delimited JSON file in the spirit of qlog: a header
+// line followed by one event per line, each with its time in milliseconds
+// since the header's reference time.
+package udxtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileExt is the extension of trace files.
+const FileExt = ".ndjson"
+
+// Event names, using qlog's category:event convention.
+const (
+	ConnectionStarted  = "connectivity:connection_started"
+	ConnectionClosed   = "connectivity:connection_closed"
+	PathMigrated       = "connectivity:path_migrated"
+	MTUUpdated         = "connectivity:mtu_updated"
+	HandshakeStarted   = "security:handshake_started"
+	HandshakeCompleted = "security:handshake_completed"
+	HandshakeFailed    = "security:handshake_failed"
+	StreamOpened       = "transport:stream_opened"
+	StreamClosed       = "transport:stream_closed"
+	PacketSent         = "transport:packet_sent"
+	PacketReceived     = "transport:packet_received"
+	PacketsAcked       = "recovery:packets_acked"
+	PacketLost         = "recovery:packet_lost"
+	MetricsUpdated     = "recovery:metrics_updated"
+)
+
+// Header is the first line of a trace.
+type Header struct {
+	Format        string       `json:"qlog_format"`
+	Title         string       `json:"title"`
+	VantagePoint  VantagePoint `json:"vantage_point"`
+	ReferenceTime float64      `json:"reference_time"` // milliseconds since the Unix epoch
+}
+
+// VantagePoint says which side of the connection wrote a trace.
+type VantagePoint struct {
+	Type string `json:"type"` // "client" or "server"
+}
+
+// Start returns the reference time as a time.Time.
+func (h Header) Start() time.Time {
+	return time.UnixMicro(int64(h.ReferenceTime * 1000))
+}
+
+// Event is a single line after the header.
+type Event struct {
+	Time float64        `json:"time"` // milliseconds since the reference time
+	Name string         `json:"name"`
+	Data map[string]any `json:"data,omitempty"`
+}
+
+// Offset returns the event's time since the reference time.
+func (e Event) Offset() time.Duration {
+	return time.Duration(e.Time * float64(time.Millisecond))
+}
+
+// Int returns the numeric data field key.
+func (e Event) Int(key string) (int64, bool) {
+	v, ok := e.Data[key].(float64)
+	return int64(v), ok
+}
+
+// Str returns the string data field key.
+func (e Event) Str(key string) (string, bool) {
+	v, ok := e.Data[key].(string)
+	return v, ok
+}
+
+// Trace is a loaded trace file.
+type Trace struct {
+	Header
+	Path   string // empty unless loaded with Load or LoadDir
+	Events []Event
+}
+
+// Read parses a trace.
+func Read(r io.Reader) (*Trace, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("missing header")
+	}
+	t := &Trace{}
+	if err := json.Unmarshal(sc.Bytes(), &t.Header); err != nil {
+		return nil, fmt.Errorf("parsing header: %w", err)
+	}
+	for line := 2; sc.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("parsing line %d: %w", line, err)
+		}
+		t.Events = append(t.Events, e)
+	}
+	return t, sc.Err()
+}
+
+// Load reads the trace at path.
+func Load(path string) (*Trace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.Path = path
+	return t, nil
+}
+
+// LoadDir reads every trace in dir, ordered by their reference time.
+func LoadDir(dir string) ([]*Trace, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var traces []*Trace
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), FileExt) {
+			continue
+		}
+		t, err := Load(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, t)
+	}
+	sort.SliceStable(traces, func(i, j int) bool {
+		return traces[i].ReferenceTime < traces[j].ReferenceTime
+	})
+	return traces, nil
+}
+
+// Filter returns the events called name.
+func (t *Trace) Filter(name string) []Event {
+	var events []Event
+	for _, e := range t.Events {
+		if e.Name == name {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Summary condenses a trace.
+type Summary struct {
+	VantagePoint      string
+	Duration          time.Duration // until the last event
+	Events            map[string]int
+	PacketsSent       int
+	PacketsReceived   int
+	PacketsLost       int
+	BytesSent         int64
+	BytesReceived     int64
+	StreamsOpened     int
+	HandshakeDuration time.Duration // zero unless the handshake completed
+	HandshakeError    string
+	Closed            bool
+}
+
+// Summarize condenses t.
+func (t *Trace) Summarize() Summary {
+	s := Summary{
+		VantagePoint: t.VantagePoint.Type,
+		Events:       make(map[string]int),
+	}
+	var handshakeStart time.Duration
+	for _, e := range t.Events {
+		s.Events[e.Name]++
+		s.Duration = max(s.Duration, e.Offset())
+		switch e.Name {
+		case PacketSent:
+			s.PacketsSent++
+			n, _ := e.Int("size")
+			s.BytesSent += n
+		case PacketReceived:
+			s.PacketsReceived++
+			n, _ := e.Int("size")
+			s.BytesReceived += n
+		case PacketLost:
+			n, ok := e.Int("count")
+			if !ok {
+				n = 1
+			}
+			s.PacketsLost += int(n)
+		case StreamOpened:
+			s.StreamsOpened++
+		case HandshakeStarted:
+			handshakeStart = e.Offset()
+		case HandshakeCompleted:
+			s.HandshakeDuration = e.Offset() - handshakeStart
+		case HandshakeFailed:
+			s.HandshakeError, _ = e.Str("error")
+		case ConnectionClosed:
+			s.Closed = true
+		}
+	}
+	return s
+}
+
+func (s Summary) String() string {
+	var events int
+	for _, n := range s.Events {
+		events += n
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d events over %s", s.VantagePoint, events, s.Duration)
+	if s.HandshakeError != "" {
+		fmt.Fprintf(&b, ", handshake failed: %s", s.HandshakeError)
+	} else if s.HandshakeDuration > 0 {
+		fmt.Fprintf(&b, ", handshake %s", s.HandshakeDuration)
+	}
+	fmt.Fprintf(&b, ", %d streams, packets sent %d (%d B), received %d (%d B), lost %d",
+		s.StreamsOpened, s.PacketsSent, s.BytesSent, s.PacketsReceived, s.BytesReceived, s.PacketsLost)
+	return b.String()
+}
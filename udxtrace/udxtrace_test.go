@@ -0,0 +1,65 @@
+package udxtrace
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTrace = `{"qlog_format":"NDJSON","title":"libp2p-udx","vantage_point":{"type":"client"},"reference_time":1700000000000}
+{"time":0,"name":"connectivity:connection_started","data":{"local":"/ip4/127.0.0.1/udp/1/udx","remote":"/ip4/127.0.0.1/udp/2/udx"}}
+{"time":0.5,"name":"security:handshake_started"}
+{"time":1,"name":"transport:packet_sent","data":{"packet_number":1,"size":100}}
+{"time":2,"name":"transport:packet_received","data":{"packet_number":1,"size":40}}
+{"time":2.5,"name":"recovery:packet_lost","data":{"count":2}}
+{"time":3,"name":"security:handshake_completed","data":{"peer":"12D3KooW","security":"/libp2p-udx/handshake/1.0.0"}}
+{"time":4,"name":"transport:stream_opened","data":{"stream_id":2,"initiator":"local"}}
+{"time":10,"name":"connectivity:connection_closed"}
+`
+
+func TestRead(t *testing.T) {
+	tr, err := Read(strings.NewReader(testTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.VantagePoint.Type != "client" || !tr.Start().Equal(time.UnixMilli(1700000000000)) {
+		t.Fatalf("unexpected header %+v", tr.Header)
+	}
+	if len(tr.Events) != 8 {
+		t.Fatalf("expected 8 events, got %d", len(tr.Events))
+	}
+	if id, ok := tr.Filter(StreamOpened)[0].Int("stream_id"); !ok || id != 2 {
+		t.Fatalf("unexpected stream ID %d", id)
+	}
+
+	s := tr.Summarize()
+	want := Summary{
+		VantagePoint:      "client",
+		Duration:          10 * time.Millisecond,
+		PacketsSent:       1,
+		PacketsReceived:   1,
+		PacketsLost:       2,
+		BytesSent:         100,
+		BytesReceived:     40,
+		StreamsOpened:     1,
+		HandshakeDuration: 2500 * time.Microsecond,
+		Closed:            true,
+	}
+	if s.Events[PacketSent] != 1 || s.Events[ConnectionClosed] != 1 {
+		t.Fatalf("unexpected event counts %v", s.Events)
+	}
+	s.Events = nil
+	if !reflect.DeepEqual(s, want) {
+		t.Fatalf("got %+v, want %+v", s, want)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	if _, err := Read(strings.NewReader("")); err == nil {
+		t.Fatal("expected an error for an empty trace")
+	}
+	if _, err := Read(strings.NewReader(testTrace + "{\n")); err == nil {
+		t.Fatal("expected an error for a truncated event")
+	}
+}
@@ -0,0 +1,350 @@
+package udxtransport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	udx "github.com/stephanfeb/go-udx"
+)
+
+// AddressValidation says when a listener makes new sources prove they own
+// their address before their packets reach UDX, so spoofed handshake floods
+// don't tie up connection state and resource manager slots.
+//
+// A listener validating sources answers the packets of an unknown source
+// with a retry packet carrying a token, a MAC of the source's address and the
+// time under a secret of the transport. The dialer's transport sends the
+// token back, and once it checks out the source's packets go through. The
+// listener keeps no state for a source until then.
+type AddressValidation int
+
+const (
+	// ValidateNever lets every packet through, as UDX does on its own.
+	ValidateNever AddressValidation = iota
+	// ValidateUnderLoad validates new sources while the sources the
+	// listener admitted and UDX hasn't accepted a connection from yet take
+	// at least half of its half-open connection slots.
+	ValidateUnderLoad
+	// ValidateAlways validates every new source.
+	ValidateAlways
+)
+
+const (
+	packetRetry byte = 0xD9 // listener to dialer: payload is a token to send back
+	packetToken byte = 0xDA // dialer to listener: payload is the token of a retry
+
+	tokenLen = 8 + 16 // issue time in Unix nanoseconds, and a truncated HMAC-SHA256
+	// tokenForPath ends a token sent back for an established connection
+	// rather than a dial.
+	tokenForPath byte = 1
+	// tokenLifetime is how long a dialer has to send a token back.
+	tokenLifetime = 10 * time.Second
+	// tokenRotation is how often the token secret changes. Tokens under the
+	// previous secret stay valid, so it must not be shorter than
+	// tokenLifetime.
+	tokenRotation = time.Hour
+	// validatedIdle is how long a source stays validated after its last
+	// packet, well past the idle timeout of its connections.
+	validatedIdle = 10 * time.Minute
+	// announcedLifetime is how long a source that padded gets retries,
+	// well past the time its handshake may take.
+	announcedLifetime = tokenLifetime
+	// retryAmplification caps the size of a retry packet relative to the
+	// packet it answers, like QUIC's anti-amplification limit.
+	retryAmplification = 3
+)
+
+// tokenKeys issues and checks address validation tokens under a secret that
+// rotates every tokenRotation.
+type tokenKeys struct {
+	clock udx.Clock
+
+	mu        sync.Mutex
+	current   []byte
+	previous  []byte // nil until the first rotation
+	rotatedAt time.Time
+}
+
+func newTokenKeys(clock udx.Clock) *tokenKeys {
+	return &tokenKeys{clock: clock, current: newTokenSecret(), rotatedAt: clock.Now()}
+}
+
+func newTokenSecret() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}
+
+// secrets returns the current and previous secrets, rotating them if due.
+func (k *tokenKeys) secrets(now time.Time) (current, previous []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if now.Sub(k.rotatedAt) >= tokenRotation {
+		k.previous, k.current = k.current, newTokenSecret()
+		if now.Sub(k.rotatedAt) >= 2*tokenRotation {
+			k.previous = nil
+		}
+		k.rotatedAt = now
+	}
+	return k.current, k.previous
+}
+
+// issue returns a token for addr.
+func (k *tokenKeys) issue(addr netip.AddrPort) []byte {
+	now := k.clock.Now()
+	secret, _ := k.secrets(now)
+	token := make([]byte, 8, tokenLen)
+	binary.BigEndian.PutUint64(token, uint64(now.UnixNano()))
+	return append(token, tokenMAC(secret, token[:8], addr)...)
+}
+
+// valid reports whether token was issued for addr less than tokenLifetime
+// ago.
+func (k *tokenKeys) valid(token []byte, addr netip.AddrPort) bool {
+	if len(token) != tokenLen {
+		return false
+	}
+	now := k.clock.Now()
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(token[:8])))
+	if age := now.Sub(issued); age < 0 || age > tokenLifetime {
+		return false
+	}
+	current, previous := k.secrets(now)
+	for _, secret := range [][]byte{current, previous} {
+		if secret != nil && hmac.Equal(token[8:], tokenMAC(secret, token[:8], addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenMAC(secret, issued []byte, addr netip.AddrPort) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(issued)
+	ip := addr.Addr().As16()
+	mac.Write(ip[:])
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], addr.Port())
+	mac.Write(port[:])
+	return mac.Sum(nil)[:tokenLen-8]
+}
+
+// addrPortOf returns the address of a UDP source, with IPv4-mapped IPv6
+// addresses unmapped.
+func addrPortOf(addr net.Addr) (netip.AddrPort, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	ap := udpAddr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// sourceValidation is the address validation state of a socket.
+type sourceValidation struct {
+	tokens *tokenKeys
+
+	mu        sync.RWMutex
+	required  func() bool // whether new sources must be validated now; nil without a listener validating
+	validated map[netip.AddrPort]*atomic.Int64
+	swept     time.Time
+	budgets   map[netip.AddrPort]*amplificationBudget // of sources not validated
+	announced map[netip.AddrPort]time.Time            // when sources padded lately
+}
+
+// setValidation makes the socket validate new sources whenever required
+// returns true. A nil required stops validation.
+func (d *packetDemux) setValidation(required func() bool) {
+	d.sv.mu.Lock()
+	defer d.sv.mu.Unlock()
+	d.sv.required = required
+}
+
+// admit reports whether a packet from addr may go on to UDX. A source that
+// must be validated first gets a retry if it takes the transport's packets,
+// and is dropped otherwise: a stock go-udx or dart-libp2p dialer can't
+// answer a retry.
+func (d *packetDemux) admit(pkt []byte, addr net.Addr) bool {
+	d.sv.mu.RLock()
+	required := d.sv.required
+	d.sv.mu.RUnlock()
+	if required == nil || !required() {
+		return true
+	}
+	ap, ok := addrPortOf(addr)
+	if !ok || d.isValidated(ap) {
+		return true
+	}
+	if d.speaks(ap) {
+		d.sendRetry(pkt, addr, ap)
+	}
+	return false
+}
+
+// announce records that addr padded, which shows it takes the transport's
+// packets.
+func (d *packetDemux) announce(addr net.Addr) {
+	ap, ok := addrPortOf(addr)
+	if !ok {
+		return
+	}
+	now := d.clock.Now()
+	d.sv.mu.Lock()
+	defer d.sv.mu.Unlock()
+	if d.sv.announced == nil {
+		d.sv.announced = make(map[netip.AddrPort]time.Time)
+	}
+	if len(d.sv.announced) >= maxUnvalidatedSources {
+		for src, at := range d.sv.announced {
+			if now.Sub(at) >= announcedLifetime {
+				delete(d.sv.announced, src)
+			}
+		}
+	}
+	if len(d.sv.announced) >= maxUnvalidatedSources {
+		// Sources that padded and went quiet; they pad again on their
+		// next dial.
+		clear(d.sv.announced)
+	}
+	d.sv.announced[ap] = now
+}
+
+// announced reports whether ap padded less than announcedLifetime ago.
+func (d *packetDemux) announced(ap netip.AddrPort) bool {
+	d.sv.mu.RLock()
+	at, ok := d.sv.announced[ap]
+	d.sv.mu.RUnlock()
+	return ok && d.clock.Now().Sub(at) < announcedLifetime
+}
+
+// speaks reports whether ap takes the transport's packets, so a retry may
+// go to it: it padded lately, or a connection at its IP address negotiated
+// them (see connPath.negotiated). The latter covers a NAT that moves a
+// connection to a new port, but also reaches other hosts behind the NAT.
+func (d *packetDemux) speaks(ap netip.AddrPort) bool {
+	if d.announced(ap) {
+		return true
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.speakers[ap.Addr()] > 0
+}
+
+// sendRetry answers pkt, from ap, a source that has to prove its address,
+// with a retry, unless the retry would be too large an answer to it.
+func (d *packetDemux) sendRetry(pkt []byte, addr net.Addr, ap netip.AddrPort) {
+	if 1+tokenLen <= retryAmplification*len(pkt) {
+		retry := append([]byte{packetRetry}, d.sv.tokens.issue(ap)...)
+		d.PacketConn.WriteTo(retry, addr)
+	}
+}
+
+// answerRetry sends the token of a retry packet back to the listener, if a
+// dial to it is waiting for UDX's handshake or a connection to it is
+// established. A connection's packets reach the listener from an address it
+// doesn't know after a NAT rebinding or a move between networks, and the
+// answer for one ends in tokenForPath. The answer is at most that byte larger
+// than the retry, and only goes to addresses the transport dials or is
+// connected to, so a spoofed retry can't aim it elsewhere.
+func (d *packetDemux) answerRetry(pkt []byte, addr net.Addr) {
+	if len(pkt) != 1+tokenLen {
+		return
+	}
+	ap, ok := addrPortOf(addr)
+	if !ok {
+		return
+	}
+	answer := append([]byte{packetToken}, pkt[1:]...)
+	switch {
+	case d.dialing(ap):
+	case d.connected(ap):
+		answer = append(answer, tokenForPath)
+	default:
+		return
+	}
+	d.PacketConn.WriteTo(answer, addr)
+}
+
+// checkToken validates the source of a token packet if its token checks out.
+// A token sent back for an established connection also lets the source
+// through the listener's gate, like the sources the transport dials: it is
+// a new path, not a new connection. Should UDX accept a connection from it
+// all the same, the listener admits that connection when it's accepted.
+func (d *packetDemux) checkToken(pkt []byte, addr net.Addr) {
+	ap, ok := addrPortOf(addr)
+	if !ok {
+		return
+	}
+	token, path := pkt[1:], false
+	if len(token) == tokenLen+1 && token[tokenLen] == tokenForPath {
+		token, path = token[:tokenLen], true
+	}
+	if !d.sv.tokens.valid(token, ap) {
+		return
+	}
+	if path {
+		d.admitPath(ap)
+	} else {
+		d.allow(ap)
+	}
+}
+
+// allow validates a source: one that sent back a token, or one the
+// transport dials or punches a hole to.
+func (d *packetDemux) allow(ap netip.AddrPort) {
+	now := d.clock.Now()
+	d.sv.mu.Lock()
+	defer d.sv.mu.Unlock()
+	if d.sv.validated == nil {
+		d.sv.validated = make(map[netip.AddrPort]*atomic.Int64)
+	}
+	if now.Sub(d.sv.swept) >= validatedIdle {
+		for src, last := range d.sv.validated {
+			if now.Sub(time.Unix(0, last.Load())) >= validatedIdle {
+				delete(d.sv.validated, src)
+			}
+		}
+		d.sv.swept = now
+	}
+	last := new(atomic.Int64)
+	last.Store(now.UnixNano())
+	d.sv.validated[ap] = last
+	delete(d.sv.budgets, ap)
+}
+
+// isValidated reports whether ap is validated, keeping it so.
+func (d *packetDemux) isValidated(ap netip.AddrPort) bool {
+	d.sv.mu.RLock()
+	last := d.sv.validated[ap]
+	d.sv.mu.RUnlock()
+	if last == nil {
+		return false
+	}
+	now := d.clock.Now()
+	if now.Sub(time.Unix(0, last.Load())) >= validatedIdle {
+		return false
+	}
+	last.Store(now.UnixNano())
+	return true
+}
+
+// mustValidate reports whether new sources must prove their address before
+// reaching the listener's UDX multiplexer.
+func (l *rawListener) mustValidate() bool {
+	switch l.transport.validation {
+	case ValidateAlways:
+		return true
+	case ValidateUnderLoad:
+		l.admissionsMu.Lock()
+		defer l.admissionsMu.Unlock()
+		return 2*len(l.admissions) >= cap(l.halfOpen)
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package udxtransport
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// padding is what the transport's dialers send ahead of UDX's handshake.
+func padding() []byte {
+	p := make([]byte, dialPaddingLen)
+	p[0] = packetPadding
+	return p
+}
+
+func TestTokens(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	keys := newTokenKeys(clock)
+	addr := netip.MustParseAddrPort("192.0.2.1:4001")
+
+	token := keys.issue(addr)
+	if !keys.valid(token, addr) {
+		t.Fatal("fresh token isn't valid")
+	}
+	for _, other := range []string{"192.0.2.2:4001", "192.0.2.1:4002"} {
+		if keys.valid(token, netip.MustParseAddrPort(other)) {
+			t.Errorf("token valid for %s", other)
+		}
+	}
+	forged := bytes.Clone(token)
+	forged[len(forged)-1] ^= 1
+	if keys.valid(forged, addr) {
+		t.Error("forged token is valid")
+	}
+
+	clock.now = clock.now.Add(tokenLifetime + time.Second)
+	if keys.valid(token, addr) {
+		t.Error("expired token is valid")
+	}
+
+	// A token issued just before a rotation stays valid after it.
+	clock.now = clock.now.Add(tokenRotation - tokenLifetime)
+	token = keys.issue(addr)
+	clock.now = clock.now.Add(tokenLifetime)
+	if !keys.valid(token, addr) {
+		t.Error("token invalid after a rotation")
+	}
+}
+
+func TestAddressValidation(t *testing.T) {
+	// Dialing through a validating listener works.
+	for _, opts := range [][]Option{nil, {DisableNativeMultiplexing()}} {
+		connectedPeers(t, append(opts, WithAddressValidation(ValidateAlways))...)
+	}
+
+	// A source that doesn't answer the retry gets nowhere.
+	server := newTestTransport(t, nil, nil, WithAddressValidation(ValidateAlways))
+	defer server.Close()
+	ln, _, accepted := listenForTest(t, server)
+	key, err := udxAddrKey(ln.Multiaddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp4", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	// The source pads first, as the transport's dialers do: a source that
+	// didn't may be a stock UDX dialer, which can't take a retry.
+	hello := bytes.Repeat([]byte{0xFF}, 32)
+	src.WriteTo(hello, raddr)
+	buf := make([]byte, 1500)
+	src.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := src.ReadFrom(buf); err == nil {
+		t.Fatalf("got %x before padding", buf[:n])
+	}
+	src.WriteTo(padding(), raddr)
+	src.WriteTo(hello, raddr)
+	src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := src.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1+tokenLen || buf[0] != packetRetry {
+		t.Fatalf("got %x, want a retry", buf[:n])
+	}
+	retry := bytes.Clone(buf[:n])
+
+	// Packets too small to answer without amplifying them are dropped.
+	src.WriteTo(hello[:5], raddr)
+	src.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := src.ReadFrom(buf); err == nil {
+		t.Fatalf("got %x in answer to a 5 byte packet", buf[:n])
+	}
+
+	// Sending the token back validates the source, so no more retries.
+	src.WriteTo(append([]byte{packetToken}, retry[1:]...), raddr)
+	time.Sleep(50 * time.Millisecond)
+	src.WriteTo(hello, raddr)
+	src.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := src.ReadFrom(buf); err == nil && buf[0] == packetRetry {
+		t.Fatal("validated source got another retry")
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Fatal("listener accepted a connection from garbage")
+	default:
+	}
+
+	// A retry from an address the transport isn't dialing goes unanswered.
+	src.WriteTo(retry, raddr)
+	src.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := src.ReadFrom(buf); err == nil && buf[0] == packetToken {
+		t.Fatalf("got %x in answer to a retry nobody asked for", buf[:n])
+	}
+}
+
+func TestAddressValidationUnderLoad(t *testing.T) {
+	server := newTestTransport(t, nil, nil, WithAddressValidation(ValidateUnderLoad), WithMaxHalfOpenConns(4))
+	defer server.Close()
+	ln, err := server.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/udx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	raw := ln.(*listener).raw
+	key, err := udxAddrKey(ln.Multiaddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp4", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admissions := func() int {
+		raw.admissionsMu.Lock()
+		defer raw.admissionsMu.Unlock()
+		return len(raw.admissions)
+	}
+
+	// Sources whose handshakes UDX never completes pile up as admissions,
+	// until half of the half-open slots are taken and validation starts.
+	hello := bytes.Repeat([]byte{0xFF}, 32)
+	buf := make([]byte, 1500)
+	for i, validated := range []bool{false, false, true, true} {
+		src, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		src.WriteTo(padding(), raddr)
+		src.WriteTo(hello, raddr)
+		src.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := src.ReadFrom(buf)
+		if retried := err == nil && n > 0 && buf[0] == packetRetry; retried != validated {
+			t.Fatalf("source %d with %d admissions: retried = %v, want %v", i, admissions(), retried, validated)
+		}
+		if !validated && admissions() != i+1 {
+			t.Fatalf("source %d wasn't admitted", i)
+		}
+	}
+	if !raw.mustValidate() {
+		t.Error("mustValidate = false with half of the half-open slots admitted")
+	}
+}